@@ -0,0 +1,138 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the access log sink safely
+// static inline void call_log_sink(asgi_log_fn sink, const char* line) {
+//     if (sink == NULL) return;
+//     sink(line);
+// }
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Formats of the access log
+const (
+	accessLogOff int32 = iota
+	// One JSON object per line
+	accessLogJSON
+	// Apache combined log format
+	accessLogCombined
+)
+
+var (
+	accessLogFormat atomic.Int32
+
+	accessLogFormats = map[string]int32{
+		"off":      accessLogOff,
+		"json":     accessLogJSON,
+		"combined": accessLogCombined,
+	}
+
+	// Receives access log lines instead of stdout when set, guarded by accessLogSinkMu
+	accessLogSinkMu sync.RWMutex
+	accessLogSink   C.asgi_log_fn
+)
+
+// accessLogEntry is one line of the JSON access log
+type accessLogEntry struct {
+	Time     string `json:"time"`
+	ClientIP string `json:"client_ip"`
+	*responseStats
+}
+
+//export SetLogFormat
+func SetLogFormat(format *C.char) *C.char {
+	name := C.GoString(format)
+	value, ok := accessLogFormats[name]
+	if !ok {
+		return C.CString(fmt.Sprintf("Unknown log format: %s (expected json, combined or off)", name))
+	}
+	accessLogFormat.Store(value)
+	return C.CString(fmt.Sprintf("Access log format set to %s", name))
+}
+
+//export RegisterAccessLogSink
+func RegisterAccessLogSink(sink C.asgi_log_fn) *C.char {
+	accessLogSinkMu.Lock()
+	accessLogSink = sink
+	accessLogSinkMu.Unlock()
+
+	if sink == nil {
+		return C.CString("Access log sink cleared, logging to stdout")
+	}
+	return C.CString("Access log sink registered")
+}
+
+// logAccess writes the access log line of a finished request in the
+// configured format, when access logging is on
+func logAccess(r *http.Request, start time.Time, stats *responseStats) {
+	format := accessLogFormat.Load()
+	if format == accessLogOff {
+		return
+	}
+
+	clientIP, _ := splitHostPort(r.RemoteAddr, "-", "")
+	var line string
+	if format == accessLogJSON {
+		entry, _ := json.Marshal(accessLogEntry{
+			Time:          start.UTC().Format(time.RFC3339Nano),
+			ClientIP:      clientIP,
+			responseStats: stats,
+		})
+		line = string(entry)
+	} else {
+		line = combinedLogLine(r, clientIP, stats.Status, stats.Bytes, start)
+	}
+	writeAccessLog(line)
+}
+
+// combinedLogLine formats a request in the Apache combined log format
+func combinedLogLine(r *http.Request, clientIP string, status int, bytes int64, start time.Time) string {
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s",
+		clientIP, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto),
+		status, size,
+		quoteLogField(r.Referer()), quoteLogField(r.UserAgent()))
+}
+
+// quoteLogField quotes a header value for the combined log, "-" when empty
+func quoteLogField(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	return strconv.Quote(value)
+}
+
+// writeAccessLog hands a line to the registered sink, or prints it
+func writeAccessLog(line string) {
+	accessLogSinkMu.RLock()
+	sink := accessLogSink
+	accessLogSinkMu.RUnlock()
+
+	if sink == nil {
+		fmt.Println(line)
+		return
+	}
+	cLine := C.CString(line)
+	defer C.free(unsafe.Pointer(cLine))
+	C.call_log_sink(sink, cLine)
+}
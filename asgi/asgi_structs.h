@@ -3,6 +3,7 @@
 
 #include <stdlib.h>
 #include <stdbool.h>
+#include <stdint.h>
 
 // String representation
 typedef struct {
@@ -30,6 +31,18 @@ typedef struct {
     unsigned char* body;
     size_t body_length;
     bool more_body;
+    asgi_string traceparent; // W3C traceparent to propagate on downstream calls
+    asgi_string http_version;
+    asgi_string request_target; // as sent, e.g. "/a?b" or absolute-form "http://host/a?b"
+    asgi_string type; // "http.request", "websocket.connect", "websocket.receive" or "websocket.disconnect"
+    bool body_is_text; // websocket.receive: the body is a text frame rather than a binary one
+    asgi_header* path_params; // segments captured by the route pattern, e.g. "id" for /users/:id
+    size_t path_params_count;
+    asgi_header* query_params; // decoded query parameters, one entry per value
+    size_t query_params_count;
+    int64_t content_length; // declared Content-Length, -1 when unknown (e.g. chunked)
+    asgi_string* subprotocols; // WebSocket subprotocols offered by the client, in order of preference
+    size_t subprotocols_count;
 } asgi_event;
 
 // ASGI response
@@ -40,9 +53,82 @@ typedef struct {
     size_t headers_count;
     unsigned char* body;
     size_t body_length;
+    bool more_body; // more body chunks follow through StreamResponseChunk
+    // Trailing headers sent after the body. On a streamed response the first
+    // response declares them and the last chunk may carry their final values.
+    asgi_header* trailers;
+    size_t trailers_count;
+    // When set, the body is streamed from this file instead of body, with
+    // Range and conditional requests answered for a 200 response
+    asgi_string file_path;
+    // Serve a single byte range of a complete 200 body with 206 when the
+    // request asks for one, as SetHonorRangeOnCallbackResponses does for all
+    bool honor_range;
 } asgi_response;
 
 // Callback function type
+//
+// With EnableDisconnectEvents, HTTP routes also receive an http.disconnect
+// event when the client goes away before the response is written. It is
+// delivered after the callback for the last http.request event has
+// returned, at most once per request, and its response is ignored.
+//
+// With EnableExpectContinueEvents, a request sent with Expect: 100-continue
+// first reaches the callback as an http.expect event, with the headers and
+// content_length but no body. A response with status >= 400 refuses the
+// upload with 417 before the client sends it; NULL or any other status lets
+// the body be read and the http.request events follow as usual.
+//
+// On WebSocket routes the callback also receives the websocket.* events:
+// - websocket.connect: a response with status 101 or 200 accepts the
+//   connection (its headers go on the handshake); any other response, or
+//   NULL, rejects it with that status or 403. The event lists the offered
+//   subprotocols; a Sec-WebSocket-Protocol header on the response picks one
+//   of them, and a value the client did not offer is dropped.
+// - websocket.receive: called once per frame. A response whose status is a
+//   close code (1000-4999) closes the connection with its body as the
+//   reason; otherwise a non-empty body is sent back, as a text frame if its
+//   Content-Type is text/*, binary for any other type, and as the same kind
+//   as the received frame when unset. NULL sends nothing.
+// - websocket.disconnect: the body holds the close code as decimal text.
+//   The response is ignored.
 typedef asgi_response* (*asgi_callback_fn)(asgi_event*);
 
+// Scope hook function type: runs after the event is built and before the
+// callback is dispatched. It may rewrite the event in place (replacing any
+// asgi_string it changes with a malloc'ed one) and returns NULL to continue,
+// or a response to short-circuit the callback.
+typedef asgi_response* (*asgi_scope_hook_fn)(asgi_event*);
+
+// Response hook function type: runs on every callback response right before
+// it is written. It may change the status and replace the headers array
+// (malloc'ed, the old one freed) to add or remove headers.
+typedef void (*asgi_response_hook_fn)(asgi_response*);
+
+// Body transform function type: runs on every complete callback response
+// body before it is written, with the response Content-Type ("" if unset).
+// It may replace body/body_length with a malloc'ed buffer (freeing the old
+// one) or leave the response untouched when the type does not apply.
+typedef void (*asgi_body_transform_fn)(const char* content_type, asgi_response*);
+
+// Connection callback function type: runs when a connection is accepted,
+// before any request is read, with the remote address ("host:port").
+// Returning false rejects the connection, which is closed immediately.
+typedef bool (*asgi_connection_fn)(const char* remote_addr);
+
+// Raw callback function type: receives the raw request bytes (request line,
+// headers and body) and returns the raw response bytes to send back.
+// The request is freed by the server once the callback returns; the returned
+// asgi_string and its data must be malloc'ed and are freed by the server.
+typedef asgi_string* (*asgi_raw_callback_fn)(asgi_string*);
+
+// Request ID generator function type: runs once per request with its
+// method, path and client address ("host:port"). Returns a malloc'ed
+// NUL-terminated ID, freed by the server, or NULL for the built-in ID.
+typedef char* (*asgi_request_id_fn)(const char* method, const char* path, const char* client);
+
+// Access log sink function type: receives each access log line, without a
+// trailing newline. The line is freed by the server once the sink returns.
+typedef void (*asgi_log_fn)(const char* line);
+
 #endif // ASGI_STRUCTS_H
\ No newline at end of file
@@ -0,0 +1,109 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Realm announced in basic auth challenges
+const basicAuthRealm = "Restricted"
+
+// basicAuthRule guards the paths under a prefix with one set of credentials,
+// kept as hashes so comparing them takes the same time whatever their length
+type basicAuthRule struct {
+	prefix   string
+	username [sha256.Size]byte
+	password [sha256.Size]byte
+}
+
+var (
+	// Serializes updates of basicAuthRules
+	basicAuthMu sync.Mutex
+	// Guarded prefixes, longest first so the most specific rule applies
+	basicAuthRules atomic.Pointer[[]basicAuthRule]
+)
+
+//export RequireBasicAuth
+func RequireBasicAuth(pathPrefix *C.char, username *C.char, password *C.char) *C.char {
+	prefix := C.GoString(pathPrefix)
+	user := C.GoString(username)
+	if !strings.HasPrefix(prefix, "/") {
+		return C.CString(fmt.Sprintf("Path prefix must start with /: %s", prefix))
+	}
+
+	basicAuthMu.Lock()
+	defer basicAuthMu.Unlock()
+
+	var rules []basicAuthRule
+	if current := basicAuthRules.Load(); current != nil {
+		rules = slices.DeleteFunc(slices.Clone(*current), func(rule basicAuthRule) bool {
+			return rule.prefix == prefix
+		})
+	}
+
+	// An empty username lifts the requirement
+	if user == "" {
+		basicAuthRules.Store(&rules)
+		return C.CString(fmt.Sprintf("Basic auth removed for: %s", prefix))
+	}
+
+	rules = append(rules, basicAuthRule{
+		prefix:   prefix,
+		username: sha256.Sum256([]byte(user)),
+		password: sha256.Sum256([]byte(C.GoString(password))),
+	})
+	slices.SortFunc(rules, func(a, b basicAuthRule) int { return len(b.prefix) - len(a.prefix) })
+	basicAuthRules.Store(&rules)
+	return C.CString(fmt.Sprintf("Basic auth required for: %s", prefix))
+}
+
+// underPrefix reports whether path is prefix or below it. A prefix without
+// a trailing slash matches whole segments only, so /admin does not guard
+// /administrator.
+func underPrefix(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// checkBasicAuth enforces the basic auth rule covering the request path,
+// answering 401 with a challenge and returning false when the request lacks
+// matching credentials
+func checkBasicAuth(w http.ResponseWriter, r *http.Request) bool {
+	rules := basicAuthRules.Load()
+	if rules == nil {
+		return true
+	}
+	index := slices.IndexFunc(*rules, func(rule basicAuthRule) bool {
+		return underPrefix(r.URL.Path, rule.prefix)
+	})
+	if index < 0 {
+		return true
+	}
+	rule := (*rules)[index]
+
+	if user, password, ok := r.BasicAuth(); ok {
+		userHash := sha256.Sum256([]byte(user))
+		passwordHash := sha256.Sum256([]byte(password))
+		// Both are compared, so a wrong username takes as long as a wrong password
+		userMatch := subtle.ConstantTimeCompare(userHash[:], rule.username[:])
+		passwordMatch := subtle.ConstantTimeCompare(passwordHash[:], rule.password[:])
+		if userMatch&passwordMatch == 1 {
+			return true
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, basicAuthRealm))
+	writeError(w, http.StatusUnauthorized, "Authentication required")
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// requireBasicAuth guards prefix with the given credentials until the test
+// ends, as RequireBasicAuth does
+func requireBasicAuth(t *testing.T, prefix, user, password string) {
+	t.Helper()
+	var rules []basicAuthRule
+	if current := basicAuthRules.Load(); current != nil {
+		rules = slices.Clone(*current)
+	}
+	rules = append(rules, basicAuthRule{
+		prefix:   prefix,
+		username: sha256.Sum256([]byte(user)),
+		password: sha256.Sum256([]byte(password)),
+	})
+	slices.SortFunc(rules, func(a, b basicAuthRule) int { return len(b.prefix) - len(a.prefix) })
+	basicAuthRules.Store(&rules)
+	t.Cleanup(func() { basicAuthRules.Store(nil) })
+}
+
+func TestUnderPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   bool
+	}{
+		{"/admin", "/admin", true},
+		{"/admin/", "/admin", true},
+		{"/admin/users", "/admin", true},
+		{"/administrator", "/admin", false},
+		{"/adm", "/admin", false},
+		{"/admin/users", "/admin/", true},
+		{"/admin", "/admin/", false},
+		{"/anything", "/", true},
+	}
+	for _, tt := range tests {
+		if got := underPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("underPrefix(%q, %q) = %v, want %v", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	requireBasicAuth(t, "/admin", "alice", "secret")
+	requireBasicAuth(t, "/admin/ops", "bob", "hunter2")
+	handlePrefix(t, "/admin", "admin")
+	handleBody(t, "/administrator", "open")
+
+	tests := []struct {
+		name     string
+		path     string
+		user     string
+		password string
+		want     int
+	}{
+		{"no credentials", "/admin/users", "", "", http.StatusUnauthorized},
+		{"right credentials", "/admin/users", "alice", "secret", http.StatusOK},
+		{"wrong password", "/admin/users", "alice", "wrong", http.StatusUnauthorized},
+		{"wrong username", "/admin/users", "mallory", "secret", http.StatusUnauthorized},
+		{"longest prefix applies", "/admin/ops/restart", "bob", "hunter2", http.StatusOK},
+		{"shorter prefix credentials", "/admin/ops/restart", "alice", "secret", http.StatusUnauthorized},
+		{"outside the prefix", "/administrator", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			dispatch(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d", w.Code, tt.want)
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if tt.want == http.StatusUnauthorized && challenge != `Basic realm="Restricted", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+			if tt.want == http.StatusOK && challenge != "" {
+				t.Errorf("allowed request was challenged with %q", challenge)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Request bodies are read in chunks of this size unless configured otherwise
+	defaultBodyChunkSize = 64 * 1024
+	// Bounds for SetBodyChunkSize
+	minBodyChunkSize = 1024
+	maxBodyChunkSize = 16 * 1024 * 1024
+	// Uploads are not held to the minimum rate during their first seconds
+	uploadRateGracePeriod = 5 * time.Second
+)
+
+var (
+	// Size of each read from a request body
+	bodyChunkSize atomic.Int64
+	// Minimum average upload rate of a request body, 0 when unlimited
+	minUploadBytesPerSec atomic.Int64
+	// When set, request bodies reach the callback one chunk per event
+	streamRequestBodies atomic.Bool
+	// Largest request body accepted, 0 when unlimited
+	maxRequestBodySize atomic.Int64
+)
+
+// errUploadTooSlow reports a request body arriving below the minimum rate
+var errUploadTooSlow = errors.New("request body upload below minimum rate")
+
+func init() {
+	bodyChunkSize.Store(defaultBodyChunkSize)
+}
+
+//export SetBodyChunkSize
+func SetBodyChunkSize(bytes int) *C.char {
+	if bytes <= 0 {
+		return C.CString("Body chunk size must be > 0")
+	}
+	size := min(max(bytes, minBodyChunkSize), maxBodyChunkSize)
+	bodyChunkSize.Store(int64(size))
+	return C.CString(fmt.Sprintf("Body chunk size set to %d bytes", size))
+}
+
+// readBody reads a request body in chunks of the configured size
+func readBody(body io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	chunk := make([]byte, bodyChunkSize.Load())
+	for {
+		n, err := body.Read(chunk)
+		buf.Write(chunk[:n])
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return buf.Bytes(), err
+		}
+	}
+}
+
+// requestBodyKey is the context key for the buffer holding a request body
+type requestBodyKey struct{}
+
+// bufferedBody holds a request body once it has been read, for every later
+// reader of the same request
+type bufferedBody struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// withBodyBuffer gives r, and every copy made of it from here on, a shared
+// buffer for its body
+func withBodyBuffer(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestBodyKey{}, &bufferedBody{}))
+}
+
+// readRequestBody reads the whole body of r, from the client the first time
+// and from the buffer on the request context after that, so every reader gets
+// the complete body. r.Body is left as a reader over the buffered bytes for
+// code reading it directly. A failed read fails every later call the same way.
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	buffered, ok := r.Context().Value(requestBodyKey{}).(*bufferedBody)
+	if !ok {
+		// A request that did not come through dispatch keeps the buffer in
+		// its body only
+		buffered = &bufferedBody{}
+	}
+	buffered.once.Do(func() {
+		buffered.data, buffered.err = readBody(r.Body)
+		r.Body.Close()
+	})
+	r.Body = io.NopCloser(bytes.NewReader(buffered.data))
+	return buffered.data, buffered.err
+}
+
+//export SetStreamRequestBodies
+func SetStreamRequestBodies(enabled bool) *C.char {
+	streamRequestBodies.Store(enabled)
+	return C.CString(fmt.Sprintf("Request body streaming enabled: %t", enabled))
+}
+
+// readBodyChunk reads the next chunk of a request body, of the configured
+// size unless the body ends first, and reports whether more may follow
+func readBodyChunk(body io.Reader) ([]byte, bool, error) {
+	chunk := make([]byte, bodyChunkSize.Load())
+	n, err := io.ReadFull(body, chunk)
+	switch err {
+	case nil:
+		return chunk[:n], true, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return chunk[:n], false, nil
+	default:
+		return chunk[:n], false, err
+	}
+}
+
+//export SetMaxRequestBodySize
+func SetMaxRequestBodySize(bytes int) *C.char {
+	if bytes < 0 {
+		return C.CString("Maximum request body size must be >= 0")
+	}
+	maxRequestBodySize.Store(int64(bytes))
+	if bytes == 0 {
+		return C.CString("Maximum request body size disabled")
+	}
+	return C.CString(fmt.Sprintf("Maximum request body size set to %d bytes", bytes))
+}
+
+// limitRequestBodySize caps the request body at the configured size. A
+// request declaring a larger Content-Length is answered with 413 right away
+// and false is returned; a body growing past the limit fails reading with
+// *http.MaxBytesError.
+func limitRequestBodySize(w http.ResponseWriter, r *http.Request) bool {
+	limit := maxRequestBodySize.Load()
+	if limit == 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		w.Header().Set("Connection", "close")
+		writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+//export SetMinUploadBytesPerSec
+func SetMinUploadBytesPerSec(bytesPerSec int) *C.char {
+	if bytesPerSec < 0 {
+		return C.CString("Minimum upload rate must be >= 0")
+	}
+	minUploadBytesPerSec.Store(int64(bytesPerSec))
+	if bytesPerSec == 0 {
+		return C.CString("Minimum upload rate disabled")
+	}
+	return C.CString(fmt.Sprintf("Minimum upload rate set to %d bytes/s", bytesPerSec))
+}
+
+// limitUploadRate makes reading the request body fail with errUploadTooSlow
+// once its average rate stays below the configured minimum past the grace
+// period, so a client trickling the body cannot hold the handler
+func limitUploadRate(w http.ResponseWriter, r *http.Request) {
+	rate := minUploadBytesPerSec.Load()
+	if rate == 0 || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	body := &minRateBody{
+		ReadCloser: r.Body,
+		controller: http.NewResponseController(w),
+		rate:       rate,
+		start:      time.Now(),
+	}
+	// The server's read timeout still bounds the whole body
+	if timeout := time.Duration(serverReadTimeout.Load()); timeout > 0 {
+		body.readDeadline = body.start.Add(timeout)
+	}
+	r.Body = body
+}
+
+// minRateBody enforces a minimum average rate on a request body
+type minRateBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	rate       int64
+	start      time.Time
+	read       int64
+	// Deadline set by the server's read timeout, zero when there is none
+	readDeadline time.Time
+}
+
+func (b *minRateBody) Read(p []byte) (int, error) {
+	// Without new data the average drops below the floor at this point, so
+	// a read still blocked then has stalled. Computed in float64, as bytes
+	// times nanoseconds overflows on large bodies.
+	allowed := uploadRateGracePeriod
+	if stalled := float64(b.read) / float64(b.rate) * float64(time.Second); stalled > float64(allowed) {
+		allowed = time.Duration(min(stalled, math.MaxInt64/2))
+	}
+	deadline := b.start.Add(allowed)
+	if !b.readDeadline.IsZero() && b.readDeadline.Before(deadline) {
+		deadline = b.readDeadline
+	}
+	deadlineErr := b.controller.SetReadDeadline(deadline)
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if deadlineErr == nil {
+		b.controller.SetReadDeadline(b.readDeadline)
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) && !deadline.Equal(b.readDeadline) {
+		return n, errUploadTooSlow
+	}
+	// Connections without deadline support are checked between reads
+	if err == nil {
+		if elapsed := time.Since(b.start); elapsed > uploadRateGracePeriod &&
+			float64(b.read) < float64(b.rate)*elapsed.Seconds() {
+			return n, errUploadTooSlow
+		}
+	}
+	return n, err
+}
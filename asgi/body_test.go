@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// BenchmarkBodyChunkSize delivers a large upload in chunks of each size,
+// reporting the chunks, and so callback events, per upload
+func BenchmarkBodyChunkSize(b *testing.B) {
+	defer bodyChunkSize.Store(defaultBodyChunkSize)
+	upload := bytes.Repeat([]byte("x"), 16*1024*1024)
+	for _, size := range []int{minBodyChunkSize, 16 * 1024, defaultBodyChunkSize, 1024 * 1024} {
+		b.Run(fmt.Sprintf("chunk=%d", size), func(b *testing.B) {
+			bodyChunkSize.Store(int64(size))
+			b.SetBytes(int64(len(upload)))
+			chunks := 0
+			for b.Loop() {
+				chunks = 0
+				body := bytes.NewReader(upload)
+				for more := true; more; chunks++ {
+					var err error
+					if _, more, err = readBodyChunk(body); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(chunks), "chunks/op")
+		})
+	}
+}
+
+// trickle writes body to w one byte every interval
+func trickle(w io.Writer, body []byte, interval time.Duration) {
+	for i := range body {
+		if _, err := w.Write(body[i : i+1]); err != nil {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// pastGracePeriod returns a minRateBody over body, limited to rate bytes per
+// second, whose upload started a grace period ago
+func pastGracePeriod(w http.ResponseWriter, body io.ReadCloser, rate int64) *minRateBody {
+	return &minRateBody{
+		ReadCloser: body,
+		controller: http.NewResponseController(w),
+		rate:       rate,
+		start:      time.Now().Add(-uploadRateGracePeriod),
+	}
+}
+
+func TestSlowUploadAborted(t *testing.T) {
+	// A connection with read deadlines is cut off while waiting for data
+	results := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(pastGracePeriod(w, r.Body, 1000))
+		results <- err
+	}))
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n")
+	go trickle(conn, bytes.Repeat([]byte("x"), 100), 10*time.Millisecond)
+	select {
+	case err := <-results:
+		if !errors.Is(err, errUploadTooSlow) {
+			t.Errorf("slow upload over a connection: got %v, want errUploadTooSlow", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow upload over a connection was not aborted")
+	}
+
+	// Without read deadlines the rate is checked as data arrives
+	pr, pw := io.Pipe()
+	go trickle(pw, bytes.Repeat([]byte("x"), 100), 10*time.Millisecond)
+	_, err = io.ReadAll(pastGracePeriod(httptest.NewRecorder(), pr, 1000))
+	pr.Close()
+	if !errors.Is(err, errUploadTooSlow) {
+		t.Errorf("slow upload without deadlines: got %v, want errUploadTooSlow", err)
+	}
+}
+
+func TestFastUploadAllowed(t *testing.T) {
+	// Six seconds' worth at 1000 bytes/s arrives in one read
+	upload := bytes.Repeat([]byte("x"), 6000)
+	body := pastGracePeriod(httptest.NewRecorder(), io.NopCloser(bytes.NewReader(upload)), 1000)
+	buf := make([]byte, 2*len(upload))
+	if n, err := body.Read(buf); n != len(upload) || err != nil {
+		t.Errorf("fast upload: read %d bytes, %v, want %d bytes", n, err, len(upload))
+	}
+	if _, err := body.Read(buf); err != io.EOF {
+		t.Errorf("end of the fast upload: got %v, want EOF", err)
+	}
+}
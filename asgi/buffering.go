@@ -0,0 +1,77 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Size of the buffer wrapped around response writes (0 = net/http's own buffering)
+	responseBufferSize atomic.Int64
+
+	// Reusable response buffers, sized to the configured buffer size
+	responseBufferPool sync.Pool
+)
+
+//export SetResponseBufferSize
+func SetResponseBufferSize(bytes int) *C.char {
+	if bytes < 0 {
+		return C.CString("Response buffer size must be >= 0")
+	}
+	responseBufferSize.Store(int64(bytes))
+	if bytes == 0 {
+		return C.CString("Response buffering disabled")
+	}
+	return C.CString(fmt.Sprintf("Response buffer size set to %d bytes", bytes))
+}
+
+// bufferedResponseWriter collects body writes in a bufio.Writer. Flush pushes
+// the buffer through immediately, so streaming writes are never held back.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	buf *bufio.Writer
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *bufferedResponseWriter) Flush() {
+	b.buf.Flush()
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (b *bufferedResponseWriter) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
+
+// bufferResponse wraps w in a buffer of the configured size. The returned
+// function flushes the buffer and must be called when the handler is done.
+func bufferResponse(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	size := int(responseBufferSize.Load())
+	if size == 0 {
+		return w, func() {}
+	}
+
+	buf, ok := responseBufferPool.Get().(*bufio.Writer)
+	if !ok || buf.Size() != size {
+		buf = bufio.NewWriterSize(w, size)
+	} else {
+		buf.Reset(w)
+	}
+
+	return &bufferedResponseWriter{ResponseWriter: w, buf: buf}, func() {
+		buf.Flush()
+		buf.Reset(nil)
+		responseBufferPool.Put(buf)
+	}
+}
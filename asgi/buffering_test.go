@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBufferedResponseFlush(t *testing.T) {
+	responseBufferSize.Store(64)
+	defer responseBufferSize.Store(0)
+
+	rec := httptest.NewRecorder()
+	w, flush := bufferResponse(rec)
+	w.Write([]byte("held"))
+	if rec.Body.Len() != 0 {
+		t.Error("write reached the client before the buffer filled")
+	}
+	// Streaming writes are pushed through by Flush
+	w.(http.Flusher).Flush()
+	if rec.Body.String() != "held" || !rec.Flushed {
+		t.Errorf("after Flush the client has %q, flushed %t", rec.Body.String(), rec.Flushed)
+	}
+	w.Write([]byte(" rest"))
+	flush()
+	if rec.Body.String() != "held rest" {
+		t.Errorf("after the final flush the client has %q", rec.Body.String())
+	}
+}
+
+// BenchmarkResponseBufferSize serves small and large bodies over loopback,
+// written in 1 KiB pieces as the C buffer reader does, for several buffer sizes
+func BenchmarkResponseBufferSize(b *testing.B) {
+	defer responseBufferSize.Store(0)
+	piece := bytes.Repeat([]byte("x"), 1024)
+
+	for _, bodySize := range []int{1 << 10, 1 << 20} {
+		for _, bufferSize := range []int{0, 16 << 10, 64 << 10} {
+			b.Run(fmt.Sprintf("body=%d/buffer=%d", bodySize, bufferSize), func(b *testing.B) {
+				responseBufferSize.Store(int64(bufferSize))
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					bw, flush := bufferResponse(w)
+					defer flush()
+					for written := 0; written < bodySize; written += len(piece) {
+						bw.Write(piece)
+					}
+				}))
+				defer ts.Close()
+
+				b.SetBytes(int64(bodySize))
+				for b.Loop() {
+					resp, err := ts.Client().Get(ts.URL)
+					if err != nil {
+						b.Fatal(err)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"context"
+	"sync"
+)
+
+// Contexts of the requests being handled, by request ID
+var requestContexts sync.Map
+
+// trackRequestContext makes the request's cancellation visible through
+// IsRequestCancelled until the returned function is called
+func trackRequestContext(requestId string, ctx context.Context) func() {
+	requestContexts.Store(requestId, ctx)
+	return func() { requestContexts.Delete(requestId) }
+}
+
+// IsRequestCancelled reports whether the client of a request has gone away
+// or the request was otherwise abandoned, e.g. by timing out. Requests that
+// are no longer being handled count as cancelled.
+//
+//export IsRequestCancelled
+func IsRequestCancelled(requestId *C.char) C.bool {
+	value, ok := requestContexts.Load(C.GoString(requestId))
+	if !ok {
+		return C.bool(true)
+	}
+	return C.bool(value.(context.Context).Err() != nil)
+}
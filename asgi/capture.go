@@ -0,0 +1,246 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest request body stored per captured request
+	captureMaxBodyBytes = 64 * 1024
+	// Replacement for the values of redacted headers
+	captureRedacted = "[REDACTED]"
+)
+
+// capturedRequest is one line of a request capture file
+type capturedRequest struct {
+	Time          time.Time           `json:"time"`
+	Method        string              `json:"method"`
+	Target        string              `json:"target"`
+	Host          string              `json:"host"`
+	RemoteAddr    string              `json:"remote_addr"`
+	Headers       map[string][]string `json:"headers"`
+	Body          []byte              `json:"body"`
+	BodyTruncated bool                `json:"body_truncated"`
+}
+
+// replayedRequest is the outcome of replaying one captured request
+type replayedRequest struct {
+	Method string `json:"method"`
+	Target string `json:"target"`
+	Status int    `json:"status"`
+	// Why the request could not be replayed, when it could not
+	Error string `json:"error,omitempty"`
+}
+
+// replayKey marks replayed requests so they are not captured again
+type replayKey struct{}
+
+var (
+	// Capture state, guarded by captureMu
+	captureMu        sync.Mutex
+	captureFile      *os.File
+	captureRemaining int
+
+	// Headers whose values are never written to a capture file
+	captureRedactedHeaders = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+	}
+)
+
+//export EnableRequestCapture
+func EnableRequestCapture(path *C.char, maxRequests int) *C.char {
+	if maxRequests <= 0 {
+		return C.CString("Max captured requests must be > 0")
+	}
+	file, err := os.OpenFile(C.GoString(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error opening capture file: %v", err))
+	}
+
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if captureFile != nil {
+		captureFile.Close()
+	}
+	captureFile, captureRemaining = file, maxRequests
+	return C.CString(fmt.Sprintf("Capturing up to %d requests to %s", maxRequests, file.Name()))
+}
+
+//export DisableRequestCapture
+func DisableRequestCapture() *C.char {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	stopCaptureLocked()
+	return C.CString("Request capture disabled")
+}
+
+//export SetCaptureRedactedHeaders
+func SetCaptureRedactedHeaders(names *C.char) *C.char {
+	// names is a comma-separated list of header names
+	redacted := make(map[string]bool)
+	for _, name := range strings.Split(C.GoString(names), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redacted[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+
+	captureMu.Lock()
+	captureRedactedHeaders = redacted
+	captureMu.Unlock()
+	return C.CString(fmt.Sprintf("%d headers redacted from captures", len(redacted)))
+}
+
+// stopCaptureLocked closes the capture file. The caller holds captureMu.
+func stopCaptureLocked() {
+	if captureFile != nil {
+		captureFile.Close()
+	}
+	captureFile, captureRemaining = nil, 0
+}
+
+// captureRequest starts capturing the request while capture is enabled and
+// returns the function appending it to the capture file once the request
+// has been handled. The body is recorded as the handler reads it, up to
+// captureMaxBodyBytes, so capturing neither reads ahead of the body limits
+// nor answers an Expect: 100-continue on behalf of the handler.
+func captureRequest(r *http.Request) func() {
+	if r.Context().Value(replayKey{}) != nil {
+		return func() {}
+	}
+
+	captureMu.Lock()
+	if captureFile == nil {
+		captureMu.Unlock()
+		return func() {}
+	}
+	entry := capturedRequest{
+		Time:       time.Now().UTC(),
+		Method:     r.Method,
+		Target:     r.RequestURI,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Headers:    make(map[string][]string, len(r.Header)),
+	}
+	for name, values := range r.Header {
+		if captureRedactedHeaders[name] {
+			values = []string{captureRedacted}
+		}
+		entry.Headers[name] = values
+	}
+	captureMu.Unlock()
+
+	var body *capturedBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &capturedBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	return func() {
+		if body != nil {
+			entry.Body, entry.BodyTruncated = body.head, body.truncated
+		}
+		line, _ := json.Marshal(entry)
+
+		captureMu.Lock()
+		defer captureMu.Unlock()
+		// Capture may have ended while the request was handled
+		if captureFile == nil {
+			return
+		}
+		if _, err := captureFile.Write(append(line, '\n')); err != nil {
+			fmt.Printf("Request capture error: %v\n", err)
+			stopCaptureLocked()
+			return
+		}
+
+		captureRemaining--
+		if captureRemaining == 0 {
+			stopCaptureLocked()
+		}
+	}
+}
+
+// capturedBody records the head of a request body as it is read
+type capturedBody struct {
+	io.ReadCloser
+	head      []byte
+	truncated bool
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	keep := min(n, max(captureMaxBodyBytes-len(b.head), 0))
+	b.head = append(b.head, p[:keep]...)
+	if n > keep {
+		b.truncated = true
+	}
+	return n, err
+}
+
+//export ReplayCapturedRequests
+func ReplayCapturedRequests(path *C.char) *C.char {
+	file, err := os.Open(C.GoString(path))
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error opening capture file: %v", err))
+	}
+	defer file.Close()
+
+	results := []replayedRequest{}
+	scanner := bufio.NewScanner(file)
+	// Lines hold base64 bodies of up to captureMaxBodyBytes plus headers
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*captureMaxBodyBytes)
+	for scanner.Scan() {
+		var entry capturedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return C.CString(fmt.Sprintf("Error reading capture file: %v", err))
+		}
+		results = append(results, replayRequest(entry))
+	}
+	if err := scanner.Err(); err != nil {
+		return C.CString(fmt.Sprintf("Error reading capture file: %v", err))
+	}
+
+	result, _ := json.Marshal(results)
+	return C.CString(string(result))
+}
+
+// replayRequest feeds a captured request through the middleware chain and
+// the dispatcher
+func replayRequest(entry capturedRequest) (result replayedRequest) {
+	result = replayedRequest{Method: entry.Method, Target: entry.Target}
+	// httptest.NewRequest panics on a malformed method or target
+	defer func() {
+		if p := recover(); p != nil {
+			result.Error = fmt.Sprint(p)
+		}
+	}()
+
+	r := httptest.NewRequest(entry.Method, entry.Target, bytes.NewReader(entry.Body))
+	r = r.WithContext(context.WithValue(r.Context(), replayKey{}, true))
+	r.Host = entry.Host
+	r.RemoteAddr = entry.RemoteAddr
+	for name, values := range entry.Headers {
+		r.Header[name] = values
+	}
+
+	recorder := httptest.NewRecorder()
+	applyMiddleware(http.HandlerFunc(dispatch)).ServeHTTP(recorder, r)
+	result.Status = recorder.Code
+	return result
+}
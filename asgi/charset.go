@@ -0,0 +1,44 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Charset appended to text responses that do not declare one, nil for none
+var defaultCharset atomic.Pointer[string]
+
+//export SetDefaultCharset
+func SetDefaultCharset(charset *C.char) *C.char {
+	value := strings.TrimSpace(C.GoString(charset))
+	if value == "" {
+		defaultCharset.Store(nil)
+		return C.CString("Default charset cleared")
+	}
+	defaultCharset.Store(&value)
+	return C.CString(fmt.Sprintf("Default charset set to %s", value))
+}
+
+// applyDefaultCharset appends the default charset to a text/* Content-Type
+// without a charset parameter. Other content types are left untouched.
+func applyDefaultCharset(header http.Header) {
+	charset := defaultCharset.Load()
+	if charset == nil {
+		return
+	}
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "text/") {
+		return
+	}
+	if _, ok := params["charset"]; ok {
+		return
+	}
+	header.Set("Content-Type", contentType+"; charset="+*charset)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+// useDefaultCharset sets the default charset until the test ends
+func useDefaultCharset(t *testing.T, charset string) {
+	t.Helper()
+	previous := defaultCharset.Load()
+	defaultCharset.Store(&charset)
+	t.Cleanup(func() { defaultCharset.Store(previous) })
+}
+
+func TestApplyDefaultCharset(t *testing.T) {
+	useDefaultCharset(t, "utf-8")
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"text/plain", "text/plain; charset=utf-8"},
+		{"text/html; level=1", "text/html; level=1; charset=utf-8"},
+		{"text/plain; charset=iso-8859-1", "text/plain; charset=iso-8859-1"},
+		{"text/plain; Charset=latin1", "text/plain; Charset=latin1"},
+		{"application/json", "application/json"},
+		{"image/png", "image/png"},
+		{"text/", "text/"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.contentType != "" {
+			header.Set("Content-Type", tt.contentType)
+		}
+		applyDefaultCharset(header)
+		if got := header.Get("Content-Type"); got != tt.want {
+			t.Errorf("Content-Type %q became %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+
+	// Without a default nothing is appended
+	defaultCharset.Store(nil)
+	header := http.Header{"Content-Type": {"text/plain"}}
+	applyDefaultCharset(header)
+	if got := header.Get("Content-Type"); got != "text/plain" {
+		t.Errorf("no default charset: Content-Type became %q", got)
+	}
+}
+
+func TestDefaultCharsetOnResponses(t *testing.T) {
+	useDefaultCharset(t, "utf-8")
+	for path, contentType := range map[string]string{
+		"/charset/text": "text/csv",
+		"/charset/json": "application/json",
+	} {
+		err := marily.Handle(path, func(marily.Event) marily.Response {
+			return marily.Response{Headers: [][2]string{{"Content-Type", contentType}}}
+		})
+		if err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+		t.Cleanup(func() { unregisterRoute(path) })
+	}
+
+	tests := map[string]string{
+		"/charset/text": "text/csv; charset=utf-8",
+		"/charset/json": "application/json",
+	}
+	for path, want := range tests {
+		w := httptest.NewRecorder()
+		dispatch(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("%s: Content-Type %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// gzip level used for compressed responses
+	compressionLevel atomic.Int64
+	// When set, callback responses are compressed for clients accepting it
+	compressionEnabled atomic.Bool
+)
+
+// Content types that are compressed already, or gain nothing from it
+var incompressibleTypePrefixes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "application/x-7z-compressed", "application/x-rar-compressed",
+	"application/pdf", "application/octet-stream",
+}
+
+func init() {
+	compressionLevel.Store(gzip.DefaultCompression)
+}
+
+//export SetCompressionLevel
+func SetCompressionLevel(level int) *C.char {
+	if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return C.CString(fmt.Sprintf("Compression level must be between %d and %d, or %d for the default",
+			gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression))
+	}
+	compressionLevel.Store(int64(level))
+	return C.CString(fmt.Sprintf("Compression level set to %d", level))
+}
+
+//export EnableCompression
+func EnableCompression(enabled bool) *C.char {
+	compressionEnabled.Store(enabled)
+	return C.CString(fmt.Sprintf("Response compression enabled: %t", enabled))
+}
+
+// newDeflateWriter creates a deflate (zlib) writer using the configured
+// compression level
+func newDeflateWriter(w io.Writer) *zlib.Writer {
+	// The levels of zlib and gzip are the same
+	zw, _ := zlib.NewWriterLevel(w, int(compressionLevel.Load()))
+	return zw
+}
+
+// newGzipWriter creates a gzip writer using the configured compression level
+func newGzipWriter(w io.Writer) *gzip.Writer {
+	// The level is validated by SetCompressionLevel, so this cannot fail
+	gz, _ := gzip.NewWriterLevel(w, int(compressionLevel.Load()))
+	return gz
+}
+
+// addVary adds values to the Vary header of a response that depends on the
+// given request headers. Values the callback already listed are kept once,
+// and a Vary of "*" is left alone since it already covers everything.
+func addVary(header http.Header, values ...string) {
+	var existing []string
+	for _, line := range header.Values("Vary") {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				existing = append(existing, v)
+			}
+		}
+	}
+	if slices.Contains(existing, "*") {
+		return
+	}
+
+	for _, value := range values {
+		if !slices.ContainsFunc(existing, func(v string) bool { return strings.EqualFold(v, value) }) {
+			existing = append(existing, value)
+		}
+	}
+	header.Set("Vary", strings.Join(existing, ", "))
+}
+
+// compressedWriter is the encoder of a compressed response
+type compressedWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressResponseWriter compresses the response body once the status and
+// headers show that the response should be compressed
+type compressResponseWriter struct {
+	http.ResponseWriter
+	// Content coding the client accepts, "gzip" or "deflate"
+	encoding    string
+	wroteHeader bool
+	encoder     compressedWriter
+}
+
+// compressResponse wraps w to compress the response when compression is on
+// and the client accepts gzip or deflate. The returned function finishes
+// the compressed stream and must be called once the body is written.
+func compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if !compressionEnabled.Load() {
+		return w, func() {}
+	}
+	cw := &compressResponseWriter{ResponseWriter: w, encoding: acceptedEncoding(r.Header)}
+	return cw, func() {
+		if cw.encoder != nil {
+			cw.encoder.Close()
+		}
+	}
+}
+
+// acceptedEncoding picks gzip, or else deflate, when the Accept-Encoding
+// header allows it, or returns "" when neither is acceptable
+func acceptedEncoding(header http.Header) string {
+	accepted := map[string]bool{}
+	for _, line := range header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(line, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			// q=0 means not acceptable
+			q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+			accepted[coding] = !(q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000")
+		}
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[encoding]; listed {
+			if ok {
+				return encoding
+			}
+		} else if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressible reports whether a response with this status and headers
+// should be compressed at all
+func compressible(status int, header http.Header) bool {
+	switch {
+	case status < 200, status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	// A range is a slice of the identity body
+	case status == http.StatusPartialContent:
+		return false
+	case header.Get("Content-Encoding") != "":
+		return false
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	return !slices.ContainsFunc(incompressibleTypePrefixes, func(prefix string) bool {
+		return strings.HasPrefix(contentType, prefix)
+	})
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader || status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	if compressible(status, header) {
+		// Caches must key the response on the header it depends on
+		addVary(header, "Accept-Encoding")
+		if cw.encoding != "" {
+			header.Set("Content-Encoding", cw.encoding)
+			// The length of the compressed body is not known up front
+			header.Del("Content-Length")
+			if cw.encoding == "gzip" {
+				cw.encoder = newGzipWriter(cw.ResponseWriter)
+			} else {
+				cw.encoder = newDeflateWriter(cw.ResponseWriter)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush pushes out what was compressed so far, for streamed responses
+func (cw *compressResponseWriter) Flush() {
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+// benchmarkBody is a JSON array of records, typical of what gets compressed
+var benchmarkBody = func() []byte {
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i := range 2000 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"id":%d,"name":"item %d","price":%d.%02d,"tags":["a","b%d"]}`, i, i, i*7%500, i%100, i%13)
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}()
+
+// BenchmarkCompressionLevel reports the time and the compressed size, as a
+// percentage of the original, of each gzip level
+func BenchmarkCompressionLevel(b *testing.B) {
+	defer compressionLevel.Store(gzip.DefaultCompression)
+	for _, level := range []int{gzip.BestSpeed, 3, gzip.DefaultCompression, gzip.BestCompression} {
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			compressionLevel.Store(int64(level))
+			var out bytes.Buffer
+			b.SetBytes(int64(len(benchmarkBody)))
+			for b.Loop() {
+				out.Reset()
+				gz := newGzipWriter(&out)
+				gz.Write(benchmarkBody)
+				gz.Close()
+			}
+			b.ReportMetric(100*float64(out.Len())/float64(len(benchmarkBody)), "%size")
+		})
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	tests := []struct {
+		existing []string
+		add      []string
+		want     string
+	}{
+		{nil, []string{"Accept-Encoding"}, "Accept-Encoding"},
+		{[]string{"Origin"}, []string{"Accept-Encoding"}, "Origin, Accept-Encoding"},
+		{[]string{"accept-encoding"}, []string{"Accept-Encoding"}, "accept-encoding"},
+		{[]string{"Origin, Cookie", "Accept"}, []string{"Accept-Encoding", "Cookie"}, "Origin, Cookie, Accept, Accept-Encoding"},
+		{[]string{"*"}, []string{"Accept-Encoding"}, "*"},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Vary": tt.existing}
+		addVary(header, tt.add...)
+		if got := header.Values("Vary"); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("Vary %q plus %q = %q, want %q", tt.existing, tt.add, got, tt.want)
+		}
+	}
+}
+
+func TestCompressedResponseVary(t *testing.T) {
+	compressionEnabled.Store(true)
+	defer compressionEnabled.Store(false)
+	handleCallback(t, "/compressed", cfixtures.EchoPathCallback())
+
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/compressed", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		dispatch(w, r)
+
+		// Caches need the Vary whether or not this client got gzip
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q, want Accept-Encoding", acceptEncoding, got)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != acceptEncoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q", acceptEncoding, got)
+		}
+		body := w.Body.Bytes()
+		if acceptEncoding == "gzip" {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("gzip.NewReader: %v", err)
+			}
+			if body, err = io.ReadAll(gz); err != nil {
+				t.Fatalf("reading the gzip body: %v", err)
+			}
+		}
+		if string(body) != "/compressed" {
+			t.Errorf("Accept-Encoding %q: body %q, want %q", acceptEncoding, body, "/compressed")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Methods allowed cross-origin when the configuration names none
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// corsConfig is the CORS policy applied to callback routes and static files
+type corsConfig struct {
+	// Origins allowed to make requests, "*" for any
+	AllowedOrigins []string `json:"allowed_origins"`
+	AllowedMethods []string `json:"allowed_methods"`
+	// Request headers allowed in requests, "*" for any
+	AllowedHeaders []string `json:"allowed_headers"`
+	// Response headers scripts may read beyond the safelisted ones
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// Seconds a preflight result may be cached, 0 to leave it to the browser
+	MaxAge int `json:"max_age"`
+}
+
+// Active CORS policy, nil when CORS handling is off
+var corsPolicy atomic.Pointer[corsConfig]
+
+//export SetCORSConfig
+func SetCORSConfig(configJson *C.char) *C.char {
+	raw := C.GoString(configJson)
+	if raw == "" {
+		corsPolicy.Store(nil)
+		return C.CString("CORS handling disabled")
+	}
+
+	var config corsConfig
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return C.CString(fmt.Sprintf("Invalid CORS config: %v", err))
+	}
+	if len(config.AllowedOrigins) == 0 {
+		return C.CString("CORS config must allow at least one origin")
+	}
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = defaultCORSMethods
+	}
+	for i, method := range config.AllowedMethods {
+		config.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	corsPolicy.Store(&config)
+	return C.CString(fmt.Sprintf("CORS enabled for origins: %s", strings.Join(config.AllowedOrigins, ", ")))
+}
+
+// allowsOrigin reports whether requests from origin are allowed
+func (c *corsConfig) allowsOrigin(origin string) bool {
+	return slices.ContainsFunc(c.AllowedOrigins, func(allowed string) bool {
+		return allowed == "*" || strings.EqualFold(allowed, origin)
+	})
+}
+
+// setAllowOrigin sets the Access-Control-Allow-Origin of a response to a
+// request from an allowed origin. Credentialed responses may not use the
+// wildcard, so they name the origin instead.
+func (c *corsConfig) setAllowOrigin(header http.Header, origin string) {
+	if slices.Contains(c.AllowedOrigins, "*") && !c.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		addVary(header, "Origin")
+	}
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// handleCORSPreflight answers a CORS preflight request with the allowed
+// methods and headers, reporting whether the request was one. Preflights
+// from origins that are not allowed get no CORS headers, which makes the
+// browser refuse the actual request.
+func handleCORSPreflight(w http.ResponseWriter, r *http.Request) bool {
+	config := corsPolicy.Load()
+	origin := r.Header.Get("Origin")
+	requestMethod := r.Header.Get("Access-Control-Request-Method")
+	if config == nil || r.Method != http.MethodOptions || origin == "" || requestMethod == "" {
+		return false
+	}
+
+	header := w.Header()
+	addVary(header, "Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers")
+	if config.allowsOrigin(origin) && slices.Contains(config.AllowedMethods, strings.ToUpper(requestMethod)) {
+		config.setAllowOrigin(header, origin)
+		header.Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			allowed := strings.Join(config.AllowedHeaders, ", ")
+			// The wildcard is literal for credentialed requests, so the
+			// requested headers are echoed instead
+			if slices.Contains(config.AllowedHeaders, "*") && config.AllowCredentials {
+				allowed = requested
+			}
+			if allowed != "" {
+				header.Set("Access-Control-Allow-Headers", allowed)
+			}
+		}
+		if config.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// applyCORSHeaders adds the CORS headers to a response for a cross-origin
+// request from an allowed origin, unless the callback set its own
+func applyCORSHeaders(w http.ResponseWriter, r *http.Request, response *C.asgi_response) {
+	if responseHeader(response, "Access-Control-Allow-Origin") != "" {
+		return
+	}
+	setCORSHeaders(w.Header(), r)
+}
+
+// setCORSHeaders adds the CORS headers for a cross-origin request from an
+// allowed origin to a response the server writes itself
+func setCORSHeaders(header http.Header, r *http.Request) {
+	config := corsPolicy.Load()
+	origin := r.Header.Get("Origin")
+	if config == nil || origin == "" || !config.allowsOrigin(origin) {
+		return
+	}
+
+	config.setAllowOrigin(header, origin)
+	if len(config.ExposedHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+	}
+}
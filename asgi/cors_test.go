@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+// useCORS applies config as the CORS policy until the test ends
+func useCORS(t *testing.T, config corsConfig) {
+	t.Helper()
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = defaultCORSMethods
+	}
+	corsPolicy.Store(&config)
+	t.Cleanup(func() { corsPolicy.Store(nil) })
+}
+
+// preflight returns a CORS preflight from origin asking for method
+func preflight(path, origin, method, headers string) *http.Request {
+	r := httptest.NewRequest(http.MethodOptions, path, nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	return r
+}
+
+func TestCORSPreflight(t *testing.T) {
+	useCORS(t, corsConfig{
+		AllowedOrigins: []string{"https://app.example"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPut},
+		AllowedHeaders: []string{"X-Token"},
+		MaxAge:         600,
+	})
+	handleCallback(t, "/cors", cfixtures.EchoPathCallback())
+
+	w := httptest.NewRecorder()
+	dispatch(w, preflight("/cors", "https://app.example", "put", "X-Token"))
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("allowed preflight: got %d %q, want 204 with no body", w.Code, w.Body.String())
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "X-Token",
+		"Access-Control-Max-Age":       "600",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	// Refused preflights are still answered, without the allowing headers
+	refused := []*http.Request{
+		preflight("/cors", "https://evil.example", http.MethodGet, ""),
+		preflight("/cors", "https://app.example", http.MethodDelete, ""),
+	}
+	for _, r := range refused {
+		w := httptest.NewRecorder()
+		dispatch(w, r)
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s %s: got %d with Allow-Origin %q, want 204 with none", r.Header.Get("Origin"),
+				r.Header.Get("Access-Control-Request-Method"), w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	// A plain OPTIONS request is not a preflight and reaches the route
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodOptions, "/cors", nil))
+	if w.Body.String() != "/cors" {
+		t.Errorf("OPTIONS without an origin: got %d %q, want the route's answer", w.Code, w.Body.String())
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	useCORS(t, corsConfig{
+		AllowedOrigins:   []string{"*"},
+		AllowedHeaders:   []string{"*"},
+		AllowCredentials: true,
+	})
+
+	// Credentialed responses name the origin and echo the requested headers
+	w := httptest.NewRecorder()
+	dispatch(w, preflight("/any", "https://app.example", http.MethodPost, "X-One, X-Two"))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "X-One, X-Two" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want the requested headers", got)
+	}
+	if got := w.Header().Values("Vary"); len(got) == 0 {
+		t.Error("credentialed preflight has no Vary header")
+	}
+
+	useCORS(t, corsConfig{AllowedOrigins: []string{"*"}})
+	w = httptest.NewRecorder()
+	dispatch(w, preflight("/any", "https://app.example", http.MethodGet, ""))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q without credentials, want *", got)
+	}
+}
+
+func TestCORSResponseHeaders(t *testing.T) {
+	useCORS(t, corsConfig{
+		AllowedOrigins: []string{"https://app.example"},
+		ExposedHeaders: []string{"X-Total", "X-Page"},
+	})
+	handleCallback(t, "/cors/data", cfixtures.EchoPathCallback())
+
+	tests := []struct {
+		origin      string
+		allowOrigin string
+		expose      string
+	}{
+		{"https://app.example", "https://app.example", "X-Total, X-Page"},
+		{"https://evil.example", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/cors/data", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		dispatch(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("origin %q: got %d, want 200", tt.origin, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("origin %q: Access-Control-Allow-Origin = %q, want %q", tt.origin, got, tt.allowOrigin)
+		}
+		if got := w.Header().Get("Access-Control-Expose-Headers"); got != tt.expose {
+			t.Errorf("origin %q: Access-Control-Expose-Headers = %q, want %q", tt.origin, got, tt.expose)
+		}
+	}
+
+	// A callback's own Access-Control-Allow-Origin is left alone
+	response := newAsgiResponse("cors", http.StatusOK, [][2]string{
+		{"Access-Control-Allow-Origin", "https://other.example"},
+	}, nil)
+	defer freeAsgiResponse(response)
+	r := httptest.NewRequest(http.MethodGet, "/cors/data", nil)
+	r.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	applyCORSHeaders(w, r, response)
+	writeResponseFromC(w, r, response)
+	if got := w.Header().Values("Access-Control-Allow-Origin"); len(got) != 1 || got[0] != "https://other.example" {
+		t.Errorf("callback Access-Control-Allow-Origin became %q", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Headers added to every callback response that does not set them itself,
+// as canonical name/value pairs in name order
+var defaultResponseHeaders atomic.Pointer[[][2]string]
+
+// SetDefaultResponseHeaders takes a JSON object of header names to values,
+// e.g. {"Server": "Marily", "X-Content-Type-Options": "nosniff"}. An empty
+// string or object clears them.
+//
+//export SetDefaultResponseHeaders
+func SetDefaultResponseHeaders(headersJson *C.char) *C.char {
+	raw := C.GoString(headersJson)
+	if raw == "" {
+		defaultResponseHeaders.Store(nil)
+		return C.CString("Default response headers cleared")
+	}
+
+	var config map[string]string
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return C.CString(fmt.Sprintf("Invalid default response headers: %v", err))
+	}
+
+	headers := make([][2]string, 0, len(config))
+	for name, value := range config {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return C.CString(fmt.Sprintf("Invalid default response header: %q: %q", name, value))
+		}
+		headers = append(headers, [2]string{http.CanonicalHeaderKey(name), value})
+	}
+	slices.SortFunc(headers, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+	if len(headers) == 0 {
+		defaultResponseHeaders.Store(nil)
+		return C.CString("Default response headers cleared")
+	}
+	defaultResponseHeaders.Store(&headers)
+
+	names := make([]string, len(headers))
+	for i, h := range headers {
+		names[i] = h[0]
+	}
+	return C.CString(fmt.Sprintf("Default response headers set: %s", strings.Join(names, ", ")))
+}
+
+// applyDefaultResponseHeaders adds the default headers the response has not
+// set. It runs after the callback's headers are added, so a callback value,
+// or one set by the server on the way, always wins.
+func applyDefaultResponseHeaders(header http.Header) {
+	defaults := defaultResponseHeaders.Load()
+	if defaults == nil {
+		return
+	}
+	for _, h := range *defaults {
+		if _, ok := header[h[0]]; !ok {
+			header.Set(h[0], h[1])
+		}
+	}
+}
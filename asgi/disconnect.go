@@ -0,0 +1,60 @@
+package main
+
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the event callback with a disconnect safely
+// static inline asgi_response* call_disconnect_callback(asgi_callback_fn callback, asgi_event* event) {
+//     if (callback == NULL) return NULL;
+//     return callback(event);
+// }
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// When set, callbacks get an http.disconnect event when the client goes
+// away while the request is being handled
+var disconnectEvents atomic.Bool
+
+//export EnableDisconnectEvents
+func EnableDisconnectEvents(enabled bool) *C.char {
+	disconnectEvents.Store(enabled)
+	return C.CString(fmt.Sprintf("Disconnect events enabled: %t", enabled))
+}
+
+// sendDisconnect tells the callback that the client of a request has gone
+// away. The http.disconnect event is delivered only after the callback call
+// still running for the request, pending, has returned, so it always comes
+// after the last http.request event of the request, and at most once. The
+// response of that call has no one to go to and is freed.
+func sendDisconnect(callback C.asgi_callback_fn, r *http.Request, requestId string, pending <-chan *C.asgi_response) {
+	// The event is built before the handler returns, as net/http may reuse
+	// the request once it has
+	var event *C.asgi_event
+	if disconnectEvents.Load() {
+		event = newAsgiEvent(r, requestId, "http.disconnect", nil)
+	}
+
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("Panic while sending disconnect for request %s: %v\n%s", requestId, p, debug.Stack())
+			}
+		}()
+
+		freeLateResponse(pending)
+		if event == nil {
+			return
+		}
+
+		executingRequests.Add(1)
+		defer executingRequests.Add(-1)
+		if response := C.call_disconnect_callback(callback, event); response != nil {
+			freeAsgiResponse(response)
+		}
+	}()
+}
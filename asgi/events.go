@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+// createASGIEvent builds the event of a request with the given body
+func createASGIEvent(r *http.Request, requestId, eventType string, body []byte) marily.Event {
+	// In absolute-form ("GET http://host/path") the authority has already
+	// been split off into r.URL.Host and r.Host, and may leave no path
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	httpVersion := fmt.Sprintf("%d.%d", r.ProtoMajor, r.ProtoMinor)
+	if r.ProtoMajor >= 2 {
+		httpVersion = strconv.Itoa(r.ProtoMajor)
+	}
+
+	host := requestHost(r)
+	clientHost, clientPort := splitHostPort(r.RemoteAddr, "127.0.0.1", "0")
+	serverHost, serverPort := splitHostPort(host, "localhost", "80")
+
+	return marily.Event{
+		Type:          eventType,
+		RequestID:     requestId,
+		Method:        r.Method,
+		Path:          path,
+		RequestTarget: r.RequestURI,
+		QueryString:   r.URL.RawQuery,
+		QueryParams:   queryParams(r.URL.Query()),
+		ContentLength: r.ContentLength,
+		Subprotocols:  offeredSubprotocols(r.Header),
+		HTTPVersion:   httpVersion,
+		// As reported by a trusted proxy when there is one
+		Scheme:     requestScheme(r),
+		Headers:    eventHeaders(r.Header, host),
+		PathParams: pathParams(r),
+		Client:     [2]string{clientHost, clientPort},
+		Server:     [2]string{serverHost, serverPort},
+		Body:       body,
+		// The trace context the handler should forward downstream
+		Traceparent: childTraceparent(r.Header.Get("traceparent")),
+	}
+}
+
+// offeredSubprotocols lists the Sec-WebSocket-Protocol values of a request
+func offeredSubprotocols(header http.Header) []string {
+	var protocols []string
+	for _, line := range header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(line, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// queryParams lists the values of a query in name order, keeping the order
+// of repeated names
+func queryParams(query url.Values) [][2]string {
+	var params [][2]string
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, value := range query[name] {
+			params = append(params, [2]string{name, value})
+		}
+	}
+	return params
+}
+
+// eventHeaders lists the request headers as they appear in an event, adding
+// a Host header with the given value since net/http moves it out of the
+// header map
+func eventHeaders(headers http.Header, host string) [][2]string {
+	pairs := make([][2]string, 0, len(headers)+1)
+	for name, values := range headers {
+		for _, value := range values {
+			// Lowercase as per ASGI spec, unless case is preserved
+			pairs = append(pairs, [2]string{eventHeaderName(name), value})
+		}
+	}
+	if len(headers["Host"]) == 0 {
+		pairs = append(pairs, [2]string{eventHeaderName("Host"), host})
+	}
+	return pairs
+}
+
+func init() {
+	// Go code compiled into the library registers through the marily package
+	if err := marily.Bind(registerGoHandler); err != nil {
+		fmt.Printf("Error registering Go handlers: %v\n", err)
+	}
+}
+
+// registerGoHandler adds a route served by a Go handler
+func registerGoHandler(path string, fn marily.HandlerFunc) error {
+	rt := &route{managed: true}
+	rt.handler = handleGoRequest(rt, fn)
+	return registerRoute(path, rt)
+}
+
+// handleGoRequest serves requests with a Go handler, under the same route
+// checks and request limits as callbacks
+func handleGoRequest(rt *route, fn marily.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+
+		// Observe the response for the latency metrics
+		recorder := newResponseRecorder(w, time.Now())
+		defer recorder.finish(r)
+		w = recorder
+
+		timeout, ok := admitRouteRequest(w, r, rt)
+		if !ok {
+			return
+		}
+
+		semaphore, stopping := rt.requestSlots()
+		if !acquireRequestSlot(w, semaphore, stopping, rt.slotWait()) {
+			return
+		}
+		defer releaseRequestSlot(semaphore)
+
+		requestId := requestIdOf(r)
+		recorder.requestId = requestId
+
+		if !limitRequestBodySize(w, r) {
+			return
+		}
+		body, err := readRequestBody(r)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
+			writeError(w, http.StatusBadRequest, "Error reading request body")
+			return
+		}
+
+		response, err := callGoHandler(fn, createASGIEvent(r, requestId, "http.request", body), timeout)
+		// The write timeout counts from the response being ready
+		extendWriteDeadline(w)
+		if errors.Is(err, errGoHandlerTimeout) {
+			writeError(w, http.StatusGatewayTimeout, "Request processing timed out")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Handler failed")
+			return
+		}
+
+		header := w.Header()
+		if slices.ContainsFunc(response.Headers, func(h [2]string) bool { return strings.EqualFold(h[0], "X-Request-ID") }) {
+			header.Del("X-Request-ID")
+		}
+		for _, h := range response.Headers {
+			header.Add(h[0], h[1])
+		}
+		applyDefaultResponseHeaders(header)
+		applyDefaultCharset(header)
+		if header.Get("Access-Control-Allow-Origin") == "" {
+			setCORSHeaders(header, r)
+		}
+		status := response.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write(response.Body)
+	}
+}
+
+// errGoHandlerTimeout reports a Go handler that did not return in time
+var errGoHandlerTimeout = errors.New("go handler timed out")
+
+// callGoHandler runs the handler for up to timeout, reporting an error when
+// it panicked or did not return in time
+func callGoHandler(fn marily.HandlerFunc, event marily.Event, timeout time.Duration) (marily.Response, error) {
+	type result struct {
+		response marily.Response
+		err      error
+	}
+	results := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("Go handler panicked for %s %s: %v\n", event.Method, event.Path, p)
+				results <- result{err: fmt.Errorf("go handler panicked: %v", p)}
+			}
+		}()
+		executingRequests.Add(1)
+		defer executingRequests.Add(-1)
+		results <- result{response: fn(event)}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.response, res.err
+	case <-timer.C:
+		return marily.Response{}, errGoHandlerTimeout
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestGoHandler(t *testing.T) {
+	err := marily.Handle("/go/{name}", func(ev marily.Event) marily.Response {
+		return marily.Response{
+			Headers: [][2]string{{"Content-Type", "text/plain"}},
+			Body:    []byte("hello " + ev.PathParams[0][1]),
+		}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/go/{name}")
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/go/marily", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello marily" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "hello marily")
+	}
+	if w.Header().Get("X-Request-ID") == "" {
+		t.Error("response has no X-Request-ID")
+	}
+
+	// Go routes are paused like callback routes
+	rt, _ := lookupRoute("/go/{name}")
+	rt.paused.Store(true)
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/go/marily", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("paused route answered %d, want 503", w.Code)
+	}
+}
+
+func TestGoHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rt := &route{timeout: 10 * time.Millisecond}
+	rt.handler = handleGoRequest(rt, func(marily.Event) marily.Response {
+		<-release
+		return marily.Response{}
+	})
+	if err := registerRoute("/go-slow", rt); err != nil {
+		t.Fatalf("registerRoute: %v", err)
+	}
+	defer unregisterRoute("/go-slow")
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/go-slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow handler answered %d, want 504", w.Code)
+	}
+}
+
+func TestGoHandlerPanic(t *testing.T) {
+	rt := &route{}
+	rt.handler = handleGoRequest(rt, func(marily.Event) marily.Response { panic("boom") })
+	if err := registerRoute("/go-panic", rt); err != nil {
+		t.Fatalf("registerRoute: %v", err)
+	}
+	defer unregisterRoute("/go-panic")
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/go-panic", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("panicking handler answered %d, want 500", w.Code)
+	}
+}
+
+func TestAbsoluteFormScope(t *testing.T) {
+	events := make(chan marily.Event, 4)
+	err := marily.Handle("/", func(ev marily.Event) marily.Response {
+		events <- ev
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/")
+	ts := startTestServer(t)
+
+	tests := []struct {
+		target string
+		path   string
+		query  string
+	}{
+		{"http://example.com:8080/abs/path?x=1&y=2", "/abs/path", "x=1&y=2"},
+		{"http://example.com:8080", "/", ""},
+		{"/origin/form?z", "/origin/form", "z"},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com:8080\r\nConnection: close\r\n\r\n", tt.target)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.target, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", tt.target, resp.StatusCode)
+			continue
+		}
+
+		ev := <-events
+		if ev.Path != tt.path || ev.QueryString != tt.query || ev.RequestTarget != tt.target {
+			t.Errorf("%s: path %q, query %q, target %q, want %q, %q, %q",
+				tt.target, ev.Path, ev.QueryString, ev.RequestTarget, tt.path, tt.query, tt.target)
+		}
+		if ev.Server != [2]string{"example.com", "8080"} {
+			t.Errorf("%s: server %v, want example.com:8080", tt.target, ev.Server)
+		}
+	}
+}
+
+func TestEventHeaderCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers [][2]string
+		want    [][2]string
+	}{
+		{"no headers", nil, [][2]string{{"host", "example.com"}}},
+		{"one header", [][2]string{{"Accept", "text/plain"}},
+			[][2]string{{"accept", "text/plain"}, {"host", "example.com"}}},
+		{"repeated header", [][2]string{{"Cookie", "a=1"}, {"Cookie", "b=2"}},
+			[][2]string{{"cookie", "a=1"}, {"cookie", "b=2"}, {"host", "example.com"}}},
+		{"host in header map", [][2]string{{"Host", "other.example"}},
+			[][2]string{{"host", "other.example"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			for _, header := range tt.headers {
+				r.Header.Add(header[0], header[1])
+			}
+			event := newAsgiEvent(r, "header-count", "http.request", nil)
+			defer freeAsgiEvent(event)
+
+			got := asgiHeaderPairs(event.headers, event.headers_count)
+			if int(event.headers_count) != len(tt.want) || len(got) != len(tt.want) {
+				t.Fatalf("headers_count = %d with %d pairs, want %d", event.headers_count, len(got), len(tt.want))
+			}
+			slices.SortFunc(got, func(a, b [2]string) int { return strings.Compare(a[0]+a[1], b[0]+b[1]) })
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("headers = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the event callback with an expect event safely
+// static inline asgi_response* call_expect_callback(asgi_callback_fn callback, asgi_event* event) {
+//     if (callback == NULL) return NULL;
+//     return callback(event);
+// }
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// When set, requests sent with Expect: 100-continue reach the callback as an
+// http.expect event before their body is read
+var expectContinueEvents atomic.Bool
+
+//export EnableExpectContinueEvents
+func EnableExpectContinueEvents(enabled bool) *C.char {
+	expectContinueEvents.Store(enabled)
+	return C.CString(fmt.Sprintf("Expect continue events enabled: %t", enabled))
+}
+
+// expectsContinue reports whether the client waits for 100 Continue before
+// sending the body
+func expectsContinue(r *http.Request) bool {
+	return r.ContentLength != 0 && headerHasToken(r.Header, "Expect", "100-continue")
+}
+
+// checkExpectContinue lets the callback accept or refuse an upload from its
+// headers alone. Nothing reads the body until it is accepted, so net/http
+// sends 100 Continue only then; a refused request gets 417 and its body is
+// never sent. Bodies over the size limit were refused with 413 already.
+func checkExpectContinue(w http.ResponseWriter, r *http.Request, callback C.asgi_callback_fn, requestId string, timeout time.Duration) bool {
+	if !expectContinueEvents.Load() || !expectsContinue(r) {
+		return true
+	}
+
+	responseChan := make(chan *C.asgi_response, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("Panic while checking expectation of request %s: %v\n%s", requestId, p, debug.Stack())
+				responseChan <- nil
+			}
+		}()
+		executingRequests.Add(1)
+		defer executingRequests.Add(-1)
+		responseChan <- C.call_expect_callback(callback, newAsgiEvent(r, requestId, "http.expect", nil))
+	}()
+
+	var response *C.asgi_response
+	select {
+	case response = <-responseChan:
+	case <-time.After(timeout):
+		writeError(w, http.StatusGatewayTimeout, "Request processing timed out")
+		go freeLateResponse(responseChan)
+		return false
+	case <-r.Context().Done():
+		go freeLateResponse(responseChan)
+		return false
+	}
+	if response == nil {
+		return true
+	}
+	defer freeAsgiResponse(response)
+
+	if status := int(response.status); status >= http.StatusBadRequest {
+		// The client has not sent the body, so the connection cannot be reused
+		w.Header().Set("Connection", "close")
+		writeError(w, http.StatusExpectationFailed, fmt.Sprintf("Upload refused with status %d", status))
+		return false
+	}
+	return true
+}
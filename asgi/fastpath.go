@@ -0,0 +1,46 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//export RegisterFastResponse
+func RegisterFastResponse(path *C.char, status int, headersJson *C.char) *C.char {
+	pathStr := C.GoString(path)
+	// A 1xx is not a final status, net/http would follow it with a 200
+	if status < 200 || status > 599 {
+		return C.CString(fmt.Sprintf("Invalid status code: %d", status))
+	}
+
+	// headersJson is an optional object of header name to value
+	headers := map[string]string{}
+	if raw := C.GoString(headersJson); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+			return C.CString(fmt.Sprintf("Invalid headers: %v", err))
+		}
+	}
+
+	rt := &route{handler: handleFastResponse(status, headers)}
+	if err := registerRoute(pathStr, rt); err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
+	return C.CString(fmt.Sprintf("Fast response %d registered for path: %s", status, pathStr))
+}
+
+// handleFastResponse answers with a fixed, body-less response produced
+// entirely in Go. No event is built, the cgo boundary is never crossed and
+// no semaphore token is taken, which keeps health checks and 204/304 style
+// endpoints cheap.
+func handleFastResponse(status int, headers map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+func TestFastResponse(t *testing.T) {
+	registerRoute("/fast", &route{handler: handleFastResponse(http.StatusNoContent, map[string]string{"Cache-Control": "no-store"})})
+	defer unregisterRoute("/fast")
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if w.Code != http.StatusNoContent || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("got %d with Cache-Control %q, want 204 no-store", w.Code, w.Header().Get("Cache-Control"))
+	}
+}
+
+// BenchmarkFastResponse compares a fast response with a C callback giving
+// the same answer, both through the full dispatch
+func BenchmarkFastResponse(b *testing.B) {
+	registerRoute("/bench/fast", &route{handler: handleFastResponse(http.StatusOK, nil)})
+	registerRoute("/bench/callback", newEventRoute(cfixtures.EchoPathCallback()))
+	defer unregisterRoute("/bench/fast")
+	defer unregisterRoute("/bench/callback")
+
+	for _, name := range []string{"fast", "callback"} {
+		b.Run(name, func(b *testing.B) {
+			r := httptest.NewRequest(http.MethodGet, "/bench/"+name, nil)
+			for b.Loop() {
+				dispatch(httptest.NewRecorder(), r)
+			}
+		})
+	}
+}
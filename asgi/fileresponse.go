@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// writeFileResponse writes the file at name as the response body. A 200
+// response goes through http.ServeContent, which sets Content-Type,
+// Content-Length and Last-Modified and answers Range and conditional
+// requests. Other statuses send the whole file as is.
+func writeFileResponse(w http.ResponseWriter, r *http.Request, status int, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Printf("Error opening response file %s: %v\n", name, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeError(w, http.StatusNotFound, "Not Found")
+		} else {
+			writeError(w, http.StatusInternalServerError, "Response file unavailable")
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		fmt.Printf("Response file %s is not a regular file\n", name)
+		writeError(w, http.StatusInternalServerError, "Response file unavailable")
+		return
+	}
+
+	if status == http.StatusOK {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+	w.WriteHeader(status)
+	io.Copy(w, f)
+}
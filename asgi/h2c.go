@@ -0,0 +1,50 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// When set, StartServer also accepts HTTP/2 without TLS, both through an
+// Upgrade: h2c request and with prior knowledge
+var h2cEnabled atomic.Bool
+
+// EnableH2C turns HTTP/2 cleartext on or off for servers started with
+// StartServer afterwards. A running server keeps its setting.
+//
+//export EnableH2C
+func EnableH2C(enabled bool) *C.char {
+	h2cEnabled.Store(enabled)
+	if enabled {
+		return C.CString("h2c enabled for the next StartServer")
+	}
+	return C.CString("h2c disabled for the next StartServer")
+}
+
+// applyH2C wraps the handler of srv so it also serves h2c when enabled
+func applyH2C(srv *http.Server) {
+	if !h2cEnabled.Load() {
+		return
+	}
+	// Registering with srv lets Shutdown close the HTTP/2 connections too
+	h2s := &http2.Server{IdleTimeout: srv.IdleTimeout}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		fmt.Printf("h2c not enabled: %v\n", err)
+		return
+	}
+	handler := h2c.NewHandler(srv.Handler, h2s)
+
+	// The first request of an upgraded connection is read into memory
+	// whole, so it is held to the body size limit up front
+	if limit := maxRequestBodySize.Load(); limit > 0 {
+		handler = http.MaxBytesHandler(handler, limit)
+	}
+	srv.Handler = handler
+}
@@ -0,0 +1,54 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// When set, request header names reach the callback in their usual casing
+// instead of lowercased as ASGI prescribes
+var preserveHeaderCase atomic.Bool
+
+// net/http canonicalizes header names, which gets these well-known names
+// wrong. Upstreams that compare names case-sensitively expect the usual
+// spelling.
+var commonHeaderCase = map[string]string{
+	"Content-Md5":              "Content-MD5",
+	"Dnt":                      "DNT",
+	"Etag":                     "ETag",
+	"Sec-Websocket-Accept":     "Sec-WebSocket-Accept",
+	"Sec-Websocket-Extensions": "Sec-WebSocket-Extensions",
+	"Sec-Websocket-Key":        "Sec-WebSocket-Key",
+	"Sec-Websocket-Protocol":   "Sec-WebSocket-Protocol",
+	"Sec-Websocket-Version":    "Sec-WebSocket-Version",
+	"Te":                       "TE",
+	"Www-Authenticate":         "WWW-Authenticate",
+	"X-Att-Deviceid":           "X-ATT-DeviceId",
+	"X-Request-Id":             "X-Request-ID",
+	"X-Ua-Compatible":          "X-UA-Compatible",
+	"X-Xss-Protection":         "X-XSS-Protection",
+}
+
+//export SetPreserveHeaderCase
+func SetPreserveHeaderCase(enabled bool) *C.char {
+	preserveHeaderCase.Store(enabled)
+	return C.CString(fmt.Sprintf("Header case preservation enabled: %t", enabled))
+}
+
+// eventHeaderName gives the name a request header has in an event:
+// lowercased, or with casing preserved when that is enabled. net/http has
+// already canonicalized the name, so the casing on the wire is not known;
+// well-known names get their usual spelling back.
+func eventHeaderName(name string) string {
+	if !preserveHeaderCase.Load() {
+		return strings.ToLower(name)
+	}
+	if common, ok := commonHeaderCase[name]; ok {
+		return common
+	}
+	return name
+}
@@ -0,0 +1,54 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Path of the built-in health check, nil when it is off
+var healthCheckPath atomic.Pointer[string]
+
+//export EnableHealthCheck
+func EnableHealthCheck(path *C.char) *C.char {
+	pathStr := C.GoString(path)
+	if pathStr == "" {
+		pathStr = "/healthz"
+	}
+	healthCheckPath.Store(&pathStr)
+	return C.CString(fmt.Sprintf("Health check enabled on path: %s", pathStr))
+}
+
+//export DisableHealthCheck
+func DisableHealthCheck() *C.char {
+	healthCheckPath.Store(nil)
+	return C.CString("Health check disabled")
+}
+
+// serveHealthCheck answers requests for the health check path, reporting
+// whether it did. It runs ahead of routing, maintenance and the request
+// semaphore, so probes neither wait for nor take a request slot: 200 while
+// the server accepts requests, 503 once it has begun shutting down.
+func serveHealthCheck(w http.ResponseWriter, r *http.Request) bool {
+	path := healthCheckPath.Load()
+	if path == nil || r.URL.Path != *path {
+		return false
+	}
+	// Probes count against the connection like any other request
+	limitConnectionRequests(w, r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if shutdownInProgress.Load() {
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"shutting_down"}`))
+		return true
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls a scope hook safely
+// static inline asgi_response* call_scope_hook(asgi_scope_hook_fn hook, asgi_event* event) {
+//     if (hook == NULL) return NULL;
+//     return hook(event);
+// }
+//
+// // C helper function that calls a response hook safely
+// static inline void call_response_hook(asgi_response_hook_fn hook, asgi_response* response) {
+//     if (hook == NULL) return;
+//     hook(response);
+// }
+//
+// // C helper function that calls a body transform safely
+// static inline void call_body_transform(asgi_body_transform_fn transform, const char* content_type, asgi_response* response) {
+//     if (transform == NULL) return;
+//     transform(content_type, response);
+// }
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+var (
+	// Hooks run on every event before it is dispatched, in registration order
+	hooksMu    sync.RWMutex
+	scopeHooks []C.asgi_scope_hook_fn
+	// Hooks run on every response before it is written, in registration order
+	responseHooks []C.asgi_response_hook_fn
+	// Transforms applied to every response body, in registration order
+	bodyTransforms []C.asgi_body_transform_fn
+)
+
+//export RegisterScopeHook
+func RegisterScopeHook(hook C.asgi_scope_hook_fn) *C.char {
+	if hook == nil {
+		return C.CString("Scope hook must not be NULL")
+	}
+
+	hooksMu.Lock()
+	scopeHooks = append(scopeHooks, hook)
+	count := len(scopeHooks)
+	hooksMu.Unlock()
+
+	return C.CString(fmt.Sprintf("Scope hook registered (%d total)", count))
+}
+
+// runScopeHooks passes the event through every scope hook. It returns the
+// response of the first hook that short-circuits, or nil to dispatch the
+// (possibly rewritten) event to the callback.
+func runScopeHooks(event *C.asgi_event) *C.asgi_response {
+	hooksMu.RLock()
+	hooks := scopeHooks
+	hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		if response := C.call_scope_hook(hook, event); response != nil {
+			return response
+		}
+	}
+	return nil
+}
+
+//export RegisterResponseHook
+func RegisterResponseHook(hook C.asgi_response_hook_fn) *C.char {
+	if hook == nil {
+		return C.CString("Response hook must not be NULL")
+	}
+
+	hooksMu.Lock()
+	responseHooks = append(responseHooks, hook)
+	count := len(responseHooks)
+	hooksMu.Unlock()
+
+	return C.CString(fmt.Sprintf("Response hook registered (%d total)", count))
+}
+
+// runResponseHooks passes the response through every response hook
+func runResponseHooks(response *C.asgi_response) {
+	hooksMu.RLock()
+	hooks := responseHooks
+	hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		C.call_response_hook(hook, response)
+	}
+}
+
+//export RegisterBodyTransform
+func RegisterBodyTransform(transform C.asgi_body_transform_fn) *C.char {
+	if transform == nil {
+		return C.CString("Body transform must not be NULL")
+	}
+
+	hooksMu.Lock()
+	bodyTransforms = append(bodyTransforms, transform)
+	count := len(bodyTransforms)
+	hooksMu.Unlock()
+
+	return C.CString(fmt.Sprintf("Body transform registered (%d total)", count))
+}
+
+// runBodyTransforms passes the complete response body through every body
+// transform, giving each the response Content-Type to decide whether it applies
+func runBodyTransforms(response *C.asgi_response) {
+	hooksMu.RLock()
+	transforms := bodyTransforms
+	hooksMu.RUnlock()
+
+	if len(transforms) == 0 {
+		return
+	}
+
+	contentType := C.CString(responseHeader(response, "Content-Type"))
+	defer C.free(unsafe.Pointer(contentType))
+
+	for _, transform := range transforms {
+		C.call_body_transform(transform, contentType, response)
+	}
+}
+
+// responseHeader returns the first value of the named header of a C response
+func responseHeader(response *C.asgi_response, name string) string {
+	for i := 0; i < int(response.headers_count); i++ {
+		header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(response.headers)) +
+			uintptr(i)*unsafe.Sizeof(C.asgi_header{})))
+		if strings.EqualFold(C.GoStringN(header.name.data, C.int(header.name.length)), name) {
+			return C.GoStringN(header.value.data, C.int(header.value.length))
+		}
+	}
+	return ""
+}
+
+// asgiResponseHeaders returns the headers of a response as name/value pairs
+func asgiResponseHeaders(response *C.asgi_response) [][2]string {
+	return asgiHeaderPairs(response.headers, response.headers_count)
+}
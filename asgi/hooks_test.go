@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+// resetHooks removes every hook once the test ends
+func resetHooks(t *testing.T) {
+	t.Cleanup(func() {
+		hooksMu.Lock()
+		scopeHooks, responseHooks, bodyTransforms = nil, nil, nil
+		hooksMu.Unlock()
+	})
+}
+
+func TestScopeHookRewritesPath(t *testing.T) {
+	resetHooks(t)
+	handleCallback(t, "/hooked", cfixtures.EchoPathCallback())
+	FreeCString(RegisterScopeHook(cfixtures.RewritePathHook()))
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/hooked", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "/rewritten" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "/rewritten")
+	}
+}
+
+func TestResponseHookAddsHeader(t *testing.T) {
+	resetHooks(t)
+	handleCallback(t, "/hooked/a", cfixtures.EchoPathCallback())
+	handleCallback(t, "/hooked/b", cfixtures.EchoPathCallback())
+	FreeCString(RegisterResponseHook(cfixtures.AddHeaderHook()))
+
+	for _, path := range []string{"/hooked/a", "/hooked/b"} {
+		w := httptest.NewRecorder()
+		dispatch(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != path {
+			t.Errorf("%s: got %d %q", path, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Hooked"); got != "yes" {
+			t.Errorf("%s: X-Hooked = %q, want yes", path, got)
+		}
+	}
+}
+
+func TestBodyTransformUppercasesText(t *testing.T) {
+	resetHooks(t)
+	handleCallback(t, "/transformed", cfixtures.EchoPathCallback())
+	FreeCString(RegisterBodyTransform(cfixtures.UppercaseTextTransform()))
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/transformed", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "/TRANSFORMED" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "/TRANSFORMED")
+	}
+
+	// The transform leaves other content types alone
+	body := `{"name":"value"}`
+	response := newAsgiResponse("transform", http.StatusOK, [][2]string{{"Content-Type", "application/json"}}, []byte(body))
+	defer freeAsgiResponse(response)
+	runBodyTransforms(response)
+	w = httptest.NewRecorder()
+	writeResponseFromC(w, httptest.NewRequest(http.MethodGet, "/", nil), response)
+	if w.Body.String() != body {
+		t.Errorf("application/json body became %q, want %q", w.Body.String(), body)
+	}
+}
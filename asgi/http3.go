@@ -0,0 +1,101 @@
+//go:build http3
+
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// The HTTP/3 server running next to the TLS server, guarded by serverMu
+var http3Server *http3.Server
+
+//export StartServerHTTP3
+func StartServerHTTP3(port int, certFile, keyFile *C.char) *C.char {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server != nil {
+		return C.CString("Server is already running")
+	}
+	if !listenerReleased() {
+		return C.CString("Server shutdown in progress, the port is not released yet")
+	}
+
+	cert, err := tls.LoadX509KeyPair(C.GoString(certFile), C.GoString(keyFile))
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error loading certificate: %v", err))
+	}
+
+	addr := fmt.Sprintf(":%d", port)
+	h3 := &http3.Server{
+		Addr:      addr,
+		Handler:   applyMiddleware(http.HandlerFunc(dispatch)),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+
+	// HTTP/3 and the TCP listener share the port, one over UDP and one over TCP
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		listener.Close()
+		return C.CString(fmt.Sprintf("Error starting HTTP/3 server: %v", err))
+	}
+
+	// The application may refuse to start, e.g. when its database is down
+	if err := runLifespan("lifespan.startup"); err != nil {
+		listener.Close()
+		packetConn.Close()
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+
+	resetRequestState()
+
+	// The companion HTTP/1.1 and HTTP/2 server advertises HTTP/3 via Alt-Svc
+	server = newHTTPServer(addr)
+	server.Handler = advertiseHTTP3(h3, server.Handler)
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	http3Server = h3
+
+	srv, semaphore := server, requestSemaphore
+	startServing(listener, func(l net.Listener) error {
+		return srv.ServeTLS(newOverflowListener(l, semaphore, true), "", "")
+	})
+	go func() {
+		if err := h3.Serve(packetConn); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("HTTP/3 server error: %v\n", err)
+		}
+	}()
+
+	return C.CString(fmt.Sprintf("Server started on port %d with HTTP/3 and max %d concurrent requests", port, maxConcurrentRequests))
+}
+
+// advertiseHTTP3 adds the Alt-Svc header pointing clients at the HTTP/3 server
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stopHTTP3 shuts down the HTTP/3 server, if any. The caller holds serverMu.
+func stopHTTP3(ctx context.Context) {
+	if http3Server == nil {
+		return
+	}
+	if err := http3Server.Shutdown(ctx); err != nil {
+		http3Server.Close()
+	}
+	http3Server = nil
+}
@@ -0,0 +1,18 @@
+//go:build !http3
+
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import "context"
+
+// HTTP/3 pulls in quic-go, so it is only built with the http3 build tag
+
+//export StartServerHTTP3
+func StartServerHTTP3(port int, certFile, keyFile *C.char) *C.char {
+	return C.CString("HTTP/3 support is not compiled in, rebuild with -tags http3")
+}
+
+// stopHTTP3 has nothing to stop without HTTP/3 support
+func stopHTTP3(ctx context.Context) {}
@@ -0,0 +1,80 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+)
+
+// injectedRequest is a request handed to InjectRequest
+type injectedRequest struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Host    string              `json:"host"`
+	Headers map[string][]string `json:"headers"`
+	// Base64 encoded in JSON
+	Body []byte `json:"body"`
+}
+
+// injectedResponse is the response InjectRequest returns
+type injectedResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body"`
+}
+
+//export InjectRequest
+func InjectRequest(requestJson *C.char) *C.char {
+	var entry injectedRequest
+	if err := json.Unmarshal([]byte(C.GoString(requestJson)), &entry); err != nil {
+		return C.CString(fmt.Sprintf("Invalid request: %v", err))
+	}
+
+	response, err := injectRequest(entry)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Invalid request: %v", err))
+	}
+	result, _ := json.Marshal(response)
+	return C.CString(string(result))
+}
+
+// injectRequest runs a request through the middleware chain and the
+// dispatcher, exactly as a request read from the network would be, and
+// records the response in memory
+func injectRequest(entry injectedRequest) (response injectedResponse, err error) {
+	// httptest.NewRequest panics on a malformed method or target
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	if entry.Method == "" {
+		entry.Method = http.MethodGet
+	}
+	if entry.Path == "" {
+		entry.Path = "/"
+	}
+	r := httptest.NewRequest(entry.Method, entry.Path, bytes.NewReader(entry.Body))
+	if entry.Host != "" {
+		r.Host = entry.Host
+	}
+	for name, values := range entry.Headers {
+		r.Header[http.CanonicalHeaderKey(name)] = values
+	}
+
+	recorder := httptest.NewRecorder()
+	applyMiddleware(http.HandlerFunc(dispatch)).ServeHTTP(recorder, r)
+
+	result := recorder.Result()
+	return injectedResponse{
+		Status:  result.StatusCode,
+		Headers: result.Header,
+		Body:    recorder.Body.Bytes(),
+	}, nil
+}
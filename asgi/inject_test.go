@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestInjectRequestRunsCallback(t *testing.T) {
+	resetHooks(t)
+	handleCallback(t, "/injected", cfixtures.EchoPathCallback())
+	FreeCString(RegisterResponseHook(cfixtures.AddHeaderHook()))
+
+	response, err := injectRequest(injectedRequest{Method: http.MethodPost, Path: "/injected?x=1", Body: []byte("payload")})
+	if err != nil {
+		t.Fatalf("injectRequest: %v", err)
+	}
+	if response.Status != http.StatusOK || string(response.Body) != "/injected" {
+		t.Errorf("got %d %q, want 200 %q", response.Status, response.Body, "/injected")
+	}
+	// The response went through the hooks and the server's own headers
+	if got := http.Header(response.Headers).Get("X-Hooked"); got != "yes" {
+		t.Errorf("X-Hooked = %q, want yes", got)
+	}
+	if http.Header(response.Headers).Get("X-Request-ID") == "" {
+		t.Error("injected response has no X-Request-ID")
+	}
+}
+
+func TestInjectRequestScope(t *testing.T) {
+	events := make(chan marily.Event, 1)
+	err := marily.Handle("/injected/scope", func(ev marily.Event) marily.Response {
+		events <- ev
+		return marily.Response{Status: http.StatusCreated}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/injected/scope")
+
+	response, err := injectRequest(injectedRequest{
+		Method:  http.MethodPut,
+		Path:    "/injected/scope",
+		Host:    "example.com",
+		Headers: map[string][]string{"x-custom": {"a", "b"}},
+		Body:    []byte("payload"),
+	})
+	if err != nil {
+		t.Fatalf("injectRequest: %v", err)
+	}
+	if response.Status != http.StatusCreated {
+		t.Errorf("got %d, want 201", response.Status)
+	}
+	ev := <-events
+	if ev.Method != http.MethodPut || string(ev.Body) != "payload" || ev.Server[0] != "example.com" {
+		t.Errorf("event %s %q to %v, want PUT %q to example.com", ev.Method, ev.Body, ev.Server, "payload")
+	}
+	var custom []string
+	for _, h := range ev.Headers {
+		if h[0] == "x-custom" {
+			custom = append(custom, h[1])
+		}
+	}
+	if len(custom) != 2 || custom[0] != "a" || custom[1] != "b" {
+		t.Errorf("x-custom headers %q, want [a b]", custom)
+	}
+}
+
+func TestInjectRequestMalformed(t *testing.T) {
+	if _, err := injectRequest(injectedRequest{Method: "NOT A METHOD"}); err == nil {
+		t.Error("malformed method accepted")
+	}
+}
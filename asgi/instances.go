@@ -0,0 +1,141 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverInstance is an additional server on its own port, with its own
+// route table and concurrency limit, running next to the default server
+type serverInstance struct {
+	id        int
+	server    *http.Server
+	done      chan struct{}
+	semaphore chan struct{}
+	// Closed once the instance begins shutting down
+	stopping chan struct{}
+
+	mux      atomic.Pointer[http.ServeMux]
+	routesMu sync.Mutex
+	routes   map[string]*route
+}
+
+var (
+	// Running additional servers by ID, guarded by serverMu
+	serverInstances = map[int]*serverInstance{}
+	lastInstanceId  int
+)
+
+// StartServerInstance starts an additional server and returns its ID, or -1
+// when it could not start. Routes are added to it with
+// RegisterInstanceEventCallback; the server-wide features, such as
+// maintenance mode and hooks, apply to it as to the default server.
+//
+//export StartServerInstance
+func StartServerInstance(port int, maxConcurrent int) int {
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentRequests
+	}
+
+	inst := &serverInstance{
+		done:      make(chan struct{}),
+		semaphore: make(chan struct{}, maxConcurrent),
+		stopping:  make(chan struct{}),
+		routes:    map[string]*route{},
+	}
+	inst.mux.Store(http.NewServeMux())
+	inst.server = newHTTPServer(fmt.Sprintf(":%d", port))
+	inst.server.Handler = applyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-inst.stopping:
+			rejectShuttingDown(w)
+			return
+		default:
+		}
+		dispatchMux(w, r, inst.mux.Load(), false)
+	}))
+
+	listener, err := net.Listen("tcp", inst.server.Addr)
+	if err != nil {
+		fmt.Printf("Error starting server instance: %v\n", err)
+		return -1
+	}
+
+	serverMu.Lock()
+	lastInstanceId++
+	inst.id = lastInstanceId
+	serverInstances[inst.id] = inst
+	serverMu.Unlock()
+
+	go func() {
+		defer close(inst.done)
+		if err := inst.server.Serve(newOverflowListener(listener, inst.semaphore, false)); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("HTTP server instance %d error: %v\n", inst.id, err)
+		}
+	}()
+
+	fmt.Printf("Server instance %d started on port %d with max %d concurrent requests\n", inst.id, port, maxConcurrent)
+	return inst.id
+}
+
+//export StopServerInstance
+func StopServerInstance(id int) *C.char {
+	serverMu.Lock()
+	inst, ok := serverInstances[id]
+	delete(serverInstances, id)
+	serverMu.Unlock()
+
+	if !ok {
+		return C.CString(fmt.Sprintf("No server instance with ID %d", id))
+	}
+
+	// Turn away requests still waiting for a semaphore token
+	close(inst.stopping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := inst.server.Shutdown(ctx); err != nil {
+		inst.server.Close()
+	}
+	<-inst.done
+
+	return C.CString(fmt.Sprintf("Server instance %d stopped", id))
+}
+
+//export RegisterInstanceEventCallback
+func RegisterInstanceEventCallback(id int, path *C.char, callback C.asgi_callback_fn) *C.char {
+	pathStr := C.GoString(path)
+
+	serverMu.Lock()
+	inst, ok := serverInstances[id]
+	serverMu.Unlock()
+	if !ok {
+		return C.CString(fmt.Sprintf("No server instance with ID %d", id))
+	}
+
+	rt := newEventRoute(callback)
+	rt.instance = inst
+
+	inst.routesMu.Lock()
+	defer inst.routesMu.Unlock()
+
+	routes := maps.Clone(inst.routes)
+	routes[pathStr] = rt
+	mux, err := buildMux(routes)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
+	inst.routes = routes
+	inst.mux.Store(mux)
+
+	return C.CString(fmt.Sprintf("Event callback registered for path: %s on server instance %d", pathStr, id))
+}
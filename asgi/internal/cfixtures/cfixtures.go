@@ -0,0 +1,148 @@
+// Package cfixtures provides C callbacks for the tests of the server, whose
+// test files cannot use cgo themselves. Each function returns a pointer to a
+// C function, to be passed wherever the server takes the matching callback
+// type from asgi_structs.h. The server library never imports this package.
+package cfixtures
+
+// #cgo CFLAGS: -I${SRCDIR}/../..
+// #include <ctype.h>
+// #include "libasgi.h"
+//
+// // The callbacks are not static, their addresses are taken from Go
+//
+// // Copies an asgi_string into a NUL-terminated string, freed by the caller
+// static char* fixture_cstring(asgi_string s) {
+//     char* result = malloc(s.length + 1);
+//     if (s.length > 0) memcpy(result, s.data, s.length);
+//     result[s.length] = '\0';
+//     return result;
+// }
+//
+// // Builds a 200 response to the event with the given type and body
+// static asgi_response* fixture_response(asgi_event* event, const char* content_type, const char* body) {
+//     asgi_response* response = calloc(1, sizeof(asgi_response));
+//     char* request_id = fixture_cstring(event->request_id);
+//     response->request_id = make_asgi_string(request_id);
+//     free(request_id);
+//     response->status = 200;
+//     response->headers = malloc(sizeof(asgi_header));
+//     response->headers[0].name = make_asgi_string("Content-Type");
+//     response->headers[0].value = make_asgi_string(content_type);
+//     response->headers_count = 1;
+//     response->body_length = strlen(body);
+//     response->body = malloc(response->body_length);
+//     memcpy(response->body, body, response->body_length);
+//     return response;
+// }
+//
+// asgi_response* cfixture_echo_path_callback(asgi_event* event) {
+//     char* path = fixture_cstring(event->path);
+//     asgi_response* response = fixture_response(event, "text/plain", path);
+//     free(path);
+//     free_asgi_event(event);
+//     return response;
+// }
+//
+// asgi_response* cfixture_nil_callback(asgi_event* event) {
+//     free_asgi_event(event);
+//     return NULL;
+// }
+//
+// asgi_response* cfixture_fallback_callback(asgi_event* event) {
+//     asgi_response* response = fixture_response(event, "text/plain", "fallback");
+//     free_asgi_event(event);
+//     return response;
+// }
+//
+// asgi_response* cfixture_rewrite_path_hook(asgi_event* event) {
+//     free_asgi_string(event->path);
+//     event->path = make_asgi_string("/rewritten");
+//     return NULL;
+// }
+//
+// void cfixture_add_header_hook(asgi_response* response) {
+//     asgi_header* headers = malloc((response->headers_count + 1) * sizeof(asgi_header));
+//     if (response->headers_count > 0) {
+//         memcpy(headers, response->headers, response->headers_count * sizeof(asgi_header));
+//     }
+//     free(response->headers);
+//     headers[response->headers_count].name = make_asgi_string("X-Hooked");
+//     headers[response->headers_count].value = make_asgi_string("yes");
+//     response->headers = headers;
+//     response->headers_count++;
+// }
+//
+// void cfixture_uppercase_text_transform(const char* content_type, asgi_response* response) {
+//     if (strncmp(content_type, "text/plain", strlen("text/plain")) != 0) return;
+//     unsigned char* body = malloc(response->body_length);
+//     for (size_t i = 0; i < response->body_length; i++) {
+//         body[i] = toupper(response->body[i]);
+//     }
+//     free(response->body);
+//     response->body = body;
+// }
+//
+// static int fixed_request_id_calls;
+//
+// int cfixture_fixed_request_id_calls(void) {
+//     return __atomic_load_n(&fixed_request_id_calls, __ATOMIC_SEQ_CST);
+// }
+//
+// char* cfixture_fixed_request_id(const char* method, const char* path, const char* client) {
+//     __atomic_add_fetch(&fixed_request_id_calls, 1, __ATOMIC_SEQ_CST);
+//     char* id = malloc(strlen("fixture-id") + 1);
+//     strcpy(id, "fixture-id");
+//     return id;
+// }
+//
+// bool cfixture_reject_ipv4_loopback(const char* remote_addr) {
+//     return strncmp(remote_addr, "127.0.0.1:", strlen("127.0.0.1:")) != 0;
+// }
+//
+// asgi_string* cfixture_raw_ok_callback(asgi_string* request) {
+//     const char* raw = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok";
+//     asgi_string* response = malloc(sizeof(asgi_string));
+//     *response = make_asgi_string(raw);
+//     return response;
+// }
+import "C"
+
+// EchoPathCallback returns an asgi_callback_fn answering 200 with the path of
+// the event as a text/plain body
+func EchoPathCallback() *[0]byte { return (*[0]byte)(C.cfixture_echo_path_callback) }
+
+// NilCallback returns an asgi_callback_fn that produces no response
+func NilCallback() *[0]byte { return (*[0]byte)(C.cfixture_nil_callback) }
+
+// FallbackCallback returns an asgi_callback_fn answering 200 "fallback"
+func FallbackCallback() *[0]byte { return (*[0]byte)(C.cfixture_fallback_callback) }
+
+// RewritePathHook returns an asgi_scope_hook_fn changing the path of every
+// event to /rewritten
+func RewritePathHook() *[0]byte { return (*[0]byte)(C.cfixture_rewrite_path_hook) }
+
+// AddHeaderHook returns an asgi_response_hook_fn adding "X-Hooked: yes" to
+// every response
+func AddHeaderHook() *[0]byte { return (*[0]byte)(C.cfixture_add_header_hook) }
+
+// UppercaseTextTransform returns an asgi_body_transform_fn uppercasing
+// text/plain bodies
+func UppercaseTextTransform() *[0]byte { return (*[0]byte)(C.cfixture_uppercase_text_transform) }
+
+// FixedRequestId returns an asgi_request_id_fn giving every request the ID
+// "fixture-id"
+func FixedRequestId() *[0]byte { return (*[0]byte)(C.cfixture_fixed_request_id) }
+
+// FixedRequestIdCalls returns how many times the FixedRequestId generator
+// has been called
+func FixedRequestIdCalls() int {
+	return int(C.cfixture_fixed_request_id_calls())
+}
+
+// RejectIPv4Loopback returns an asgi_connection_fn refusing connections
+// from 127.0.0.1
+func RejectIPv4Loopback() *[0]byte { return (*[0]byte)(C.cfixture_reject_ipv4_loopback) }
+
+// RawOKCallback returns an asgi_raw_callback_fn answering every request with
+// a raw 200 "ok" response
+func RawOKCallback() *[0]byte { return (*[0]byte)(C.cfixture_raw_ok_callback) }
@@ -0,0 +1,82 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	// Slots for reading request bodies, nil when unlimited
+	readSlots atomic.Pointer[chan struct{}]
+	// Slots for writing response bodies, nil when unlimited
+	writeSlots atomic.Pointer[chan struct{}]
+)
+
+//export SetReadConcurrency
+func SetReadConcurrency(limit int) *C.char {
+	if limit < 0 {
+		return C.CString("Read concurrency must be >= 0")
+	}
+	setIOSlots(&readSlots, limit)
+	if limit == 0 {
+		return C.CString("Read concurrency unlimited")
+	}
+	return C.CString(fmt.Sprintf("Read concurrency set to %d", limit))
+}
+
+//export SetWriteConcurrency
+func SetWriteConcurrency(limit int) *C.char {
+	if limit < 0 {
+		return C.CString("Write concurrency must be >= 0")
+	}
+	setIOSlots(&writeSlots, limit)
+	if limit == 0 {
+		return C.CString("Write concurrency unlimited")
+	}
+	return C.CString(fmt.Sprintf("Write concurrency set to %d", limit))
+}
+
+// setIOSlots replaces a slot pool. Requests holding slots of the old pool
+// return them there, so a resize takes effect as they finish.
+func setIOSlots(slots *atomic.Pointer[chan struct{}], limit int) {
+	if limit == 0 {
+		slots.Store(nil)
+		return
+	}
+	ch := make(chan struct{}, limit)
+	slots.Store(&ch)
+}
+
+// acquireIOSlot waits for a slot in the pool, giving up when ctx is done.
+// The returned function releases the slot.
+func acquireIOSlot(ctx context.Context, slots *atomic.Pointer[chan struct{}]) (func(), bool) {
+	ch := slots.Load()
+	if ch == nil {
+		return func() {}, true
+	}
+	select {
+	case *ch <- struct{}{}:
+		return func() { <-*ch }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// ioSlotUsage reports the slots of a pool in use and its capacity, both
+// 0 when unlimited
+type ioSlotUsage struct {
+	InUse    int `json:"in_use"`
+	Capacity int `json:"capacity"`
+}
+
+func ioSlotsUsage(slots *atomic.Pointer[chan struct{}]) ioSlotUsage {
+	ch := slots.Load()
+	if ch == nil {
+		return ioSlotUsage{}
+	}
+	return ioSlotUsage{InUse: len(*ch), Capacity: cap(*ch)}
+}
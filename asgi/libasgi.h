@@ -12,6 +12,8 @@
 
 #ifndef GO_CGO_GOSTRING_TYPEDEF
 typedef struct { const char *p; ptrdiff_t n; } _GoString_;
+extern size_t _GoStringLen(_GoString_ s);
+extern const char *_GoStringPtr(_GoString_ s);
 #endif
 
 #endif
@@ -19,6 +21,259 @@ typedef struct { const char *p; ptrdiff_t n; } _GoString_;
 /* Start of preamble from import "C" comments.  */
 
 
+#line 3 "accesslog.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the access log sink safely
+ static inline void call_log_sink(asgi_log_fn sink, const char* line) {
+     if (sink == NULL) return;
+     sink(line);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "auth.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "body.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "buffering.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "cancellation.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "capture.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "charset.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "compression.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "cors.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "defaultheaders.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "disconnect.go"
+ #include "asgi_structs.h"
+
+ // C helper function that calls the event callback with a disconnect safely
+ static inline asgi_response* call_disconnect_callback(asgi_callback_fn callback, asgi_event* event) {
+     if (callback == NULL) return NULL;
+     return callback(event);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "expect.go"
+ #include "asgi_structs.h"
+
+ // C helper function that calls the event callback with an expect event safely
+ static inline asgi_response* call_expect_callback(asgi_callback_fn callback, asgi_event* event) {
+     if (callback == NULL) return NULL;
+     return callback(event);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "fastpath.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "h2c.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "headercase.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "health.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "hooks.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls a scope hook safely
+ static inline asgi_response* call_scope_hook(asgi_scope_hook_fn hook, asgi_event* event) {
+     if (hook == NULL) return NULL;
+     return hook(event);
+ }
+
+ // C helper function that calls a response hook safely
+ static inline void call_response_hook(asgi_response_hook_fn hook, asgi_response* response) {
+     if (hook == NULL) return;
+     hook(response);
+ }
+
+ // C helper function that calls a body transform safely
+ static inline void call_body_transform(asgi_body_transform_fn transform, const char* content_type, asgi_response* response) {
+     if (transform == NULL) return;
+     transform(content_type, response);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 5 "http3_disabled.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "inject.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "instances.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "iolimits.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "lifespan.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the lifespan callback safely
+ static inline asgi_response* call_lifespan_callback(asgi_callback_fn callback, asgi_event* event) {
+     if (callback == NULL) return NULL;
+     return callback(event);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "listener.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the connection callback safely
+ static inline bool call_connection_callback(asgi_connection_fn callback, const char* remote_addr) {
+     if (callback == NULL) return true;
+     return callback(remote_addr);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "maintenance.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "metrics.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "nilresponse.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the nil response fallback safely
+ static inline asgi_response* call_fallback_callback(asgi_callback_fn callback, asgi_event* event) {
+     if (callback == NULL) return NULL;
+     return callback(event);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "override.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "pathparams.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "problem.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "prometheus.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "proxy.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "ranges.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "ratelimit.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "raw.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the raw callback safely
+ static inline asgi_string* call_raw_callback(asgi_raw_callback_fn callback, asgi_string* request) {
+     if (callback == NULL) return NULL;
+     return callback(request);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "requestid.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the request ID generator safely
+ static inline char* call_request_id_generator(asgi_request_id_fn generator, const char* method, const char* path, const char* client) {
+     if (generator == NULL) return NULL;
+     return generator(method, path, client);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "routes.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
 #line 3 "server.go"
  #include <stdlib.h>
  #include <string.h>
@@ -56,6 +311,10 @@ typedef struct { const char *p; ptrdiff_t n; } _GoString_;
      free_asgi_string(event->path);
      free_asgi_string(event->query_string);
      free_asgi_string(event->scheme);
+     free_asgi_string(event->traceparent);
+     free_asgi_string(event->http_version);
+     free_asgi_string(event->request_target);
+     free_asgi_string(event->type);
 
      // Free headers
      for (size_t i = 0; i < event->headers_count; i++) {
@@ -66,6 +325,32 @@ typedef struct { const char *p; ptrdiff_t n; } _GoString_;
          free(event->headers);
      }
 
+     // Free path params
+     for (size_t i = 0; i < event->path_params_count; i++) {
+         free_asgi_string(event->path_params[i].name);
+         free_asgi_string(event->path_params[i].value);
+     }
+     if (event->path_params != NULL) {
+         free(event->path_params);
+     }
+
+     // Free the offered subprotocols
+     for (size_t i = 0; i < event->subprotocols_count; i++) {
+         free_asgi_string(event->subprotocols[i]);
+     }
+     if (event->subprotocols != NULL) {
+         free(event->subprotocols);
+     }
+
+     // Free query params
+     for (size_t i = 0; i < event->query_params_count; i++) {
+         free_asgi_string(event->query_params[i].name);
+         free_asgi_string(event->query_params[i].value);
+     }
+     if (event->query_params != NULL) {
+         free(event->query_params);
+     }
+
      // Free client
      if (event->client != NULL) {
          // Access client array elements by pointer arithmetic
@@ -106,10 +391,20 @@ typedef struct { const char *p; ptrdiff_t n; } _GoString_;
          free(response->headers);
      }
 
+     // Free trailers
+     for (size_t i = 0; i < response->trailers_count; i++) {
+         free_asgi_string(response->trailers[i].name);
+         free_asgi_string(response->trailers[i].value);
+     }
+     if (response->trailers != NULL) {
+         free(response->trailers);
+     }
+
      // Free body
      if (response->body != NULL) {
          free(response->body);
      }
+     free_asgi_string(response->file_path);
 
      // Free the response itself
      free(response);
@@ -123,6 +418,53 @@ typedef struct { const char *p; ptrdiff_t n; } _GoString_;
 
 #line 1 "cgo-generated-wrapper"
 
+#line 3 "servertiming.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "static.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "stream.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "timeouts.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "tracing.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "upgrade.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "validation.go"
+ #include "asgi_structs.h"
+
+#line 1 "cgo-generated-wrapper"
+
+#line 3 "websocket.go"
+ #include <stdlib.h>
+ #include "asgi_structs.h"
+
+ // C helper function that calls the callback with a WebSocket event safely
+ static inline asgi_response* call_websocket_callback(asgi_callback_fn callback, asgi_event* event) {
+     if (callback == NULL) return NULL;
+     return callback(event);
+ }
+
+#line 1 "cgo-generated-wrapper"
+
 
 /* End of preamble from import "C" comments.  */
 
@@ -147,10 +489,16 @@ typedef size_t GoUintptr;
 typedef float GoFloat32;
 typedef double GoFloat64;
 #ifdef _MSC_VER
+#if !defined(__cplusplus) || _MSVC_LANG <= 201402L
 #include <complex.h>
 typedef _Fcomplex GoComplex64;
 typedef _Dcomplex GoComplex128;
 #else
+#include <complex>
+typedef std::complex<float> GoComplex64;
+typedef std::complex<double> GoComplex128;
+#endif
+#else
 typedef float _Complex GoComplex64;
 typedef double _Complex GoComplex128;
 #endif
@@ -177,11 +525,99 @@ typedef struct { void *data; GoInt len; GoInt cap; } GoSlice;
 extern "C" {
 #endif
 
+extern char* SetLogFormat(char* format);
+extern char* RegisterAccessLogSink(asgi_log_fn sink);
+extern char* RequireBasicAuth(char* pathPrefix, char* username, char* password);
+extern char* SetBodyChunkSize(GoInt bytes);
+extern char* SetStreamRequestBodies(GoUint8 enabled);
+extern char* SetMaxRequestBodySize(GoInt bytes);
+extern char* SetMinUploadBytesPerSec(GoInt bytesPerSec);
+extern char* SetResponseBufferSize(GoInt bytes);
+extern _Bool IsRequestCancelled(char* requestId);
+extern char* EnableRequestCapture(char* path, GoInt maxRequests);
+extern char* DisableRequestCapture(void);
+extern char* SetCaptureRedactedHeaders(char* names);
+extern char* ReplayCapturedRequests(char* path);
+extern char* SetDefaultCharset(char* charset);
+extern char* SetCompressionLevel(GoInt level);
+extern char* EnableCompression(GoUint8 enabled);
+extern char* SetCORSConfig(char* configJson);
+extern char* SetDefaultResponseHeaders(char* headersJson);
+extern char* EnableDisconnectEvents(GoUint8 enabled);
+extern char* EnableExpectContinueEvents(GoUint8 enabled);
+extern char* RegisterFastResponse(char* path, GoInt status, char* headersJson);
+extern char* EnableH2C(GoUint8 enabled);
+extern char* SetPreserveHeaderCase(GoUint8 enabled);
+extern char* EnableHealthCheck(char* path);
+extern char* DisableHealthCheck(void);
+extern char* RegisterScopeHook(asgi_scope_hook_fn hook);
+extern char* RegisterResponseHook(asgi_response_hook_fn hook);
+extern char* RegisterBodyTransform(asgi_body_transform_fn transform);
+extern char* StartServerHTTP3(GoInt port, char* certFile, char* keyFile);
+extern char* InjectRequest(char* requestJson);
+extern GoInt StartServerInstance(GoInt port, GoInt maxConcurrent);
+extern char* StopServerInstance(GoInt id);
+extern char* RegisterInstanceEventCallback(GoInt id, char* path, asgi_callback_fn callback);
+extern char* SetReadConcurrency(GoInt limit);
+extern char* SetWriteConcurrency(GoInt limit);
+extern char* RegisterLifespanCallback(asgi_callback_fn callback);
+extern char* SetAcceptOverflowStrategy(char* strategy);
+extern char* RegisterConnectionCallback(asgi_connection_fn callback);
+extern GoInt GetListenerFD(void);
+extern char* EnableMaintenanceMode(GoInt statusCode, char* contentType, char* body);
+extern char* DisableMaintenanceMode(void);
+extern char* GetTimingMetrics(void);
+extern char* GetLastResponseStats(void);
+extern char* SetNilResponseBehavior(char* behavior, GoInt status, asgi_callback_fn fallback);
+extern char* EnableMethodOverride(GoUint8 enabled);
+extern char* RegisterEventCallbackPattern(char* pattern, asgi_callback_fn callback);
+extern asgi_response* WriteProblemResponse(char* requestId, GoInt status, char* problemType, char* title, char* detail);
+extern char* SetProblemJSONErrors(GoUint8 enabled);
+extern char* EnableMetrics(char* path);
+extern char* SetTrustedProxies(char* cidrs);
+extern char* SetHonorRangeOnCallbackResponses(GoUint8 enabled);
+extern char* SetRateLimit(GoInt requestsPerSecond, GoInt burst);
+extern char* SetGlobalRateLimit(GoInt requestsPerSecond, GoInt burst);
+extern char* RegisterRawCallback(char* path, asgi_raw_callback_fn callback);
+extern char* SetRequestIdStrategy(char* strategy);
+extern char* RegisterRequestIDGenerator(asgi_request_id_fn generator);
+extern char* RegisterNotFoundCallback(asgi_callback_fn callback);
+extern char* RegisterEventCallbackPrefix(char* prefix, asgi_callback_fn callback);
+extern char* SetRouteQueueTimeout(char* path, GoInt timeoutMilliseconds);
+extern char* UnregisterEventCallback(char* path);
+extern char* ReplaceRouteTable(char** paths, asgi_callback_fn* callbackFns, GoInt count);
+extern char* ListRegisteredRoutes(void);
+extern char* PauseRoute(char* path);
+extern char* ResumeRoute(char* path);
+extern char* SetRoutePreloadLinks(char* path, char* linksJson);
 extern void freeAsgiEvent(asgi_event* event);
+extern void FreeCString(char* ptr);
 extern char* RegisterEventCallback(char* path, asgi_callback_fn callback);
-extern char* StartServer(GoInt port);
-extern char* StopServer();
-extern char* GetConcurrentRequests();
+extern char* RegisterEventCallbackMethod(char* method, char* path, asgi_callback_fn callback);
+extern char* RegisterEventCallbackWithTimeout(char* path, asgi_callback_fn callback, GoInt timeoutMilliseconds);
+extern char* RegisterEventCallbackWithCacheControl(char* path, asgi_callback_fn callback, char* cacheControl);
+extern char* StartServer(GoInt port, GoInt maxConcurrent);
+extern char* StartServerTLS(GoInt port, char* certFile, char* keyFile);
+extern char* StartServerUnix(char* socketPath);
+extern char* StopServer(void);
+extern char* StopServerWithTimeout(GoInt timeoutSeconds);
+extern char* StopServerGraceful(GoInt timeoutSeconds);
+extern char* SetMaxRequestsPerConnection(GoInt n);
+extern char* SetMaxResponseHeaders(GoInt count, GoInt totalBytes);
+extern char* GetConcurrentRequests(void);
+extern char* GetServerStatus(void);
+extern char* SetQueueTimeout(GoInt timeoutMilliseconds);
+extern char* EnableServerTiming(GoUint8 enabled);
+extern char* RegisterStaticDir(char* urlPrefix, char* dir);
+extern char* SetStaticDirListing(char* urlPrefix, GoUint8 enabled);
+extern char* StreamResponseChunk(char* requestId, asgi_response* chunk);
+extern char* SetClientTimeoutHeader(char* name, GoInt maxMilliseconds);
+extern char* ConfigureTimeouts(GoInt readMilliseconds, GoInt writeMilliseconds, GoInt idleMilliseconds);
+extern char* GenerateChildTraceparent(char* parent);
+extern char* SetUpgradeBehavior(char* behavior);
+extern char* SetValidateHeaderUTF8(GoUint8 enabled);
+extern char* SetMaxHeaderLineBytes(GoInt n);
+extern char* SetWebSocketKeepalive(GoInt pingIntervalMs, GoInt pongTimeoutMs);
 
 #ifdef __cplusplus
 }
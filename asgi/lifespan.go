@@ -0,0 +1,68 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the lifespan callback safely
+// static inline asgi_response* call_lifespan_callback(asgi_callback_fn callback, asgi_event* event) {
+//     if (callback == NULL) return NULL;
+//     return callback(event);
+// }
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+var (
+	lifespanMu sync.RWMutex
+	// Receives the lifespan.startup and lifespan.shutdown events when set
+	lifespanCallback C.asgi_callback_fn
+)
+
+//export RegisterLifespanCallback
+func RegisterLifespanCallback(callback C.asgi_callback_fn) *C.char {
+	lifespanMu.Lock()
+	lifespanCallback = callback
+	lifespanMu.Unlock()
+
+	if callback == nil {
+		return C.CString("Lifespan callback cleared")
+	}
+	return C.CString("Lifespan callback registered")
+}
+
+// runLifespan sends a lifespan event to the registered callback. A response
+// with an error status reports failure, its body being the message; no
+// response, or any other status, is success.
+func runLifespan(eventType string) error {
+	lifespanMu.RLock()
+	callback := lifespanCallback
+	lifespanMu.RUnlock()
+
+	if callback == nil {
+		return nil
+	}
+
+	// Lifespan events carry no request, every other field is left empty
+	event := (*C.asgi_event)(C.calloc(1, C.size_t(unsafe.Sizeof(C.asgi_event{}))))
+	event._type = goStringToAsgiString(eventType)
+	event.request_id = goStringToAsgiString(generateRequestId())
+
+	response := C.call_lifespan_callback(callback, event)
+	if response == nil {
+		return nil
+	}
+	defer freeAsgiResponse(response)
+
+	if status := int(response.status); status >= 400 {
+		message := fmt.Sprintf("status %d", status)
+		if response.body != nil && response.body_length > 0 {
+			message = C.GoStringN((*C.char)(unsafe.Pointer(response.body)), C.int(response.body_length))
+		}
+		return fmt.Errorf("%s failed: %s", eventType, message)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the connection callback safely
+// static inline bool call_connection_callback(asgi_connection_fn callback, const char* remote_addr) {
+//     if (callback == NULL) return true;
+//     return callback(remote_addr);
+// }
+import "C"
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// What the listener does with new connections while every request slot is taken
+const (
+	// Accept as usual and let the OS backlog drop what it cannot hold
+	acceptOverflowDrop int32 = iota
+	// Back off briefly before accepting, to shed load gracefully
+	acceptOverflowDelay
+	// Accept, then immediately answer 503 and close the connection, or just
+	// close it on TLS listeners
+	acceptOverflowReject
+)
+
+const (
+	// Pause between overload checks with the delay strategy
+	acceptBackoffStep = 10 * time.Millisecond
+	// Longest an accept is held back with the delay strategy
+	acceptBackoffMax = 100 * time.Millisecond
+)
+
+var (
+	acceptOverflowStrategy atomic.Int32
+
+	// Callback deciding whether to keep each new connection, guarded by connectionCallbackMu
+	connectionCallbackMu sync.RWMutex
+	connectionCallback   C.asgi_connection_fn
+
+	acceptOverflowStrategies = map[string]int32{
+		"drop":   acceptOverflowDrop,
+		"delay":  acceptOverflowDelay,
+		"reject": acceptOverflowReject,
+	}
+
+	// Canned response for connections rejected at accept time
+	overloadedBody     = "Server is at capacity, please try again later"
+	overloadedResponse = fmt.Appendf(nil, "HTTP/1.1 503 Service Unavailable\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Connection: close\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n%s", len(overloadedBody), overloadedBody)
+)
+
+//export SetAcceptOverflowStrategy
+func SetAcceptOverflowStrategy(strategy *C.char) *C.char {
+	name := C.GoString(strategy)
+	value, ok := acceptOverflowStrategies[name]
+	if !ok {
+		return C.CString(fmt.Sprintf("Unknown accept overflow strategy: %s (expected drop, delay or reject)", name))
+	}
+	acceptOverflowStrategy.Store(value)
+	return C.CString(fmt.Sprintf("Accept overflow strategy set to %s", name))
+}
+
+// overflowListener applies the accept overflow strategy to a listener
+type overflowListener struct {
+	net.Listener
+	// Request slots of the server owning the listener
+	semaphore chan struct{}
+	// Connections start with a TLS handshake, which a plaintext 503 would
+	// only corrupt
+	tls bool
+}
+
+func newOverflowListener(l net.Listener, semaphore chan struct{}, tls bool) net.Listener {
+	return &overflowListener{Listener: l, semaphore: semaphore, tls: tls}
+}
+
+// overloaded reports whether every request slot of the server is in use
+func (l *overflowListener) overloaded() bool {
+	return len(l.semaphore) >= cap(l.semaphore)
+}
+
+func (l *overflowListener) Accept() (net.Conn, error) {
+	conn, err := l.accept()
+	if err != nil {
+		return nil, err
+	}
+	connectionCallbackMu.RLock()
+	screened := connectionCallback != nil
+	connectionCallbackMu.RUnlock()
+	// The callback may block, so it runs in the goroutine serving the
+	// connection rather than holding up the accept loop
+	if screened {
+		return &screenedConn{Conn: conn, allow: allowConnection}, nil
+	}
+	return conn, nil
+}
+
+// accept accepts the next connection according to the overflow strategy
+func (l *overflowListener) accept() (net.Conn, error) {
+	for {
+		switch acceptOverflowStrategy.Load() {
+		case acceptOverflowDelay:
+			for waited := time.Duration(0); l.overloaded() && waited < acceptBackoffMax; waited += acceptBackoffStep {
+				time.Sleep(acceptBackoffStep)
+			}
+		case acceptOverflowReject:
+			conn, err := l.Listener.Accept()
+			if err != nil {
+				return nil, err
+			}
+			if l.overloaded() {
+				if l.tls {
+					conn.Close()
+				} else {
+					go rejectConnection(conn)
+				}
+				continue
+			}
+			return conn, nil
+		}
+		return l.Listener.Accept()
+	}
+}
+
+//export RegisterConnectionCallback
+func RegisterConnectionCallback(callback C.asgi_connection_fn) *C.char {
+	connectionCallbackMu.Lock()
+	connectionCallback = callback
+	connectionCallbackMu.Unlock()
+
+	if callback == nil {
+		return C.CString("Connection callback removed")
+	}
+	return C.CString("Connection callback registered")
+}
+
+// allowConnection asks the connection callback, if any, whether to keep a
+// newly accepted connection
+func allowConnection(conn net.Conn) bool {
+	connectionCallbackMu.RLock()
+	callback := connectionCallback
+	connectionCallbackMu.RUnlock()
+
+	if callback == nil {
+		return true
+	}
+	remoteAddr := C.CString(conn.RemoteAddr().String())
+	defer C.free(unsafe.Pointer(remoteAddr))
+	return bool(C.call_connection_callback(callback, remoteAddr))
+}
+
+// screenedConn asks allow whether to keep the connection on its first read
+// or write, closing it when refused
+type screenedConn struct {
+	net.Conn
+	allow   func(net.Conn) bool
+	once    sync.Once
+	allowed bool
+}
+
+// screen runs the check once, reporting whether the connection is kept
+func (c *screenedConn) screen() bool {
+	c.once.Do(func() {
+		c.allowed = c.allow(c.Conn)
+		if !c.allowed {
+			c.Conn.Close()
+		}
+	})
+	return c.allowed
+}
+
+func (c *screenedConn) Read(b []byte) (int, error) {
+	if !c.screen() {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *screenedConn) Write(b []byte) (int, error) {
+	if !c.screen() {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+// rejectConnection answers a connection with a 503 and closes it
+func rejectConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(overloadedResponse)
+}
+
+// GetListenerFD returns the file descriptor of the running server's
+// listener, or -1 when no server is running or the listener does not expose
+// one. The descriptor stays owned by the server: callers must not close it,
+// and it becomes invalid once the server stops. Descriptors are meaningful
+// on Unix platforms; on Windows the value is a SOCKET handle.
+//
+//export GetListenerFD
+func GetListenerFD() int {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server == nil || serverListener == nil {
+		return -1
+	}
+	sc, ok := serverListener.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+
+	fd := -1
+	if err := rawConn.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return -1
+	}
+	return fd
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestScreenedConnRejects(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var checked net.Conn
+	conn := &screenedConn{Conn: server, allow: func(c net.Conn) bool {
+		checked = c
+		return false
+	}}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read on a refused connection: %v, want net.ErrClosed", err)
+	}
+	if checked != server {
+		t.Error("allow was not given the accepted connection")
+	}
+	// The refused connection is closed, which the peer sees
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("peer read from a refused connection succeeded")
+	}
+}
+
+func TestScreenedConnAllows(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	calls := 0
+	conn := &screenedConn{Conn: server, allow: func(net.Conn) bool {
+		calls++
+		return true
+	}}
+	go client.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hi" {
+		t.Fatalf("Read = %q, %v, want \"hi\"", buf[:n], err)
+	}
+	go client.Read(make([]byte, 2))
+	if _, err := conn.Write([]byte("ok")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("allow called %d times, want once", calls)
+	}
+}
+
+func TestOverflowListenerOverloaded(t *testing.T) {
+	semaphore := make(chan struct{}, 1)
+	l := &overflowListener{semaphore: semaphore}
+	if l.overloaded() {
+		t.Error("empty semaphore reported as overloaded")
+	}
+	semaphore <- struct{}{}
+	if !l.overloaded() {
+		t.Error("full semaphore not reported as overloaded")
+	}
+}
+
+// overloadedListener returns an overflow listener on a local port whose
+// server has every request slot taken, with the semaphore to free them
+func overloadedListener(t *testing.T, tls bool) (net.Listener, chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	semaphore := make(chan struct{}, 1)
+	semaphore <- struct{}{}
+	return newOverflowListener(l, semaphore, tls), semaphore
+}
+
+// useOverflowStrategy applies strategy until the test ends
+func useOverflowStrategy(t *testing.T, strategy int32) {
+	previous := acceptOverflowStrategy.Swap(strategy)
+	t.Cleanup(func() { acceptOverflowStrategy.Store(previous) })
+}
+
+// acceptAsync accepts the next connection of l in the background
+func acceptAsync(l net.Listener) <-chan net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	return accepted
+}
+
+func TestAcceptOverflowDrop(t *testing.T) {
+	useOverflowStrategy(t, acceptOverflowDrop)
+	l, _ := overloadedListener(t, false)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case conn := <-acceptAsync(l):
+		conn.Close()
+	case <-time.After(acceptBackoffMax / 2):
+		t.Error("drop strategy held back the accept")
+	}
+}
+
+func TestAcceptOverflowDelay(t *testing.T) {
+	useOverflowStrategy(t, acceptOverflowDelay)
+	l, _ := overloadedListener(t, false)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	start := time.Now()
+	conn := <-acceptAsync(l)
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	conn.Close()
+	// Overloaded for the whole wait, the accept goes ahead after the longest back-off
+	if waited := time.Since(start); waited < acceptBackoffMax {
+		t.Errorf("accepted after %v, want at least %v", waited, acceptBackoffMax)
+	}
+}
+
+func TestAcceptOverflowReject(t *testing.T) {
+	useOverflowStrategy(t, acceptOverflowReject)
+	l, semaphore := overloadedListener(t, false)
+	accepted := acceptAsync(l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("rejected client got no response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("rejected client got %d, want 503", resp.StatusCode)
+	}
+
+	// Once a slot is free the next connection is accepted
+	<-semaphore
+	next, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Error("connection not accepted once a slot was free")
+	}
+}
+
+func TestAcceptOverflowRejectTLS(t *testing.T) {
+	useOverflowStrategy(t, acceptOverflowReject)
+	l, _ := overloadedListener(t, true)
+	acceptAsync(l)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	// The connection is closed without a plaintext response
+	if n, err := client.Read(make([]byte, 1)); n != 0 || !errors.Is(err, io.EOF) {
+		t.Errorf("rejected TLS client read %d bytes, %v, want EOF", n, err)
+	}
+}
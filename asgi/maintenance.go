@@ -0,0 +1,55 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// maintenanceResponse is served for every route while maintenance mode is on
+type maintenanceResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// Current maintenance response, nil when maintenance mode is off
+var maintenance atomic.Pointer[maintenanceResponse]
+
+//export EnableMaintenanceMode
+func EnableMaintenanceMode(statusCode int, contentType, body *C.char) *C.char {
+	// A 1xx is not a final status, net/http would follow it with a 200
+	if statusCode < 200 || statusCode > 599 {
+		return C.CString(fmt.Sprintf("Invalid maintenance status code: %d", statusCode))
+	}
+	maintenance.Store(&maintenanceResponse{
+		status:      statusCode,
+		contentType: C.GoString(contentType),
+		body:        []byte(C.GoString(body)),
+	})
+	return C.CString(fmt.Sprintf("Maintenance mode enabled with status %d", statusCode))
+}
+
+//export DisableMaintenanceMode
+func DisableMaintenanceMode() *C.char {
+	maintenance.Store(nil)
+	return C.CString("Maintenance mode disabled")
+}
+
+// serveMaintenance writes the maintenance response if maintenance mode is on.
+// It runs before routing, so neither callbacks nor the semaphore are involved.
+func serveMaintenance(w http.ResponseWriter) bool {
+	m := maintenance.Load()
+	if m == nil {
+		return false
+	}
+	if m.contentType != "" {
+		w.Header().Set("Content-Type", m.contentType)
+	}
+	w.WriteHeader(m.status)
+	w.Write(m.body)
+	return true
+}
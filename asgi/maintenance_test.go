@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+func TestMaintenanceBypassesCallbacksNotHealthChecks(t *testing.T) {
+	handleCallback(t, "/maintained", cfixtures.EchoPathCallback())
+	health := "/healthz"
+	healthCheckPath.Store(&health)
+	defer healthCheckPath.Store(nil)
+	maintenance.Store(&maintenanceResponse{status: http.StatusServiceUnavailable, contentType: "text/html", body: []byte("<p>Back soon</p>")})
+	defer maintenance.Store(nil)
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/maintained", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<p>Back soon</p>" {
+		t.Errorf("route during maintenance: got %d %q, want the maintenance page", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/html" {
+		t.Errorf("Content-Type = %q, want text/html", got)
+	}
+
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}` {
+		t.Errorf("health check during maintenance: got %d %q", w.Code, w.Body.String())
+	}
+
+	maintenance.Store(nil)
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/maintained", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "/maintained" {
+		t.Errorf("route after maintenance: got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,119 @@
+// Package marily is the Go API of the asgi-go server: handlers written in Go
+// and middleware around the server's root handler.
+//
+// The server itself is built as a C shared library, so its main package
+// cannot be imported. Go code compiled into that library imports this
+// package instead, typically registering from an init function:
+//
+//	func init() {
+//		marily.Handle("/hello", func(ev marily.Event) marily.Response {
+//			return marily.Response{Status: 200, Body: []byte("hello")}
+//		})
+//	}
+//
+// Go handlers get the same treatment as C callbacks: request slots, route
+// pausing, header checks, timeouts and metrics. Their events are built like
+// those of C callbacks but never cross the cgo boundary.
+package marily
+
+import (
+	"errors"
+	"sync"
+)
+
+// Event is an event as built in Go, before the server copies it into a C
+// asgi_event. Go handlers receive it as is.
+type Event struct {
+	// "http.request", "websocket.connect", "websocket.receive" or "websocket.disconnect"
+	Type      string
+	RequestID string
+	Method    string
+	Path      string
+	// The request target exactly as it appeared on the request line
+	RequestTarget string
+	QueryString   string
+	// Decoded query parameters, one entry per value, by name
+	QueryParams [][2]string
+	// Declared Content-Length of the body, -1 when unknown
+	ContentLength int64
+	// WebSocket subprotocols offered by the client, in order of preference
+	Subprotocols []string
+	// "1.0", "1.1", "2" or "3"
+	HTTPVersion string
+	Scheme      string
+	// Header names are lowercased unless header case is preserved
+	Headers [][2]string
+	// Segments captured by the route pattern
+	PathParams [][2]string
+	// Host and port of each side of the connection
+	Client [2]string
+	Server [2]string
+	Body   []byte
+	// More body chunks follow in further events
+	MoreBody bool
+	// websocket.receive: the body is a text frame rather than a binary one
+	BodyIsText bool
+	// W3C traceparent to propagate on downstream calls
+	Traceparent string
+}
+
+// Response is the Go counterpart of asgi_response, returned by Go handlers.
+// A zero Status means 200.
+type Response struct {
+	Status  int
+	Headers [][2]string
+	Body    []byte
+}
+
+// HandlerFunc handles the http.request event of each request of a route
+type HandlerFunc func(Event) Response
+
+// handlerRegistration is a Handle call made before the server was bound
+type handlerRegistration struct {
+	path string
+	fn   HandlerFunc
+}
+
+var (
+	// Guards register and pending
+	handlersMu sync.Mutex
+	// Adds a route to the server, nil until the server binds itself
+	register func(path string, fn HandlerFunc) error
+	// Handlers registered before the server bound itself, in order
+	pending []handlerRegistration
+)
+
+// Handle registers fn for the requests matching path, a pattern as accepted
+// by net/http's ServeMux. Registering a path again replaces its handler.
+// Handlers registered before the server library has loaded are added to it
+// once it has, and an invalid pattern is reported then.
+func Handle(path string, fn HandlerFunc) error {
+	if fn == nil {
+		return errors.New("marily: nil handler")
+	}
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if register == nil {
+		pending = append(pending, handlerRegistration{path: path, fn: fn})
+		return nil
+	}
+	return register(path, fn)
+}
+
+// Bind is called by the server library as it loads, with the function
+// adding a Go handler to its route table. The handlers registered so far are
+// added right away, and the errors of those that could not be are returned.
+func Bind(registerFn func(path string, fn HandlerFunc) error) error {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	register = registerFn
+	var errs []error
+	for _, h := range pending {
+		if err := register(h.path, h.fn); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	pending = nil
+	return errors.Join(errs...)
+}
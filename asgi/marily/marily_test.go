@@ -0,0 +1,50 @@
+package marily
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHandleBeforeBind(t *testing.T) {
+	handlersMu.Lock()
+	register, pending = nil, nil
+	handlersMu.Unlock()
+
+	hello := func(Event) Response { return Response{Body: []byte("hello")} }
+	if err := Handle("/hello", hello); err != nil {
+		t.Fatalf("Handle before Bind: %v", err)
+	}
+	if err := Handle("/bad", hello); err != nil {
+		t.Fatalf("Handle before Bind: %v", err)
+	}
+
+	var registered []string
+	errBad := errors.New("bad pattern")
+	err := Bind(func(path string, fn HandlerFunc) error {
+		if path == "/bad" {
+			return errBad
+		}
+		registered = append(registered, path)
+		return nil
+	})
+	if !errors.Is(err, errBad) {
+		t.Errorf("Bind error = %v, want %v", err, errBad)
+	}
+	if len(registered) != 1 || registered[0] != "/hello" {
+		t.Errorf("registered %v, want [/hello]", registered)
+	}
+
+	// Once bound, handlers are registered right away
+	if err := Handle("/later", hello); err != nil {
+		t.Fatalf("Handle after Bind: %v", err)
+	}
+	if len(registered) != 2 || registered[1] != "/later" {
+		t.Errorf("registered %v, want [/hello /later]", registered)
+	}
+}
+
+func TestHandleNil(t *testing.T) {
+	if err := Handle("/nil", nil); err == nil {
+		t.Error("Handle accepted a nil handler")
+	}
+}
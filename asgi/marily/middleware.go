@@ -0,0 +1,55 @@
+package marily
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Middleware wraps a handler with behavior of its own, such as auth, logging
+// or recovery. It calls next to pass the request on, or answers it itself.
+type Middleware func(next http.Handler) http.Handler
+
+var (
+	// Serializes access to middlewares
+	middlewareMu sync.Mutex
+	// Middleware wrapping the root handler of every server, in the order added
+	middlewares []Middleware
+)
+
+// Use adds mw to the middleware chain around the root handler of every
+// server. The first middleware added is the outermost, seeing requests first
+// and responses last. Each server builds its chain when it starts, so
+// middleware added later applies from the next start:
+//
+//	marily.Use(func(next http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			w.Header().Set("X-Served-By", "marily")
+//			next.ServeHTTP(w, r)
+//		})
+//	})
+func Use(mw Middleware) {
+	if mw == nil {
+		return
+	}
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	middlewares = append(middlewares, mw)
+}
+
+// Chain wraps h in the middleware added with Use, as the chain stands
+func Chain(h http.Handler) http.Handler {
+	middlewareMu.Lock()
+	chain := slices.Clone(middlewares)
+	middlewareMu.Unlock()
+	return Wrap(h, chain...)
+}
+
+// Wrap wraps h in mws, the first of them outermost
+func Wrap(h http.Handler, mws ...Middleware) http.Handler {
+	// Wrap from the innermost out, so the first runs first
+	for _, mw := range slices.Backward(mws) {
+		h = mw(h)
+	}
+	return h
+}
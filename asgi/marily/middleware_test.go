@@ -0,0 +1,48 @@
+package marily
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tag returns middleware appending name to the X-Order response header
+func tag(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Order", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestWrapOrder(t *testing.T) {
+	h := Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Order", "handler")
+	}), tag("outer"), tag("inner"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := strings.Join(w.Header().Values("X-Order"), ","); got != "outer,inner,handler" {
+		t.Errorf("order = %s, want outer,inner,handler", got)
+	}
+}
+
+func TestChainSnapshot(t *testing.T) {
+	middlewareMu.Lock()
+	middlewares = nil
+	middlewareMu.Unlock()
+
+	Use(tag("first"))
+	Use(nil)
+	h := Chain(http.NotFoundHandler())
+	// Added after the chain was built, so not part of it
+	Use(tag("second"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := strings.Join(w.Header().Values("X-Order"), ","); got != "first" {
+		t.Errorf("order = %s, want first", got)
+	}
+}
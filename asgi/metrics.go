@@ -0,0 +1,198 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in seconds, of the latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	// Time from handler entry to the first byte of the response
+	ttfbHistogram = newHistogram(latencyBuckets)
+	// Time from handler entry to the end of the response
+	requestDurationHistogram = newHistogram(latencyBuckets)
+	// What was sent for the most recently finished request, nil before any
+	lastResponseStats atomic.Pointer[responseStats]
+	// Finished requests by status class, 1xx to 5xx
+	statusClassCounts [5]atomic.Int64
+)
+
+// responseStats describes the response sent for a request
+type responseStats struct {
+	RequestId  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// histogram is a lock-free cumulative histogram of durations in seconds
+type histogram struct {
+	bounds []float64
+	// One counter per bound plus a final +Inf bucket, not cumulative
+	counts []atomic.Int64
+	count  atomic.Int64
+	// Sum of all observations in nanoseconds
+	sumNanos atomic.Int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(h.bounds) && seconds > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sumNanos.Add(int64(d))
+}
+
+// histogramSnapshot is a point-in-time copy of a histogram
+type histogramSnapshot struct {
+	// Cumulative counts per upper bound, the last one being +Inf
+	Buckets []int64   `json:"buckets"`
+	Bounds  []float64 `json:"bounds"`
+	Count   int64     `json:"count"`
+	Sum     float64   `json:"sum"`
+}
+
+func (h *histogram) snapshot() histogramSnapshot {
+	s := histogramSnapshot{Bounds: h.bounds, Buckets: make([]int64, len(h.counts))}
+	var cumulative int64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		s.Buckets[i] = cumulative
+	}
+	s.Count = h.count.Load()
+	s.Sum = time.Duration(h.sumNanos.Load()).Seconds()
+	return s
+}
+
+//export GetTimingMetrics
+func GetTimingMetrics() *C.char {
+	result, _ := json.Marshal(map[string]histogramSnapshot{
+		"time_to_first_byte_seconds": ttfbHistogram.snapshot(),
+		"request_duration_seconds":   requestDurationHistogram.snapshot(),
+	})
+	return C.CString(string(result))
+}
+
+//export GetLastResponseStats
+func GetLastResponseStats() *C.char {
+	stats := lastResponseStats.Load()
+	if stats == nil {
+		return C.CString("{}")
+	}
+	result, _ := json.Marshal(stats)
+	return C.CString(string(result))
+}
+
+// responseRecorder wraps a ResponseWriter to observe the response as it is
+// written, recording the time to its first byte, the status and the bytes
+// sent
+type responseRecorder struct {
+	http.ResponseWriter
+	start     time.Time
+	firstByte bool
+	// Status sent, 0 until the response starts
+	status int
+	// Body bytes written, after any compression
+	bytes int64
+	// ID of the request, once it has one
+	requestId string
+}
+
+func newResponseRecorder(w http.ResponseWriter, start time.Time) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, start: start}
+}
+
+// markFirstByte records the time to first byte, once
+func (rr *responseRecorder) markFirstByte() {
+	if !rr.firstByte {
+		rr.firstByte = true
+		ttfbHistogram.observe(time.Since(rr.start))
+	}
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	// Informational responses such as 103 Early Hints are not the response
+	if status >= 200 {
+		rr.markFirstByte()
+		if rr.status == 0 {
+			rr.status = status
+		}
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.markFirstByte()
+	// Like net/http, writing without a status sends 200
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	rr.markFirstByte()
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, as for WebSocket upgrades
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rr.ResponseWriter).Hijack()
+	if err == nil && rr.status == 0 {
+		rr.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// finish records the total duration and the response stats of the request
+// and logs it
+func (rr *responseRecorder) finish(r *http.Request) {
+	duration := time.Since(rr.start)
+	requestDurationHistogram.observe(duration)
+
+	// Nothing written means net/http sends an empty 200
+	status := rr.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	stats := &responseStats{
+		RequestId:  rr.requestId,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Status:     status,
+		Bytes:      rr.bytes,
+		DurationMs: float64(duration.Microseconds()) / 1000,
+	}
+	lastResponseStats.Store(stats)
+	if class := status / 100; class >= 1 && class <= 5 {
+		statusClassCounts[class-1].Add(1)
+	}
+	logAccess(r, rr.start, stats)
+}
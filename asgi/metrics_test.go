@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1})
+	for _, d := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, time.Second} {
+		h.observe(d)
+	}
+	s := h.snapshot()
+	if want := []int64{2, 3, 4}; len(s.Buckets) != len(want) || s.Buckets[0] != want[0] || s.Buckets[1] != want[1] || s.Buckets[2] != want[2] {
+		t.Errorf("buckets = %v, want %v", s.Buckets, want)
+	}
+	if s.Count != 4 || s.Sum != 1.065 {
+		t.Errorf("count %d, sum %v, want 4 and 1.065", s.Count, s.Sum)
+	}
+}
+
+func TestStreamedTimeToFirstByte(t *testing.T) {
+	const (
+		requestId  = "ttfb-stream"
+		firstDelay = 20 * time.Millisecond
+		chunkDelay = 100 * time.Millisecond
+	)
+	before := ttfbHistogram.snapshot()
+	start := time.Now()
+	rr := newResponseRecorder(httptest.NewRecorder(), start)
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+
+	// The first part of the response is ready after firstDelay, the rest
+	// follows chunkDelay later
+	time.Sleep(firstDelay)
+	first := newAsgiResponse(requestId, http.StatusOK, nil, []byte("first "))
+	defer freeAsgiResponse(first)
+	first.more_body = true
+	stream := openResponseStream(requestId)
+	defer stream.close(requestId)
+	if !writeResponseFromC(rr, r, first) {
+		t.Fatal("first part of the response not written")
+	}
+	go func() {
+		time.Sleep(chunkDelay)
+		stream.send(newAsgiResponse(requestId, http.StatusOK, nil, []byte("last")))
+	}()
+	writeResponseStream(rr, r, stream, time.Second)
+	total := time.Since(start)
+
+	if body := rr.ResponseWriter.(*httptest.ResponseRecorder).Body.String(); body != "first last" {
+		t.Fatalf("streamed body %q, want %q", body, "first last")
+	}
+	after := ttfbHistogram.snapshot()
+	if after.Count != before.Count+1 {
+		t.Fatalf("%d time to first byte observations, want 1", after.Count-before.Count)
+	}
+	// Measured up to the first part, not to the end of the stream
+	ttfb := time.Duration((after.Sum - before.Sum) * float64(time.Second))
+	if ttfb < firstDelay || ttfb > total-chunkDelay {
+		t.Errorf("time to first byte %v, want between %v and %v", ttfb, firstDelay, total-chunkDelay)
+	}
+}
+
+// waitForGauges waits until the waiting and executing gauges read waiting
+// and executing, and checks the metrics endpoint reports the same
+func waitForGauges(t *testing.T, waiting, executing int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for waitingRequests.Load() != waiting || executingRequests.Load() != executing {
+		if time.Now().After(deadline) {
+			t.Fatalf("gauges at %d waiting and %d executing, want %d and %d",
+				waitingRequests.Load(), executingRequests.Load(), waiting, executing)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		fmt.Sprintf("marily_requests_waiting %d\n", waiting),
+		fmt.Sprintf("marily_callbacks_executing %d\n", executing),
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("metrics endpoint lacks %q", strings.TrimSpace(line))
+		}
+	}
+}
+
+func TestWaitingAndExecutingGauges(t *testing.T) {
+	limitRequestSlots(t, 2, time.Minute)
+	release := make(chan struct{})
+	err := marily.Handle("/gauges", func(marily.Event) marily.Response {
+		<-release
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/gauges")
+
+	// Two requests take the slots, three queue for them
+	const requests = 5
+	done := make(chan struct{}, requests)
+	for range requests {
+		go func() {
+			dispatch(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gauges", nil))
+			done <- struct{}{}
+		}()
+	}
+	waitForGauges(t, 3, 2)
+
+	// A finished request hands its slot to a waiting one
+	release <- struct{}{}
+	<-done
+	waitForGauges(t, 2, 2)
+
+	for range requests - 1 {
+		release <- struct{}{}
+	}
+	for range requests - 1 {
+		<-done
+	}
+	waitForGauges(t, 0, 0)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+// Built-in checks run by dispatchMux ahead of every route tier, in order:
+// clients over their rate are turned away first, CORS preflights are
+// answered without invoking a route, and guarded paths need credentials
+var builtinMiddleware = []marily.Middleware{
+	rateLimitMiddleware,
+	corsPreflightMiddleware,
+	basicAuthMiddleware,
+}
+
+// applyMiddleware wraps h in the middleware chain added with marily.Use
+func applyMiddleware(h http.Handler) http.Handler {
+	return marily.Chain(h)
+}
+
+// rateLimitMiddleware answers 429 to clients over the configured rates
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkRateLimit(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// corsPreflightMiddleware answers CORS preflight requests itself
+func corsPreflightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !handleCORSPreflight(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// basicAuthMiddleware answers 401 to requests for guarded paths that lack
+// matching credentials
+func basicAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkBasicAuth(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
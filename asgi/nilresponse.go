@@ -0,0 +1,107 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the nil response fallback safely
+// static inline asgi_response* call_fallback_callback(asgi_callback_fn callback, asgi_event* event) {
+//     if (callback == NULL) return NULL;
+//     return callback(event);
+// }
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// What happens when a callback returns no response
+const (
+	// Answer with a fixed status
+	nilResponseStatus = "status"
+	// Ask the fallback callback for a response instead
+	nilResponseFallback = "fallback"
+	// Close the connection without answering
+	nilResponseClose = "close"
+)
+
+var (
+	nilResponseMu       sync.RWMutex
+	nilResponseBehavior = nilResponseStatus
+	nilResponseCode     = http.StatusInternalServerError
+	nilResponseCallback C.asgi_callback_fn
+)
+
+//export SetNilResponseBehavior
+func SetNilResponseBehavior(behavior *C.char, status int, fallback C.asgi_callback_fn) *C.char {
+	behaviorStr := C.GoString(behavior)
+
+	nilResponseMu.Lock()
+	defer nilResponseMu.Unlock()
+
+	switch behaviorStr {
+	case nilResponseStatus:
+		if status < 400 || status > 599 {
+			return C.CString("Nil response status must be between 400 and 599")
+		}
+		nilResponseCode = status
+	case nilResponseFallback:
+		if fallback == nil {
+			return C.CString("Nil response fallback must not be NULL")
+		}
+		nilResponseCallback = fallback
+	case nilResponseClose:
+	default:
+		return C.CString(fmt.Sprintf("Unknown nil response behavior: %s (expected status, fallback or close)", behaviorStr))
+	}
+	nilResponseBehavior = behaviorStr
+	return C.CString(fmt.Sprintf("Nil response behavior set to %s", behaviorStr))
+}
+
+// handleNilResponse deals with a callback that returned no response. It
+// returns the fallback's response for the caller to write, or nil once the
+// request has been answered.
+func handleNilResponse(w http.ResponseWriter, r *http.Request, requestId string, timeoutChan <-chan time.Time) *C.asgi_response {
+	nilResponseMu.RLock()
+	behavior, status, fallback := nilResponseBehavior, nilResponseCode, nilResponseCallback
+	nilResponseMu.RUnlock()
+
+	switch behavior {
+	case nilResponseClose:
+		// Aborting the handler closes the connection, or resets the stream
+		panic(http.ErrAbortHandler)
+	case nilResponseFallback:
+		// The body went to the callback already, the fallback gets the scope only
+		cEvent := newAsgiEvent(r, requestId, "http.request", nil)
+		responseChan := make(chan *C.asgi_response, 1)
+		go func() {
+			// A panic here would take the host process down with it
+			defer func() {
+				if p := recover(); p != nil {
+					fmt.Printf("Panic in nil response fallback for request %s: %v\n%s", requestId, p, debug.Stack())
+					responseChan <- nil
+				}
+			}()
+			executingRequests.Add(1)
+			defer executingRequests.Add(-1)
+			responseChan <- C.call_fallback_callback(fallback, cEvent)
+		}()
+		select {
+		case response := <-responseChan:
+			if response != nil {
+				return response
+			}
+		case <-timeoutChan:
+			go freeLateResponse(responseChan)
+			writeError(w, http.StatusGatewayTimeout, "Request processing timed out")
+			return nil
+		}
+		status = http.StatusInternalServerError
+	}
+
+	writeError(w, status, "No response from event handler")
+	return nil
+}
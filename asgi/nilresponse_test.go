@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+// useNilResponse sets what happens to nil responses until the test ends
+func useNilResponse(t *testing.T, behavior string, status int, fallback *[0]byte) {
+	t.Helper()
+	nilResponseMu.Lock()
+	defer nilResponseMu.Unlock()
+	previousBehavior, previousStatus, previousFallback := nilResponseBehavior, nilResponseCode, nilResponseCallback
+	nilResponseBehavior, nilResponseCode, nilResponseCallback = behavior, status, fallback
+	t.Cleanup(func() {
+		nilResponseMu.Lock()
+		defer nilResponseMu.Unlock()
+		nilResponseBehavior, nilResponseCode, nilResponseCallback = previousBehavior, previousStatus, previousFallback
+	})
+}
+
+func TestNilResponseStatus(t *testing.T) {
+	handleCallback(t, "/nil", cfixtures.NilCallback())
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/nil", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("default: got %d, want 500", w.Code)
+	}
+
+	useNilResponse(t, nilResponseStatus, http.StatusServiceUnavailable, nil)
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/nil", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status 503: got %d, want 503", w.Code)
+	}
+}
+
+func TestNilResponseFallback(t *testing.T) {
+	handleCallback(t, "/nil", cfixtures.NilCallback())
+	useNilResponse(t, nilResponseFallback, http.StatusInternalServerError, cfixtures.FallbackCallback())
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/nil", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "fallback" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "fallback")
+	}
+
+	// A fallback producing no response either ends in a 500
+	useNilResponse(t, nilResponseFallback, http.StatusInternalServerError, cfixtures.NilCallback())
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/nil", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("nil fallback: got %d, want 500", w.Code)
+	}
+}
+
+func TestNilResponseClose(t *testing.T) {
+	handleCallback(t, "/nil", cfixtures.NilCallback())
+	useNilResponse(t, nilResponseClose, http.StatusInternalServerError, nil)
+	ts := startTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/nil")
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("got %d, want the connection closed without a response", resp.StatusCode)
+	}
+}
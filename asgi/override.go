@@ -0,0 +1,56 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// Header and query parameter carrying the emulated method
+	methodOverrideHeader = "X-HTTP-Method-Override"
+	methodOverrideParam  = "_method"
+)
+
+// Methods a POST may be turned into. Only methods that clients behind
+// restrictive proxies cannot send are allowed, never CONNECT or TRACE.
+var methodOverrideTargets = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// When set, POST requests may override their method
+var methodOverride atomic.Bool
+
+//export EnableMethodOverride
+func EnableMethodOverride(enabled bool) *C.char {
+	methodOverride.Store(enabled)
+	return C.CString(fmt.Sprintf("Method override enabled: %t", enabled))
+}
+
+// applyMethodOverride replaces the method of a POST request with the one in
+// its override header, or failing that its _method query parameter, so that
+// routing and the scope see the emulated method
+func applyMethodOverride(r *http.Request) {
+	if !methodOverride.Load() || r.Method != http.MethodPost {
+		return
+	}
+
+	override := r.Header.Get(methodOverrideHeader)
+	if override == "" {
+		override = r.URL.Query().Get(methodOverrideParam)
+	}
+	override = strings.ToUpper(strings.TrimSpace(override))
+	if override == "" {
+		return
+	}
+
+	for _, target := range methodOverrideTargets {
+		if override == target {
+			fmt.Printf("Method override applied: POST %s -> %s\n", r.URL.Path, override)
+			r.Method = override
+			return
+		}
+	}
+}
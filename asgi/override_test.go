@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestMethodOverride(t *testing.T) {
+	methodOverride.Store(true)
+	defer methodOverride.Store(false)
+	methods := make(chan string, 1)
+	err := marily.Handle("/override", func(ev marily.Event) marily.Response {
+		methods <- ev.Method
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/override")
+	handleBody(t, "DELETE /override/routed", "deleted")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header string
+		want   string
+	}{
+		{"header", http.MethodPost, "/override", "PUT", http.MethodPut},
+		{"query", http.MethodPost, "/override?_method=delete", "", http.MethodDelete},
+		{"header wins over query", http.MethodPost, "/override?_method=DELETE", "patch", http.MethodPatch},
+		{"unsafe target", http.MethodPost, "/override", "CONNECT", http.MethodPost},
+		{"not a POST", http.MethodGet, "/override?_method=DELETE", "", http.MethodGet},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("X-HTTP-Method-Override", tt.header)
+		}
+		dispatch(httptest.NewRecorder(), r)
+		if got := <-methods; got != tt.want {
+			t.Errorf("%s: scope method %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Routing sees the overridden method
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, "/override/routed?_method=DELETE", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "deleted" {
+		t.Errorf("routed override: got %d %q, want 200 %q", w.Code, w.Body.String(), "deleted")
+	}
+
+	// Overrides are opt-in
+	methodOverride.Store(false)
+	r := httptest.NewRequest(http.MethodPost, "/override", nil)
+	r.Header.Set("X-HTTP-Method-Override", "PUT")
+	dispatch(httptest.NewRecorder(), r)
+	if got := <-methods; got != http.MethodPost {
+		t.Errorf("disabled: scope method %s, want POST", got)
+	}
+}
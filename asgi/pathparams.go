@@ -0,0 +1,86 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// muxPattern translates a route pattern with ":param" and "*wildcard"
+// segments, optionally preceded by a method ("GET /users/:id"), into a
+// ServeMux pattern ("GET /users/{id}")
+func muxPattern(pattern string) (string, error) {
+	method, path, hasMethod := strings.Cut(pattern, " ")
+	if !hasMethod {
+		method, path = "", pattern
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			if len(segment) == 1 {
+				return "", fmt.Errorf("unnamed parameter in %q", pattern)
+			}
+			segments[i] = "{" + segment[1:] + "}"
+		case strings.HasPrefix(segment, "*"):
+			if len(segment) == 1 {
+				return "", fmt.Errorf("unnamed wildcard in %q", pattern)
+			}
+			if i != len(segments)-1 {
+				return "", fmt.Errorf("wildcard %s must be the last segment of %q", segment, pattern)
+			}
+			segments[i] = "{" + segment[1:] + "...}"
+		case strings.ContainsAny(segment, "{}"):
+			return "", fmt.Errorf("braces are not allowed in %q", pattern)
+		}
+	}
+
+	path = strings.Join(segments, "/")
+	if hasMethod {
+		return method + " " + path, nil
+	}
+	return path, nil
+}
+
+//export RegisterEventCallbackPattern
+func RegisterEventCallbackPattern(pattern *C.char, callback C.asgi_callback_fn) *C.char {
+	patternStr := C.GoString(pattern)
+	translated, err := muxPattern(patternStr)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error registering pattern %s: %v", patternStr, err))
+	}
+
+	// ServeMux prefers the most specific pattern and refuses ambiguous ones
+	if err := registerRoute(translated, newEventRoute(callback)); err != nil {
+		return C.CString(fmt.Sprintf("Error registering pattern %s: %v", patternStr, err))
+	}
+	fmt.Print("Event callback registered for pattern: ", patternStr, "\n")
+	return C.CString(fmt.Sprintf("Event callback registered for pattern: %s", patternStr))
+}
+
+// pathParams returns the segments captured by the pattern the request
+// matched, in pattern order
+func pathParams(r *http.Request) [][2]string {
+	var params [][2]string
+	rest := r.Pattern
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			return params
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return params
+		}
+		name := strings.TrimSuffix(rest[start+1:start+end], "...")
+		rest = rest[start+end+1:]
+		// {$} only anchors the end of the path
+		if name != "$" {
+			params = append(params, [2]string{name, r.PathValue(name)})
+		}
+	}
+}
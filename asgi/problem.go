@@ -0,0 +1,71 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Content type for RFC 7807 problem details
+const problemContentType = "application/problem+json"
+
+// When set, the server's built-in error responses use problem+json bodies
+var problemJSONErrors atomic.Bool
+
+// problemDetails is the RFC 7807 problem details object
+type problemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// newProblemBody encodes a problem details body, filling in the RFC 7807
+// defaults for an empty type or title
+func newProblemBody(status int, problemType, title, detail string) []byte {
+	if problemType == "" {
+		problemType = "about:blank"
+	}
+	if title == "" {
+		title = http.StatusText(status)
+	}
+	body, _ := json.Marshal(problemDetails{
+		Type:   problemType,
+		Title:  title,
+		Status: status,
+		Detail: detail,
+	})
+	return body
+}
+
+// writeError writes one of the server's built-in error responses, either as
+// plain text or as problem+json depending on SetProblemJSONErrors
+func writeError(w http.ResponseWriter, status int, message string) {
+	if problemJSONErrors.Load() {
+		w.Header().Set("Content-Type", problemContentType)
+		w.WriteHeader(status)
+		w.Write(newProblemBody(status, "", "", message))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+//export WriteProblemResponse
+func WriteProblemResponse(requestId *C.char, status int, problemType, title, detail *C.char) *C.asgi_response {
+	body := newProblemBody(status, C.GoString(problemType), C.GoString(title), C.GoString(detail))
+	headers := [][2]string{{"Content-Type", problemContentType}}
+	return newAsgiResponse(C.GoString(requestId), status, headers, body)
+}
+
+//export SetProblemJSONErrors
+func SetProblemJSONErrors(enabled bool) *C.char {
+	problemJSONErrors.Store(enabled)
+	return C.CString(fmt.Sprintf("Problem JSON errors enabled: %t", enabled))
+}
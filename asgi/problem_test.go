@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestWriteErrorPlainText(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusServiceUnavailable, "Server is busy")
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "Server is busy" {
+		t.Errorf("got %d %q, want 503 %q", w.Code, w.Body.String(), "Server is busy")
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain; charset=utf-8", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+}
+
+func TestWriteErrorProblemJSON(t *testing.T) {
+	problemJSONErrors.Store(true)
+	defer problemJSONErrors.Store(false)
+
+	w := httptest.NewRecorder()
+	writeError(w, http.StatusGatewayTimeout, "Request processing timed out")
+	if got := w.Header().Get("Content-Type"); got != problemContentType {
+		t.Errorf("Content-Type = %q, want %q", got, problemContentType)
+	}
+	var problem problemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("body %q: %v", w.Body.String(), err)
+	}
+	want := problemDetails{Type: "about:blank", Title: "Gateway Timeout", Status: http.StatusGatewayTimeout, Detail: "Request processing timed out"}
+	if problem != want {
+		t.Errorf("got %+v, want %+v", problem, want)
+	}
+}
+
+func TestNewProblemBodyKeepsTypeAndTitle(t *testing.T) {
+	var problem problemDetails
+	body := newProblemBody(http.StatusConflict, "https://example.com/conflict", "Version conflict", "")
+	if err := json.Unmarshal(body, &problem); err != nil {
+		t.Fatalf("body %q: %v", body, err)
+	}
+	want := problemDetails{Type: "https://example.com/conflict", Title: "Version conflict", Status: http.StatusConflict}
+	if problem != want {
+		t.Errorf("got %+v, want %+v", problem, want)
+	}
+}
+
+func TestMuxErrorsUseProblemJSON(t *testing.T) {
+	err := marily.Handle("GET /problem/only-get", func(marily.Event) marily.Response {
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("GET /problem/only-get")
+
+	problemJSONErrors.Store(true)
+	defer problemJSONErrors.Store(false)
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, "/problem/only-get", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d, want 405", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != problemContentType {
+		t.Errorf("405 Content-Type = %q, want %q", got, problemContentType)
+	}
+	if got := w.Header().Get("Allow"); got == "" {
+		t.Error("405 has no Allow header")
+	}
+
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/problem/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got %d, want 404", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != problemContentType {
+		t.Errorf("404 Content-Type = %q, want %q", got, problemContentType)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//export EnableMetrics
+func EnableMetrics(path *C.char) *C.char {
+	pathStr := C.GoString(path)
+	if pathStr == "" {
+		pathStr = "/metrics"
+	}
+
+	// Like fast responses, the endpoint is served in Go without a request
+	// slot, so it can still be scraped while the server is saturated
+	rt := &route{handler: http.HandlerFunc(handleMetrics)}
+	if err := registerRoute(pathStr, rt); err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
+	return C.CString(fmt.Sprintf("Metrics endpoint registered for path: %s", pathStr))
+}
+
+// handleMetrics serves the server metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+
+	var total int64
+	for i := range statusClassCounts {
+		total += statusClassCounts[i].Load()
+	}
+	writeMetricHeader(&b, "marily_requests_total", "counter", "Requests handled by callbacks.")
+	fmt.Fprintf(&b, "marily_requests_total %d\n", total)
+
+	writeMetricHeader(&b, "marily_responses_total", "counter", "Responses by status class.")
+	for i := range statusClassCounts {
+		fmt.Fprintf(&b, "marily_responses_total{code=\"%dxx\"} %d\n", i+1, statusClassCounts[i].Load())
+	}
+
+	writeMetricHeader(&b, "marily_requests_in_flight", "gauge", "Requests being handled.")
+	fmt.Fprintf(&b, "marily_requests_in_flight %d\n", activeRequests.Load())
+	writeMetricHeader(&b, "marily_requests_waiting", "gauge", "Requests waiting for a request slot.")
+	fmt.Fprintf(&b, "marily_requests_waiting %d\n", waitingRequests.Load())
+	writeMetricHeader(&b, "marily_callbacks_executing", "gauge", "Callbacks running.")
+	fmt.Fprintf(&b, "marily_callbacks_executing %d\n", executingRequests.Load())
+
+	readUsage, writeUsage := ioSlotsUsage(&readSlots), ioSlotsUsage(&writeSlots)
+	writeMetricHeader(&b, "marily_io_slots_in_use", "gauge", "Slots held for reading request bodies and writing responses.")
+	fmt.Fprintf(&b, "marily_io_slots_in_use{kind=\"read\"} %d\n", readUsage.InUse)
+	fmt.Fprintf(&b, "marily_io_slots_in_use{kind=\"write\"} %d\n", writeUsage.InUse)
+	writeMetricHeader(&b, "marily_io_slots_capacity", "gauge", "Slots for reading request bodies and writing responses, 0 when unlimited.")
+	fmt.Fprintf(&b, "marily_io_slots_capacity{kind=\"read\"} %d\n", readUsage.Capacity)
+	fmt.Fprintf(&b, "marily_io_slots_capacity{kind=\"write\"} %d\n", writeUsage.Capacity)
+
+	writeHistogram(&b, "marily_request_duration_seconds", "Time from handler entry to the end of the response.",
+		requestDurationHistogram.snapshot())
+	writeHistogram(&b, "marily_time_to_first_byte_seconds", "Time from handler entry to the first byte of the response.",
+		ttfbHistogram.snapshot())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric
+func writeMetricHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeHistogram writes a histogram snapshot as a Prometheus histogram
+func writeHistogram(b *strings.Builder, name, help string, s histogramSnapshot) {
+	writeMetricHeader(b, name, "histogram", help)
+	for i, bound := range s.Bounds {
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), s.Buckets[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, s.Buckets[len(s.Buckets)-1])
+	fmt.Fprintf(b, "%s_sum %s\n", name, strconv.FormatFloat(s.Sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count %d\n", name, s.Count)
+}
@@ -0,0 +1,266 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Networks whose forwarding headers are trusted, nil when none are
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+//export SetTrustedProxies
+func SetTrustedProxies(cidrs *C.char) *C.char {
+	// cidrs is a comma-separated list of networks or single addresses
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(C.GoString(cidrs), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return C.CString(fmt.Sprintf("Invalid trusted proxy: %s", entry))
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	if len(prefixes) == 0 {
+		trustedProxies.Store(nil)
+		return C.CString("Trusted proxies cleared")
+	}
+	trustedProxies.Store(&prefixes)
+	return C.CString(fmt.Sprintf("%d trusted proxy networks set", len(prefixes)))
+}
+
+// isTrustedProxy reports whether the peer of the request is a trusted proxy
+func isTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return isTrustedAddr(addr)
+}
+
+// isTrustedAddr reports whether addr is in a trusted proxy network
+func isTrustedAddr(addr netip.Addr) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded parses an RFC 7239 Forwarded header into one map of
+// lowercased parameters per forwarding hop, nearest to the client first
+func parseForwarded(values []string) []map[string]string {
+	var hops []map[string]string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := make(map[string]string)
+			for _, pair := range strings.Split(element, ";") {
+				name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				hop[strings.ToLower(name)] = strings.Trim(val, `"`)
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// forwardedHost returns the original host reported by a trusted proxy, or
+// an empty string when there is none. The host is that of the hop found by
+// outermostHop; when that hop names none, the nearest one that does is used.
+func forwardedHost(r *http.Request) string {
+	if !isTrustedProxy(r) {
+		return ""
+	}
+	hops := forwardingHops(r)
+	start, _, _ := outermostHop(hops)
+	if start < 0 {
+		start = len(hops) - 1
+	}
+	for i := max(start, 0); i < len(hops); i++ {
+		if hops[i].host != "" {
+			return hops[i].host
+		}
+	}
+	return ""
+}
+
+// parseForwardedNode parses a node of a forwarding header, "192.0.2.1",
+// "192.0.2.1:4711" or "[2001:db8::1]:4711", into an address and port. The
+// port is "0" when the node has none.
+func parseForwardedNode(node string) (netip.Addr, string, bool) {
+	node = strings.TrimSpace(node)
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), strconv.Itoa(int(addrPort.Port())), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(node, "[]"))
+	if err != nil {
+		return netip.Addr{}, "", false
+	}
+	return addr.Unmap(), "0", true
+}
+
+// forwardingHop is one hop of a forwarding header: the node the proxy got
+// the request from and the host it was asked for, either possibly empty
+type forwardingHop struct {
+	node string
+	host string
+}
+
+// forwardingHops lists the hops reported by the Forwarded header, or else by
+// the X-Forwarded-For and X-Forwarded-Host headers, nearest to the client
+// first. Each proxy appends to both of the latter, so their entries are
+// paired up from the nearest proxy back.
+func forwardingHops(r *http.Request) []forwardingHop {
+	if forwarded := parseForwarded(r.Header.Values("Forwarded")); len(forwarded) > 0 {
+		hops := make([]forwardingHop, len(forwarded))
+		for i, hop := range forwarded {
+			hops[i] = forwardingHop{node: hop["for"], host: hop["host"]}
+		}
+		return hops
+	}
+
+	var nodes, hosts []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		nodes = append(nodes, strings.Split(value, ",")...)
+	}
+	for _, value := range r.Header.Values("X-Forwarded-Host") {
+		hosts = append(hosts, strings.Split(value, ",")...)
+	}
+	hops := make([]forwardingHop, max(len(nodes), len(hosts)))
+	for i, node := range nodes {
+		hops[len(hops)-len(nodes)+i].node = node
+	}
+	for i, host := range hosts {
+		hops[len(hops)-len(hosts)+i].host = strings.TrimSpace(host)
+	}
+	return hops
+}
+
+// outermostHop walks the hops from the nearest proxy outwards, and stops at
+// the first node that is not a trusted proxy itself: that is the client, and
+// anything further out could have been made up by it. It returns the index
+// and node of the hop it stopped at, with an index of -1 when the nearest
+// node is obfuscated, unknown or missing.
+func outermostHop(hops []forwardingHop) (int, netip.Addr, string) {
+	index, client, clientPort := -1, netip.Addr{}, ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, port, ok := parseForwardedNode(hops[i].node)
+		if !ok {
+			// Obfuscated or unknown nodes end the chain
+			break
+		}
+		index, client, clientPort = i, addr, port
+		if !isTrustedAddr(addr) {
+			break
+		}
+	}
+	return index, client, clientPort
+}
+
+// forwardedClient returns the address of the client as "host:port", from
+// the Forwarded or X-Forwarded-For header of a trusted proxy, or an empty
+// string when there is none
+func forwardedClient(r *http.Request) string {
+	index, addr, port := outermostHop(forwardingHops(r))
+	if index < 0 {
+		return ""
+	}
+	return net.JoinHostPort(addr.String(), port)
+}
+
+// forwardedProto returns the scheme the client used, from the Forwarded or
+// X-Forwarded-Proto header of a trusted proxy, or an empty string when there
+// is none
+func forwardedProto(r *http.Request) string {
+	proto := ""
+	if hops := parseForwarded(r.Header.Values("Forwarded")); len(hops) > 0 {
+		proto = hops[0]["proto"]
+	} else if value := r.Header.Get("X-Forwarded-Proto"); value != "" {
+		// The first entry is the scheme the client originally used
+		proto, _, _ = strings.Cut(value, ",")
+	}
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto != "http" && proto != "https" {
+		return ""
+	}
+	return proto
+}
+
+// forwardedProtoKey is the context key for the scheme forwarded by a
+// trusted proxy
+type forwardedProtoKey struct{}
+
+// viaTrustedProxyKey is the context key marking requests that came through
+// a trusted proxy, whose RemoteAddr applyForwardedHeaders may have rewritten
+type viaTrustedProxyKey struct{}
+
+// viaTrustedProxy reports whether the request came from a trusted proxy,
+// whether or not applyForwardedHeaders has rewritten it since
+func viaTrustedProxy(r *http.Request) bool {
+	if via, _ := r.Context().Value(viaTrustedProxyKey{}).(bool); via {
+		return true
+	}
+	return isTrustedProxy(r)
+}
+
+// applyForwardedHeaders rewrites the request with the values forwarded by a
+// trusted proxy, so routing and the event see the client's view of it: the
+// host, the client address in RemoteAddr and the scheme in the context
+func applyForwardedHeaders(r *http.Request) *http.Request {
+	// Everything is decided while the peer is still the proxy
+	if !isTrustedProxy(r) {
+		return r
+	}
+	// Rewrite a copy, the server still holds the request it read
+	r = r.WithContext(context.WithValue(r.Context(), viaTrustedProxyKey{}, true))
+	if host := forwardedHost(r); host != "" {
+		r.Host = host
+	}
+	if proto := forwardedProto(r); proto != "" {
+		r = r.WithContext(context.WithValue(r.Context(), forwardedProtoKey{}, proto))
+	}
+	if client := forwardedClient(r); client != "" {
+		r.RemoteAddr = client
+	}
+	return r
+}
+
+// requestScheme returns the scheme of the request, as the client used it
+func requestScheme(r *http.Request) string {
+	if proto, ok := r.Context().Value(forwardedProtoKey{}).(string); ok {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
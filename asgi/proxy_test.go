@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// trustProxies trusts the given networks until the test ends
+func trustProxies(t *testing.T, cidrs ...string) {
+	t.Helper()
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefixes = append(prefixes, netip.MustParsePrefix(cidr))
+	}
+	trustedProxies.Store(&prefixes)
+	t.Cleanup(func() { trustedProxies.Store(nil) })
+}
+
+func TestForwardedHostUntrustedPeer(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:4711"
+	r.Header.Set("X-Forwarded-Host", "evil.example")
+	if got := forwardedHost(r); got != "" {
+		t.Errorf("forwardedHost = %q from an untrusted peer, want none", got)
+	}
+}
+
+func TestForwardedHostNearestTrustedHop(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{
+			// The client prepended a host of its own, the proxy appended the real one
+			name: "spoofed x-forwarded-host",
+			headers: map[string]string{
+				"X-Forwarded-For":  "198.51.100.1, 203.0.113.7",
+				"X-Forwarded-Host": "evil.example, app.example",
+			},
+			want: "app.example",
+		},
+		{
+			// Two trusted proxies, the outer one saw the client's host
+			name: "chain of trusted proxies",
+			headers: map[string]string{
+				"X-Forwarded-For":  "203.0.113.7, 10.0.0.2",
+				"X-Forwarded-Host": "app.example, internal.example",
+			},
+			want: "app.example",
+		},
+		{
+			name: "host without x-forwarded-for",
+			headers: map[string]string{
+				"X-Forwarded-Host": "evil.example, app.example",
+			},
+			want: "app.example",
+		},
+		{
+			name: "forwarded header",
+			headers: map[string]string{
+				"Forwarded": "for=198.51.100.1;host=evil.example, for=203.0.113.7;host=app.example",
+			},
+			want: "app.example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "10.0.0.1:4711"
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := forwardedHost(r); got != tt.want {
+				t.Errorf("forwardedHost = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		forwardedFor string
+		want         string
+	}{
+		{"198.51.100.1, 203.0.113.7", "203.0.113.7:0"},
+		{"203.0.113.7, 10.0.0.2", "203.0.113.7:0"},
+		{"[2001:db8::1]:4711", "[2001:db8::1]:4711"},
+		{"unknown, 10.0.0.2", "10.0.0.2:0"},
+		{"unknown", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:4711"
+		r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		if got := forwardedClient(r); got != tt.want {
+			t.Errorf("forwardedClient(%q) = %q, want %q", tt.forwardedFor, got, tt.want)
+		}
+	}
+}
+
+func TestApplyForwardedHeadersCopiesRequest(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	r := httptest.NewRequest(http.MethodGet, "http://internal.example/", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("X-Forwarded-Host", "app.example")
+	r.Header.Set("X-Forwarded-Proto", "https")
+
+	rewritten := applyForwardedHeaders(r)
+	if rewritten.Host != "app.example" || rewritten.RemoteAddr != "203.0.113.7:0" || requestScheme(rewritten) != "https" {
+		t.Errorf("rewritten to %s %s %s", rewritten.Host, rewritten.RemoteAddr, requestScheme(rewritten))
+	}
+	if r.Host != "internal.example" || r.RemoteAddr != "10.0.0.1:4711" {
+		t.Errorf("original request changed to %s %s", r.Host, r.RemoteAddr)
+	}
+}
+
+func TestIncomingRequestIdAfterForwarding(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("X-Request-ID", "proxy-assigned-id")
+
+	// The ID is the proxy's even though RemoteAddr is now the client
+	r = applyForwardedHeaders(r)
+	if got := incomingRequestId(r); got != "proxy-assigned-id" {
+		t.Errorf("incomingRequestId = %q, want proxy-assigned-id", got)
+	}
+	requestContexts.Delete("proxy-assigned-id")
+
+	direct := httptest.NewRequest(http.MethodGet, "/", nil)
+	direct.RemoteAddr = "203.0.113.7:4711"
+	direct.Header.Set("X-Request-ID", "client-chosen-id")
+	if got := incomingRequestId(applyForwardedHeaders(direct)); got != "" {
+		t.Errorf("incomingRequestId = %q from a direct client, want none", got)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// When set, Range requests are served from complete callback response bodies
+var honorRangeOnCallbackResponses atomic.Bool
+
+var (
+	// The Range header is not a single byte range and is ignored
+	errRangeIgnored = errors.New("range ignored")
+	// The byte range lies outside the body
+	errRangeUnsatisfiable = errors.New("range not satisfiable")
+)
+
+//export SetHonorRangeOnCallbackResponses
+func SetHonorRangeOnCallbackResponses(enabled bool) *C.char {
+	honorRangeOnCallbackResponses.Store(enabled)
+	return C.CString(fmt.Sprintf("Range handling on callback responses enabled: %t", enabled))
+}
+
+// parseSingleRange parses a Range header holding a single byte range against
+// a body of the given size, returning the first and last byte offsets
+func parseSingleRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errRangeIgnored
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errRangeIgnored
+	}
+
+	// Suffix range: the last n bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errRangeIgnored
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeUnsatisfiable
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errRangeIgnored
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errRangeIgnored
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, errRangeUnsatisfiable
+	}
+	return start, end, nil
+}
+
+// applyRange narrows the body to the range requested by the client and
+// returns the status to respond with: 206 for a satisfiable range, 416 for
+// an unsatisfiable one, or 200 when the full body should be sent
+func applyRange(w http.ResponseWriter, r *http.Request, body *cBufferReader) int {
+	if r.Method != http.MethodGet {
+		return http.StatusOK
+	}
+	// Ranges over an encoded body would not match the client's view of it
+	if w.Header().Get("Content-Encoding") != "" {
+		return http.StatusOK
+	}
+
+	// Full responses advertise ranges too, so clients know to ask
+	w.Header().Set("Accept-Ranges", "bytes")
+	header := r.Header.Get("Range")
+	if header == "" {
+		return http.StatusOK
+	}
+
+	size := int64(len(body.data))
+
+	start, end, err := parseSingleRange(header, size)
+	switch err {
+	case errRangeIgnored:
+		return http.StatusOK
+	case errRangeUnsatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.Header().Del("Content-Length")
+		body.data = nil
+		return http.StatusRequestedRangeNotSatisfiable
+	}
+
+	body.data = body.data[start : end+1]
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	return http.StatusPartialContent
+}
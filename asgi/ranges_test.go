@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseSingleRange(t *testing.T) {
+	tests := []struct {
+		header      string
+		first, last int64
+		err         error
+	}{
+		{"bytes=0-3", 0, 3, nil},
+		{"bytes=4-", 4, 9, nil},
+		{"bytes=-3", 7, 9, nil},
+		{"bytes=-20", 0, 9, nil},
+		{"bytes=5-100", 5, 9, nil},
+		{"bytes=10-", 0, 0, errRangeUnsatisfiable},
+		{"bytes=-0", 0, 0, errRangeUnsatisfiable},
+		{"bytes=0-1,3-4", 0, 0, errRangeIgnored},
+		{"bytes=4-2", 0, 0, errRangeIgnored},
+		{"items=0-3", 0, 0, errRangeIgnored},
+		{"bytes=a-b", 0, 0, errRangeIgnored},
+	}
+	for _, tt := range tests {
+		first, last, err := parseSingleRange(tt.header, 10)
+		if first != tt.first || last != tt.last || err != tt.err {
+			t.Errorf("parseSingleRange(%q) = %d, %d, %v, want %d, %d, %v",
+				tt.header, first, last, err, tt.first, tt.last, tt.err)
+		}
+	}
+}
+
+func TestRangeOnCallbackResponse(t *testing.T) {
+	honorRangeOnCallbackResponses.Store(true)
+	defer honorRangeOnCallbackResponses.Store(false)
+	response := newAsgiResponse("range", http.StatusOK, nil, []byte("0123456789"))
+	defer freeAsgiResponse(response)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	writeResponseFromC(w, r, response)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Errorf("single range: got %d %q, want 206 %q", w.Code, w.Body.String(), "2345")
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q, want bytes 2-5/10", got)
+	}
+
+	r.Header.Set("Range", "bytes=20-")
+	w = httptest.NewRecorder()
+	writeResponseFromC(w, r, response)
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Body.Len() != 0 {
+		t.Errorf("unsatisfiable range: got %d %q, want an empty 416", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes */10" {
+		t.Errorf("Content-Range = %q, want bytes */10", got)
+	}
+
+	// Without a Range header the whole body is sent, advertising ranges
+	r.Header.Del("Range")
+	w = httptest.NewRecorder()
+	writeResponseFromC(w, r, response)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("no range: got %d %q with Accept-Ranges %q", w.Code, w.Body.String(), w.Header().Get("Accept-Ranges"))
+	}
+}
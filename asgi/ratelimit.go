@@ -0,0 +1,141 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Most clients tracked by the per-client limiter; the least recently seen
+// are forgotten first, which only ever gives them a full bucket back
+const maxRateLimitedClients = 10000
+
+// tokenBucket refills at rate tokens per second up to burst tokens
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token when one is available, else reports how long until
+// the next one is. The caller guards the bucket.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) (bool, time.Duration) {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimiter holds one token bucket per key, bounded by an LRU
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// Keys, most recently used first
+	lru *list.List
+}
+
+// rateLimitEntry is an element of the LRU
+type rateLimitEntry struct {
+	key    string
+	bucket tokenBucket
+}
+
+func newRateLimiter(requestsPerSecond, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(requestsPerSecond),
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// allow takes a token from the bucket of key
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	element, ok := l.buckets[key]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		// New keys start with a full bucket
+		element = l.lru.PushFront(&rateLimitEntry{key: key, bucket: tokenBucket{tokens: l.burst, last: now}})
+		l.buckets[key] = element
+		if l.lru.Len() > maxRateLimitedClients {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*rateLimitEntry).key)
+		}
+	}
+	return element.Value.(*rateLimitEntry).bucket.take(l.rate, l.burst, now)
+}
+
+var (
+	// Limits requests per client IP, nil when off
+	clientRateLimiter atomic.Pointer[rateLimiter]
+	// Limits the requests of all clients together, nil when off
+	globalRateLimiter atomic.Pointer[rateLimiter]
+)
+
+//export SetRateLimit
+func SetRateLimit(requestsPerSecond int, burst int) *C.char {
+	if requestsPerSecond <= 0 {
+		clientRateLimiter.Store(nil)
+		return C.CString("Per-client rate limit disabled")
+	}
+	limiter := newRateLimiter(requestsPerSecond, burst)
+	clientRateLimiter.Store(limiter)
+	return C.CString(fmt.Sprintf("Per-client rate limit set to %d requests/s (burst %d)", requestsPerSecond, int(limiter.burst)))
+}
+
+//export SetGlobalRateLimit
+func SetGlobalRateLimit(requestsPerSecond int, burst int) *C.char {
+	if requestsPerSecond <= 0 {
+		globalRateLimiter.Store(nil)
+		return C.CString("Global rate limit disabled")
+	}
+	limiter := newRateLimiter(requestsPerSecond, burst)
+	globalRateLimiter.Store(limiter)
+	return C.CString(fmt.Sprintf("Global rate limit set to %d requests/s (burst %d)", requestsPerSecond, int(limiter.burst)))
+}
+
+// checkRateLimit takes a token for the request from the global and the
+// per-client limiter, answering 429 with Retry-After and returning false
+// when either has none left. Clients are told apart by IP, which is the
+// forwarded one behind a trusted proxy.
+func checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if limiter := globalRateLimiter.Load(); limiter != nil {
+		if ok, wait := limiter.allow(""); !ok {
+			rejectRateLimited(w, wait)
+			return false
+		}
+	}
+	if limiter := clientRateLimiter.Load(); limiter != nil {
+		clientIP, _ := splitHostPort(r.RemoteAddr, "", "")
+		if ok, wait := limiter.allow(clientIP); !ok {
+			rejectRateLimited(w, wait)
+			return false
+		}
+	}
+	return true
+}
+
+// rejectRateLimited answers 429, telling the client when to retry
+func rejectRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, "Too many requests")
+}
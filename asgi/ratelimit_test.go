@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := tokenBucket{tokens: 2, last: start}
+
+	for i := range 2 {
+		if ok, _ := b.take(1, 2, start); !ok {
+			t.Fatalf("take %d of a full bucket failed", i)
+		}
+	}
+	ok, wait := b.take(1, 2, start)
+	if ok || wait != time.Second {
+		t.Errorf("empty bucket: got %v, wait %v, want refused with 1s", ok, wait)
+	}
+
+	// Half a token has refilled after 500ms
+	ok, wait = b.take(1, 2, start.Add(500*time.Millisecond))
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("after 500ms: got %v, wait %v, want refused with 500ms", ok, wait)
+	}
+	if ok, _ := b.take(1, 2, start.Add(time.Second)); !ok {
+		t.Error("after 1s the refilled token was not available")
+	}
+
+	// Refills stop at the burst
+	if ok, _ := b.take(1, 2, start.Add(time.Hour)); !ok {
+		t.Fatal("after an hour no token was available")
+	}
+	if b.tokens != 1 {
+		t.Errorf("bucket holds %v tokens after an hour and one take, want 1", b.tokens)
+	}
+}
+
+func TestRateLimiterEvictsOldestClient(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	l.allow("first")
+	for i := range maxRateLimitedClients {
+		l.allow(strconv.Itoa(i))
+	}
+	if l.lru.Len() != maxRateLimitedClients {
+		t.Errorf("tracking %d clients, want %d", l.lru.Len(), maxRateLimitedClients)
+	}
+	// Forgetting a client gives it a full bucket back
+	if ok, _ := l.allow("first"); !ok {
+		t.Error("evicted client was refused")
+	}
+	if ok, _ := l.allow(strconv.Itoa(maxRateLimitedClients - 1)); ok {
+		t.Error("recent client got a second token")
+	}
+}
+
+// rateLimitedRequest returns whether a request from client gets through
+// dispatch, checking the answer it gets when it does not
+func rateLimitedRequest(t *testing.T, client string) bool {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/limited", nil)
+	r.RemoteAddr = client
+	w := httptest.NewRecorder()
+	dispatch(w, r)
+	if w.Code == http.StatusOK {
+		return true
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("%s: got %d with Retry-After %q, want 429 with 60", client, w.Code, w.Header().Get("Retry-After"))
+	}
+	return false
+}
+
+func TestClientRateLimit(t *testing.T) {
+	handleBody(t, "/limited", "ok")
+	// A token a minute, so none refill during the test
+	limiter := newRateLimiter(1, 2)
+	limiter.rate = 1.0 / 60
+	clientRateLimiter.Store(limiter)
+	t.Cleanup(func() { clientRateLimiter.Store(nil) })
+
+	for i := range 2 {
+		if !rateLimitedRequest(t, "192.0.2.1:1000") {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	// Another port is the same client
+	if rateLimitedRequest(t, "192.0.2.1:2000") {
+		t.Error("request over the burst got through")
+	}
+	if !rateLimitedRequest(t, "192.0.2.2:1000") {
+		t.Error("another client was refused")
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	handleBody(t, "/limited", "ok")
+	limiter := newRateLimiter(1, 2)
+	limiter.rate = 1.0 / 60
+	globalRateLimiter.Store(limiter)
+	t.Cleanup(func() { globalRateLimiter.Store(nil) })
+
+	if !rateLimitedRequest(t, "192.0.2.1:1000") || !rateLimitedRequest(t, "192.0.2.2:1000") {
+		t.Fatal("request within the burst was refused")
+	}
+	if rateLimitedRequest(t, "192.0.2.3:1000") {
+		t.Error("request over the global burst got through")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the raw callback safely
+// static inline asgi_string* call_raw_callback(asgi_raw_callback_fn callback, asgi_string* request) {
+//     if (callback == NULL) return NULL;
+//     return callback(request);
+// }
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"runtime/debug"
+	"time"
+	"unsafe"
+)
+
+//export RegisterRawCallback
+func RegisterRawCallback(path *C.char, callback C.asgi_raw_callback_fn) *C.char {
+	pathStr := C.GoString(path)
+
+	rt := &route{managed: true}
+	rt.handler = handleRawRequestWithCallback(rt, callback)
+	if err := registerRoute(pathStr, rt); err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
+	return C.CString(fmt.Sprintf("Raw callback registered for path: %s", pathStr))
+}
+
+// handleRawRequestWithCallback passes the request on the wire format to the
+// callback and writes whatever bytes it returns straight to the connection.
+// The server only does transport here: no event is built and the connection
+// is closed after the response, since the framing is up to the callback.
+// The route checks and request limits are those of event callbacks.
+func handleRawRequestWithCallback(rt *route, callback C.asgi_raw_callback_fn) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+
+		// Observe the response for the latency metrics
+		recorder := newResponseRecorder(w, time.Now())
+		defer recorder.finish(r)
+		w = recorder
+
+		timeout, ok := admitRouteRequest(w, r, rt)
+		if !ok {
+			return
+		}
+
+		semaphore, stopping := rt.requestSlots()
+		if !acquireRequestSlot(w, semaphore, stopping, rt.slotWait()) {
+			return
+		}
+		defer releaseRequestSlot(semaphore)
+		recorder.requestId = requestIdOf(r)
+
+		if callback == nil {
+			writeError(w, http.StatusNotFound, "No handler registered for this path")
+			return
+		}
+
+		rawRequest, err := httputil.DumpRequest(r, true)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Could not read request")
+			return
+		}
+
+		// The raw response can only be written to a hijacked connection
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "Raw callbacks are not supported on this connection")
+			return
+		}
+
+		cRequest := (*C.asgi_string)(C.malloc(C.size_t(unsafe.Sizeof(C.asgi_string{}))))
+		cRequest.data = (*C.char)(C.CBytes(rawRequest))
+		cRequest.length = C.size_t(len(rawRequest))
+
+		// Call the callback in a goroutine to allow timeout
+		responseChan := make(chan []byte, 1)
+		go func() {
+			// A panic here would take the host process down with it
+			defer func() {
+				if p := recover(); p != nil {
+					fmt.Printf("Panic in raw callback for %s: %v\n%s", r.URL.Path, p, debug.Stack())
+					responseChan <- nil
+				}
+			}()
+			executingRequests.Add(1)
+			defer executingRequests.Add(-1)
+
+			result := C.call_raw_callback(callback, cRequest)
+			C.free(unsafe.Pointer(cRequest.data))
+			C.free(unsafe.Pointer(cRequest))
+
+			if result == nil {
+				responseChan <- nil
+				return
+			}
+			var rawResponse []byte
+			if result.data != nil {
+				rawResponse = C.GoBytes(unsafe.Pointer(result.data), C.int(result.length))
+				C.free(unsafe.Pointer(result.data))
+			}
+			C.free(unsafe.Pointer(result))
+			responseChan <- rawResponse
+		}()
+
+		var rawResponse []byte
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case rawResponse = <-responseChan:
+			// Callback completed
+		case <-timer.C:
+			// The callback's response is freed by its goroutine whenever it comes
+			writeError(w, http.StatusGatewayTimeout, "Request processing timed out")
+			return
+		}
+
+		if rawResponse == nil {
+			writeError(w, http.StatusInternalServerError, "No response from raw handler")
+			return
+		}
+
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Could not take over the connection")
+			return
+		}
+		defer conn.Close()
+
+		clearDeadlines(conn)
+		buf.Write(rawResponse)
+		buf.Flush()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the request ID generator safely
+// static inline char* call_request_id_generator(asgi_request_id_fn generator, const char* method, const char* path, const char* client) {
+//     if (generator == NULL) return NULL;
+//     return generator(method, path, client);
+// }
+import "C"
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// How generateRequestId builds request IDs
+const (
+	// Wall-clock nanoseconds and a sequence number
+	requestIdSequential int32 = iota
+	// Random RFC 4122 version 4 UUIDs
+	requestIdUUID
+)
+
+// Longest X-Request-ID taken over from a client
+const maxIncomingRequestIdLength = 128
+
+var (
+	requestIdGeneratorMu sync.RWMutex
+	// Produces request IDs instead of generateRequestId when set
+	requestIdGenerator C.asgi_request_id_fn
+
+	requestIdStrategy atomic.Int32
+
+	requestIdStrategies = map[string]int32{
+		"sequential": requestIdSequential,
+		"uuid":       requestIdUUID,
+	}
+)
+
+//export SetRequestIdStrategy
+func SetRequestIdStrategy(strategy *C.char) *C.char {
+	name := C.GoString(strategy)
+	value, ok := requestIdStrategies[name]
+	if !ok {
+		return C.CString(fmt.Sprintf("Unknown request ID strategy: %s (expected sequential or uuid)", name))
+	}
+	requestIdStrategy.Store(value)
+	return C.CString(fmt.Sprintf("Request ID strategy set to %s", name))
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// incomingRequestId returns the X-Request-ID a trusted proxy assigned to
+// the request, or "" when there is none usable. IDs key per-request state,
+// so one that is malformed or already in use is not taken over; a usable ID
+// is reserved in requestContexts until the request's tracking ends.
+func incomingRequestId(r *http.Request) string {
+	if !viaTrustedProxy(r) {
+		return ""
+	}
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > maxIncomingRequestIdLength {
+		return ""
+	}
+	for i := 0; i < len(id); i++ {
+		// Visible ASCII only
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return ""
+		}
+	}
+	// Reserved in one step, so concurrent requests cannot both take it
+	if _, inUse := requestContexts.LoadOrStore(id, r.Context()); inUse {
+		return ""
+	}
+	return id
+}
+
+//export RegisterRequestIDGenerator
+func RegisterRequestIDGenerator(generator C.asgi_request_id_fn) *C.char {
+	requestIdGeneratorMu.Lock()
+	requestIdGenerator = generator
+	requestIdGeneratorMu.Unlock()
+
+	if generator == nil {
+		return C.CString("Request ID generator cleared")
+	}
+	return C.CString("Request ID generator registered")
+}
+
+// requestIdKey is the context key for the ID of a request
+type requestIdKey struct{}
+
+// withRequestId assigns the request its ID and echoes it in the X-Request-ID
+// response header. The request's context is tracked under the ID until the
+// returned function is called.
+func withRequestId(w http.ResponseWriter, r *http.Request) (*http.Request, func()) {
+	requestId := newRequestId(r)
+	w.Header().Set("X-Request-ID", requestId)
+	r = r.WithContext(context.WithValue(r.Context(), requestIdKey{}, requestId))
+	return r, trackRequestContext(requestId, r.Context())
+}
+
+// requestIdOf returns the ID withRequestId assigned to the request, or a new
+// one for a request that did not come through dispatch
+func requestIdOf(r *http.Request) string {
+	if requestId, ok := r.Context().Value(requestIdKey{}).(string); ok {
+		return requestId
+	}
+	return generateRequestId()
+}
+
+// newRequestId returns the ID of a request: the X-Request-ID it arrived
+// with from a trusted proxy, else one from the registered generator when it
+// produces one, else one from generateRequestId. It is called once per
+// request, by withRequestId.
+func newRequestId(r *http.Request) string {
+	if id := incomingRequestId(r); id != "" {
+		return id
+	}
+
+	requestIdGeneratorMu.RLock()
+	generator := requestIdGenerator
+	requestIdGeneratorMu.RUnlock()
+
+	if generator == nil {
+		return generateRequestId()
+	}
+
+	method := C.CString(r.Method)
+	path := C.CString(r.URL.Path)
+	client := C.CString(r.RemoteAddr)
+	defer C.free(unsafe.Pointer(method))
+	defer C.free(unsafe.Pointer(path))
+	defer C.free(unsafe.Pointer(client))
+
+	result := C.call_request_id_generator(generator, method, path, client)
+	if result == nil {
+		return generateRequestId()
+	}
+	id := C.GoString(result)
+	C.free(unsafe.Pointer(result))
+	if id == "" {
+		return generateRequestId()
+	}
+	return id
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+// useRequestIdGenerator registers a C request ID generator until the test ends
+func useRequestIdGenerator(t *testing.T, generator *[0]byte) {
+	FreeCString(RegisterRequestIDGenerator(generator))
+	t.Cleanup(func() { FreeCString(RegisterRequestIDGenerator(nil)) })
+}
+
+func TestCustomRequestIdGenerator(t *testing.T) {
+	useRequestIdGenerator(t, cfixtures.FixedRequestId())
+	ids := make(chan string, 1)
+	err := marily.Handle("/request-id", func(ev marily.Event) marily.Response {
+		ids <- ev.RequestID
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/request-id")
+
+	calls := cfixtures.FixedRequestIdCalls()
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/request-id", nil))
+	if n := cfixtures.FixedRequestIdCalls() - calls; n != 1 {
+		t.Errorf("generator called %d times for one request, want once", n)
+	}
+	if got := <-ids; got != "fixture-id" {
+		t.Errorf("event request ID %q, want fixture-id", got)
+	}
+	if got := w.Header().Get("X-Request-ID"); got != "fixture-id" {
+		t.Errorf("X-Request-ID = %q, want fixture-id", got)
+	}
+
+	// Callback routes take the generated ID too, also generated once
+	handleCallback(t, "/request-id/c", cfixtures.EchoPathCallback())
+	calls = cfixtures.FixedRequestIdCalls()
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/request-id/c", nil))
+	if n := cfixtures.FixedRequestIdCalls() - calls; n != 1 {
+		t.Errorf("generator called %d times for one callback request, want once", n)
+	}
+	if got := w.Header().Get("X-Request-ID"); got != "fixture-id" {
+		t.Errorf("callback route X-Request-ID = %q, want fixture-id", got)
+	}
+
+	// An ID assigned by a trusted proxy takes precedence
+	trustProxies(t, "10.0.0.0/8")
+	r := httptest.NewRequest(http.MethodGet, "/request-id", nil)
+	r.RemoteAddr = "10.0.0.1:4711"
+	r.Header.Set("X-Request-ID", "proxy-assigned-id")
+	dispatch(httptest.NewRecorder(), r)
+	if got := <-ids; got != "proxy-assigned-id" {
+		t.Errorf("event request ID %q, want proxy-assigned-id", got)
+	}
+}
+
+func TestRequestIdStrategies(t *testing.T) {
+	defer requestIdStrategy.Store(requestIdSequential)
+
+	first, second := generateRequestId(), generateRequestId()
+	if first == "" || first == second {
+		t.Errorf("sequential IDs %q and %q are not unique", first, second)
+	}
+
+	requestIdStrategy.Store(requestIdUUID)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if id := generateRequestId(); !uuid.MatchString(id) {
+		t.Errorf("%q is not a version 4 UUID", id)
+	}
+}
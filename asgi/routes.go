@@ -0,0 +1,603 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// route is a registered pattern's handler together with its per-route state
+type route struct {
+	// Serves the requests matched by the route
+	handler http.Handler
+	// The event callback behind handler, nil for raw and fast routes
+	callback C.asgi_callback_fn
+	// Paused routes answer 503 without invoking the callback
+	paused atomic.Bool
+	// Link header values sent as preload hints with every response
+	preloadLinks atomic.Pointer[[]string]
+	// Cache-Control applied to responses that do not set their own
+	cacheControl string
+	// Callback timeout for the route, 0 for the global default
+	timeout time.Duration
+	// How long requests wait for a request slot, nil for the global default
+	queueTimeout atomic.Pointer[time.Duration]
+	// The additional server the route belongs to, nil for the default server
+	instance *serverInstance
+	// The handler runs the route checks and takes request slots, so pausing
+	// and queue timeouts apply; false for fast and metrics routes
+	managed bool
+}
+
+func init() {
+	globalMux.Store(http.NewServeMux())
+}
+
+// Route serving requests no pattern matches, nil for the plain 404
+var notFoundRoute atomic.Pointer[route]
+
+//export RegisterNotFoundCallback
+func RegisterNotFoundCallback(callback C.asgi_callback_fn) *C.char {
+	if callback == nil {
+		notFoundRoute.Store(nil)
+		return C.CString("Not found callback cleared")
+	}
+	notFoundRoute.Store(newEventRoute(callback))
+	return C.CString("Not found callback registered")
+}
+
+// prefixRoute serves every path under prefix that no more specific route
+// claims
+type prefixRoute struct {
+	prefix string
+	route  *route
+}
+
+// Prefix routes, longest first so the most specific prefix wins. Updated
+// under callbacksMu.
+var prefixRoutes atomic.Pointer[[]prefixRoute]
+
+// RegisterEventCallbackPrefix routes every path under prefix to callback.
+// A prefix without a trailing slash matches whole segments, so /app covers
+// /app and /app/x but not /apple. Of several matching prefixes the longest
+// wins, and a route registered for the path itself always wins over any
+// prefix. A NULL callback removes the prefix.
+//
+//export RegisterEventCallbackPrefix
+func RegisterEventCallbackPrefix(prefix *C.char, callback C.asgi_callback_fn) *C.char {
+	prefixStr := C.GoString(prefix)
+	if !strings.HasPrefix(prefixStr, "/") {
+		return C.CString(fmt.Sprintf("Path prefix must start with /: %s", prefixStr))
+	}
+
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+
+	var routes []prefixRoute
+	if current := prefixRoutes.Load(); current != nil {
+		routes = slices.DeleteFunc(slices.Clone(*current), func(p prefixRoute) bool {
+			return p.prefix == prefixStr
+		})
+	}
+
+	if callback == nil {
+		prefixRoutes.Store(&routes)
+		return C.CString(fmt.Sprintf("Prefix callback removed for: %s", prefixStr))
+	}
+
+	routes = append(routes, prefixRoute{prefix: prefixStr, route: newEventRoute(callback)})
+	slices.SortFunc(routes, func(a, b prefixRoute) int { return len(b.prefix) - len(a.prefix) })
+	prefixRoutes.Store(&routes)
+	fmt.Print("Event callback registered for prefix: ", prefixStr, "\n")
+	return C.CString(fmt.Sprintf("Event callback registered for prefix: %s", prefixStr))
+}
+
+// matchPrefixRoute returns the route of the longest prefix covering path
+func matchPrefixRoute(routes *[]prefixRoute, path string) *route {
+	if routes == nil {
+		return nil
+	}
+	for _, p := range *routes {
+		if underPrefix(path, p.prefix) {
+			return p.route
+		}
+	}
+	return nil
+}
+
+// patternPath returns the path of a ServeMux pattern, dropping the method
+// and host of patterns like "GET example.com/app/"
+func patternPath(pattern string) string {
+	path := pattern[strings.LastIndex(pattern, " ")+1:]
+	if i := strings.Index(path, "/"); i > 0 {
+		path = path[i:]
+	}
+	return path
+}
+
+// isSubtreeMatch reports whether pattern matched the request only as a
+// ServeMux subtree, a pattern ending in a slash that covers deeper paths
+func isSubtreeMatch(pattern string, r *http.Request) bool {
+	path := patternPath(pattern)
+	return strings.HasSuffix(path, "/") && path != r.URL.Path
+}
+
+// isCatchAll reports whether pattern is the "/" subtree covering every path,
+// the root path included. Use "/{$}" for a callback on the root alone.
+func isCatchAll(pattern string) bool {
+	return patternPath(pattern) == "/"
+}
+
+// serveRoute serves the request with the route matching it in mux, in the
+// order documented on dispatch. Requests no route matches go to the not
+// found callback when one is registered, while the 405 and redirect
+// responses of ServeMux are kept. Prefix routes and static mounts belong to
+// the default server only.
+func serveRoute(w http.ResponseWriter, r *http.Request, mux *http.ServeMux, defaultServer bool) {
+	notFound := notFoundRoute.Load()
+	var prefixes *[]prefixRoute
+	var mounts *[]staticMount
+	if defaultServer {
+		prefixes = prefixRoutes.Load()
+		mounts = staticMounts.Load()
+	}
+
+	// Matched requests go through ServeHTTP, which also sets the pattern and
+	// path values on the request
+	handler, pattern := mux.Handler(r)
+	if notFound == nil && (prefixes == nil || len(*prefixes) == 0) && (mounts == nil || len(*mounts) == 0) {
+		serveMuxHandler(w, r, mux, handler, pattern)
+		return
+	}
+	if pattern != "" && !isSubtreeMatch(pattern, r) && !isCatchAll(pattern) {
+		mux.ServeHTTP(w, r)
+		return
+	}
+	if rt := matchPrefixRoute(prefixes, r.URL.Path); rt != nil {
+		rt.handler.ServeHTTP(w, r)
+		return
+	}
+	if pattern != "" && !isCatchAll(pattern) {
+		mux.ServeHTTP(w, r)
+		return
+	}
+	if serveStatic(w, r, mounts) {
+		return
+	}
+	// The "/" catch-all is the default callback when there is one
+	if pattern != "" || notFound == nil {
+		serveMuxHandler(w, r, mux, handler, pattern)
+		return
+	}
+
+	// Without a pattern the handler is one of ServeMux's built-in responses,
+	// cheap to run ahead to find out which
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code == http.StatusNotFound {
+		notFound.handler.ServeHTTP(w, r)
+		return
+	}
+	writeMuxResponse(w, recorder)
+}
+
+// serveMuxHandler serves the request with the handler mux.Handler returned
+// for it. Without a pattern that is one of ServeMux's built-in responses,
+// whose errors are sent like the server's own.
+func serveMuxHandler(w http.ResponseWriter, r *http.Request, mux *http.ServeMux, handler http.Handler, pattern string) {
+	if pattern != "" {
+		mux.ServeHTTP(w, r)
+		return
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	writeMuxResponse(w, recorder)
+}
+
+// writeMuxResponse copies a recorded ServeMux response, sending its 404 and
+// 405 through writeError so they follow the error format in use
+func writeMuxResponse(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	switch recorder.Code {
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		if allow := recorder.Header().Get("Allow"); allow != "" {
+			w.Header().Set("Allow", allow)
+		}
+		writeError(w, recorder.Code, http.StatusText(recorder.Code))
+		return
+	}
+	maps.Copy(w.Header(), recorder.Header())
+	w.WriteHeader(recorder.Code)
+	w.Write(recorder.Body.Bytes())
+}
+
+// newEventRoute creates a route dispatching events to the callback
+func newEventRoute(callback C.asgi_callback_fn) *route {
+	rt := &route{callback: callback, managed: true}
+	rt.handler = handleRequestWithCallback(rt)
+	return rt
+}
+
+// slotWait returns how long requests of the route wait for a request slot
+func (rt *route) slotWait() time.Duration {
+	if wait := rt.queueTimeout.Load(); wait != nil {
+		return *wait
+	}
+	return time.Duration(queueTimeout.Load())
+}
+
+//export SetRouteQueueTimeout
+func SetRouteQueueTimeout(path *C.char, timeoutMilliseconds int) *C.char {
+	pathStr := C.GoString(path)
+	rt, ok := lookupRoute(pathStr)
+	if !ok {
+		return C.CString(fmt.Sprintf("No route registered for path: %s", pathStr))
+	}
+	if !rt.managed {
+		return C.CString(fmt.Sprintf("Route takes no request slots, queue timeout not supported: %s", pathStr))
+	}
+
+	// A negative timeout reverts to the global one
+	if timeoutMilliseconds < 0 {
+		rt.queueTimeout.Store(nil)
+		return C.CString(fmt.Sprintf("Queue timeout reset for path: %s", pathStr))
+	}
+	wait := time.Duration(timeoutMilliseconds) * time.Millisecond
+	rt.queueTimeout.Store(&wait)
+	return C.CString(fmt.Sprintf("Queue timeout set to %v for path: %s", wait, pathStr))
+}
+
+// requestSlots returns the semaphore limiting the route's requests and the
+// channel closed when its server begins shutting down
+func (rt *route) requestSlots() (chan struct{}, <-chan struct{}) {
+	if rt.instance != nil {
+		return rt.instance.semaphore, rt.instance.stopping
+	}
+	return requestSemaphore, *serverStopping.Load()
+}
+
+// buildMux creates a ServeMux serving the given routes. ServeMux panics on
+// invalid or conflicting patterns, which is reported as an error instead.
+func buildMux(routes map[string]*route) (mux *http.ServeMux, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	mux = http.NewServeMux()
+	for pattern, rt := range routes {
+		mux.Handle(pattern, rt.handler)
+	}
+	return mux, nil
+}
+
+// swapRoutes makes routes the active route table. Requests load globalMux
+// once, so each one sees either the complete old or the complete new table.
+// The caller holds callbacksMu.
+func swapRoutes(routes map[string]*route) error {
+	mux, err := buildMux(routes)
+	if err != nil {
+		return err
+	}
+	callbacks = routes
+	globalMux.Store(mux)
+	return nil
+}
+
+// registerRoute adds or replaces the route for pattern
+func registerRoute(pattern string, rt *route) error {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+
+	routes := maps.Clone(callbacks)
+	routes[pattern] = rt
+	return swapRoutes(routes)
+}
+
+// unregisterRoute removes the route for pattern, reporting whether there was one
+func unregisterRoute(pattern string) (bool, error) {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+
+	if _, ok := callbacks[pattern]; !ok {
+		return false, nil
+	}
+	routes := maps.Clone(callbacks)
+	delete(routes, pattern)
+	return true, swapRoutes(routes)
+}
+
+//export UnregisterEventCallback
+func UnregisterEventCallback(path *C.char) *C.char {
+	pathStr := C.GoString(path)
+	found, err := unregisterRoute(pathStr)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error unregistering path %s: %v", pathStr, err))
+	}
+	if !found {
+		return C.CString(fmt.Sprintf("No route registered for path: %s", pathStr))
+	}
+	fmt.Print("Event callback unregistered for path: ", pathStr, "\n")
+	return C.CString(fmt.Sprintf("Event callback unregistered for path: %s", pathStr))
+}
+
+// routeTableChanges summarizes a route table replacement
+type routeTableChanges struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Replaced []string `json:"replaced"`
+}
+
+// ReplaceRouteTable swaps the event callbacks registered by path for the
+// given table in one step, returning the changes as JSON. Routes of other
+// kinds, fast, raw, metrics, Go and method-specific routes, are kept unless
+// the table names their pattern. A path keeping its callback route keeps its
+// per-route settings: paused, cache control, timeouts and preload links. A
+// path listed twice is an error.
+//
+//export ReplaceRouteTable
+func ReplaceRouteTable(paths **C.char, callbackFns *C.asgi_callback_fn, count int) *C.char {
+	if count < 0 || (count > 0 && (paths == nil || callbackFns == nil)) {
+		return C.CString("Invalid route table")
+	}
+
+	table := make(map[string]*route, count)
+	if count > 0 {
+		pathSlice := unsafe.Slice(paths, count)
+		callbackSlice := unsafe.Slice(callbackFns, count)
+		for i := range count {
+			pattern := C.GoString(pathSlice[i])
+			if _, ok := table[pattern]; ok {
+				return C.CString(fmt.Sprintf("Duplicate path in route table: %s", pattern))
+			}
+			table[pattern] = newEventRoute(callbackSlice[i])
+		}
+	}
+
+	changes, err := replaceRouteTable(table)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error replacing route table: %v", err))
+	}
+	result, _ := json.Marshal(changes)
+	return C.CString(string(result))
+}
+
+// replaceRouteTable makes table the set of event callback routes, keeping
+// the routes of other kinds, and reports the changes
+func replaceRouteTable(table map[string]*route) (routeTableChanges, error) {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+
+	changes := routeTableChanges{Added: []string{}, Removed: []string{}, Replaced: []string{}}
+	routes := make(map[string]*route, len(table))
+	for pattern, rt := range table {
+		if old, ok := callbacks[pattern]; ok {
+			changes.Replaced = append(changes.Replaced, pattern)
+			if old.callback != nil {
+				rt.inheritSettings(old)
+			}
+		} else {
+			changes.Added = append(changes.Added, pattern)
+		}
+		routes[pattern] = rt
+	}
+	for pattern, rt := range callbacks {
+		if _, ok := routes[pattern]; ok {
+			continue
+		}
+		if rt.callback == nil || strings.Contains(pattern, " ") {
+			routes[pattern] = rt
+		} else {
+			changes.Removed = append(changes.Removed, pattern)
+		}
+	}
+
+	if err := swapRoutes(routes); err != nil {
+		return changes, err
+	}
+
+	slices.Sort(changes.Added)
+	slices.Sort(changes.Removed)
+	slices.Sort(changes.Replaced)
+	return changes, nil
+}
+
+// inheritSettings copies the per-route settings of the route rt replaces
+func (rt *route) inheritSettings(old *route) {
+	rt.paused.Store(old.paused.Load())
+	rt.preloadLinks.Store(old.preloadLinks.Load())
+	rt.cacheControl = old.cacheControl
+	rt.timeout = old.timeout
+	rt.queueTimeout.Store(old.queueTimeout.Load())
+}
+
+// routeInfo describes a registered route for ListRegisteredRoutes
+type routeInfo struct {
+	// The key the route was registered under
+	Pattern string `json:"pattern"`
+	Method  string `json:"method,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Path    string `json:"path"`
+	// How the path matches: "exact", "pattern" with {param} segments,
+	// "subtree", "prefix" or "static"
+	Match string `json:"match"`
+	// The directory served by a static mount
+	Dir    string `json:"dir,omitempty"`
+	Paused bool   `json:"paused"`
+}
+
+// describeRoute splits a ServeMux pattern like "GET example.com/a/{id}"
+// into its parts
+func describeRoute(pattern string, rt *route) routeInfo {
+	info := routeInfo{Pattern: pattern, Paused: rt.paused.Load()}
+	rest := pattern
+	if method, path, ok := strings.Cut(pattern, " "); ok {
+		info.Method, rest = method, path
+	}
+	if i := strings.Index(rest, "/"); i > 0 {
+		info.Host, rest = rest[:i], rest[i:]
+	}
+	info.Path = rest
+
+	switch {
+	case strings.Contains(rest, "{"):
+		info.Match = "pattern"
+	case strings.HasSuffix(rest, "/"):
+		info.Match = "subtree"
+	default:
+		info.Match = "exact"
+	}
+	return info
+}
+
+// ListRegisteredRoutes returns the routes of the default server as a JSON
+// array sorted by pattern, followed by the prefix routes and static mounts
+//
+//export ListRegisteredRoutes
+func ListRegisteredRoutes() *C.char {
+	callbacksMu.RLock()
+	routes := make([]routeInfo, 0, len(callbacks))
+	for pattern, rt := range callbacks {
+		routes = append(routes, describeRoute(pattern, rt))
+	}
+	slices.SortFunc(routes, func(a, b routeInfo) int { return strings.Compare(a.Pattern, b.Pattern) })
+	if prefixes := prefixRoutes.Load(); prefixes != nil {
+		for _, p := range *prefixes {
+			routes = append(routes, routeInfo{Pattern: p.prefix, Path: p.prefix, Match: "prefix", Paused: p.route.paused.Load()})
+		}
+	}
+	callbacksMu.RUnlock()
+
+	if mounts := staticMounts.Load(); mounts != nil {
+		for _, m := range *mounts {
+			routes = append(routes, routeInfo{Pattern: m.prefix, Path: m.prefix, Match: "static", Dir: m.dir})
+		}
+	}
+
+	result, _ := json.Marshal(routes)
+	return C.CString(string(result))
+}
+
+// lookupRoute returns the route registered for path, if any
+func lookupRoute(path string) (*route, bool) {
+	callbacksMu.RLock()
+	defer callbacksMu.RUnlock()
+	if rt, ok := callbacks[path]; ok {
+		return rt, true
+	}
+
+	// Prefix routes are found by their prefix
+	if routes := prefixRoutes.Load(); routes != nil {
+		for _, p := range *routes {
+			if p.prefix == path {
+				return p.route, true
+			}
+		}
+	}
+	return nil, false
+}
+
+//export PauseRoute
+func PauseRoute(path *C.char) *C.char {
+	pathStr := C.GoString(path)
+	rt, ok := lookupRoute(pathStr)
+	if !ok {
+		return C.CString(fmt.Sprintf("No route registered for path: %s", pathStr))
+	}
+	if !rt.managed {
+		return C.CString(fmt.Sprintf("Route cannot be paused: %s", pathStr))
+	}
+	rt.paused.Store(true)
+	return C.CString(fmt.Sprintf("Route paused: %s", pathStr))
+}
+
+//export ResumeRoute
+func ResumeRoute(path *C.char) *C.char {
+	pathStr := C.GoString(path)
+	rt, ok := lookupRoute(pathStr)
+	if !ok {
+		return C.CString(fmt.Sprintf("No route registered for path: %s", pathStr))
+	}
+	if !rt.managed {
+		return C.CString(fmt.Sprintf("Route cannot be paused: %s", pathStr))
+	}
+	rt.paused.Store(false)
+	return C.CString(fmt.Sprintf("Route resumed: %s", pathStr))
+}
+
+//export SetRoutePreloadLinks
+func SetRoutePreloadLinks(path *C.char, linksJson *C.char) *C.char {
+	pathStr := C.GoString(path)
+	rt, ok := lookupRoute(pathStr)
+	if !ok {
+		return C.CString(fmt.Sprintf("No route registered for path: %s", pathStr))
+	}
+	// Only event callbacks send the early hints
+	if rt.callback == nil {
+		return C.CString(fmt.Sprintf("Preload links are only sent by event callback routes: %s", pathStr))
+	}
+
+	// linksJson is an array of Link header values, e.g. ["</app.css>; rel=preload; as=style"]
+	var links []string
+	if err := json.Unmarshal([]byte(C.GoString(linksJson)), &links); err != nil {
+		return C.CString(fmt.Sprintf("Invalid preload links: %v", err))
+	}
+	if len(links) == 0 {
+		rt.preloadLinks.Store(nil)
+		return C.CString(fmt.Sprintf("Preload links cleared for path: %s", pathStr))
+	}
+	rt.preloadLinks.Store(&links)
+	return C.CString(fmt.Sprintf("%d preload links set for path: %s", len(links), pathStr))
+}
+
+// applyCachePolicy adds the route's Cache-Control header, and an Expires
+// header matching its max-age, unless the callback set them itself
+func applyCachePolicy(w http.ResponseWriter, rt *route, response *C.asgi_response) {
+	if rt.cacheControl == "" || responseHeader(response, "Cache-Control") != "" {
+		return
+	}
+	w.Header().Set("Cache-Control", rt.cacheControl)
+
+	if responseHeader(response, "Expires") != "" {
+		return
+	}
+	for directive := range strings.SplitSeq(rt.cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			expires := time.Now().Add(time.Duration(seconds) * time.Second)
+			w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+		}
+		break
+	}
+}
+
+// sendPreloadLinks adds the route's preload Link headers to the response and
+// sends them ahead of time as 103 Early Hints, so the browser can start
+// fetching the assets while the callback is still running
+func sendPreloadLinks(w http.ResponseWriter, r *http.Request, rt *route) {
+	links := rt.preloadLinks.Load()
+	if links == nil {
+		return
+	}
+	for _, link := range *links {
+		w.Header().Add("Link", link)
+	}
+	// Informational responses are not understood by HTTP/1.0 clients
+	if r.ProtoAtLeast(1, 1) {
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+}
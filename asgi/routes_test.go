@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestPausedRouteLeavesSiblingsServing(t *testing.T) {
+	handleBody(t, "/pause/a", "a")
+	handleBody(t, "/pause/b", "b")
+
+	rt, ok := lookupRoute("/pause/a")
+	if !ok {
+		t.Fatal("route not found")
+	}
+	rt.paused.Store(true)
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/pause/a", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("paused route answered %d, want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != strconv.Itoa(pausedRouteRetryAfter) {
+		t.Errorf("Retry-After = %q, want %d", got, pausedRouteRetryAfter)
+	}
+
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/pause/b", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("sibling route answered %d, want 200", w.Code)
+	}
+
+	rt.paused.Store(false)
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/pause/a", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("resumed route answered %d, want 200", w.Code)
+	}
+}
+
+// handleBody registers a Go handler answering with body at path until the
+// test ends
+func handleBody(t *testing.T, path, body string) {
+	t.Helper()
+	err := marily.Handle(path, func(marily.Event) marily.Response {
+		return marily.Response{Body: []byte(body)}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	t.Cleanup(func() { unregisterRoute(path) })
+}
+
+// handlePrefix adds a prefix route answering with body until the test ends
+func handlePrefix(t *testing.T, prefix, body string) {
+	t.Helper()
+	rt := &route{managed: true}
+	rt.handler = handleGoRequest(rt, func(marily.Event) marily.Response {
+		return marily.Response{Body: []byte(body)}
+	})
+	previous := prefixRoutes.Load()
+	routes := []prefixRoute{{prefix: prefix, route: rt}}
+	if previous != nil {
+		routes = append(routes, *previous...)
+	}
+	slices.SortFunc(routes, func(a, b prefixRoute) int { return len(b.prefix) - len(a.prefix) })
+	prefixRoutes.Store(&routes)
+	t.Cleanup(func() { prefixRoutes.Store(previous) })
+}
+
+func TestRoutePrecedence(t *testing.T) {
+	handleBody(t, "/tiers/exact", "exact")
+	handleBody(t, "/tiers/items/{id}", "pattern")
+	handleBody(t, "/tiers/prefix/exact", "exact")
+	handlePrefix(t, "/tiers/prefix", "prefix")
+	handleBody(t, "/tiers/tree/", "subtree")
+	handlePrefix(t, "/tiers/both", "prefix")
+	handleBody(t, "/tiers/both/", "subtree")
+	mountDir(t, "/tiers/static/", "a.txt", "static")
+	t.Cleanup(func() { updateStaticMounts("/tiers/static/", nil) })
+	handleBody(t, "/tiers/static/routed.txt", "exact")
+	handleBody(t, "/", "default")
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/tiers/exact", "exact"},
+		{"/tiers/items/1", "pattern"},
+		{"/tiers/prefix/exact", "exact"},
+		{"/tiers/prefix/other", "prefix"},
+		{"/tiers/tree/deep/path", "subtree"},
+		{"/tiers/both/x", "prefix"},
+		{"/tiers/static/a.txt", "static"},
+		{"/tiers/static/routed.txt", "exact"},
+		{"/tiers/static/missing.txt", "default"},
+		{"/tiers/unknown", "default"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		dispatch(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s: got %d %q, want 200 %q", tt.path, w.Code, w.Body.String(), tt.want)
+		}
+	}
+
+	// Without a default callback nothing else catches the request
+	unregisterRoute("/")
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/tiers/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("/tiers/unknown without a default: got %d, want 404", w.Code)
+	}
+}
+
+// handleCallback registers a C callback from cfixtures at path until the
+// test ends
+func handleCallback(t *testing.T, path string, callback *[0]byte) {
+	t.Helper()
+	if err := registerRoute(path, newEventRoute(callback)); err != nil {
+		t.Fatalf("registerRoute: %v", err)
+	}
+	t.Cleanup(func() { unregisterRoute(path) })
+}
+
+func TestReplaceRouteTableChanges(t *testing.T) {
+	t.Cleanup(func() {
+		unregisterRoute("/table/kept")
+		unregisterRoute("/table/gone")
+		unregisterRoute("/table/new")
+	})
+	handleBody(t, "/table/go", "go")
+	tableA := map[string]*route{
+		"/table/kept": newEventRoute(cfixtures.EchoPathCallback()),
+		"/table/gone": newEventRoute(cfixtures.EchoPathCallback()),
+	}
+	if _, err := replaceRouteTable(tableA); err != nil {
+		t.Fatalf("replaceRouteTable: %v", err)
+	}
+	rt, _ := lookupRoute("/table/kept")
+	rt.paused.Store(true)
+
+	changes, err := replaceRouteTable(map[string]*route{
+		"/table/kept": newEventRoute(cfixtures.FallbackCallback()),
+		"/table/new":  newEventRoute(cfixtures.EchoPathCallback()),
+	})
+	if err != nil {
+		t.Fatalf("replaceRouteTable: %v", err)
+	}
+	if !slices.Equal(changes.Added, []string{"/table/new"}) ||
+		!slices.Equal(changes.Removed, []string{"/table/gone"}) ||
+		!slices.Equal(changes.Replaced, []string{"/table/kept"}) {
+		t.Errorf("changes = %+v", changes)
+	}
+	if rt, _ := lookupRoute("/table/kept"); !rt.paused.Load() {
+		t.Error("replaced route lost its paused setting")
+	}
+	if _, ok := lookupRoute("/table/gone"); ok {
+		t.Error("route missing from the new table is still registered")
+	}
+	if _, ok := lookupRoute("/table/go"); !ok {
+		t.Error("Go route was removed by the table replacement")
+	}
+}
+
+func TestReplaceRouteTableConsistent(t *testing.T) {
+	t.Cleanup(func() {
+		unregisterRoute("/swap/x")
+		unregisterRoute("/swap/a")
+		unregisterRoute("/swap/b")
+	})
+	// Table A answers /swap/x with "fallback" and has /swap/a, table B
+	// echoes the path of /swap/x and has /swap/b instead
+	tableA := func() map[string]*route {
+		return map[string]*route{
+			"/swap/x": newEventRoute(cfixtures.FallbackCallback()),
+			"/swap/a": newEventRoute(cfixtures.EchoPathCallback()),
+		}
+	}
+	tableB := func() map[string]*route {
+		return map[string]*route{
+			"/swap/x": newEventRoute(cfixtures.EchoPathCallback()),
+			"/swap/b": newEventRoute(cfixtures.EchoPathCallback()),
+		}
+	}
+	if _, err := replaceRouteTable(tableA()); err != nil {
+		t.Fatalf("replaceRouteTable: %v", err)
+	}
+
+	// Each side does a fixed amount of work, a single CPU may run them one
+	// after the other
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			table := tableA()
+			if i%2 == 0 {
+				table = tableB()
+			}
+			if _, err := replaceRouteTable(table); err != nil {
+				t.Errorf("replaceRouteTable: %v", err)
+				return
+			}
+		}
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				// A request resolves every path against one table
+				mux := globalMux.Load()
+				_, a := mux.Handler(httptest.NewRequest(http.MethodGet, "/swap/a", nil))
+				_, b := mux.Handler(httptest.NewRequest(http.MethodGet, "/swap/b", nil))
+				if (a == "/swap/a") == (b == "/swap/b") {
+					t.Errorf("mixed table: /swap/a matched %q, /swap/b matched %q", a, b)
+					return
+				}
+
+				w := httptest.NewRecorder()
+				dispatch(w, httptest.NewRequest(http.MethodGet, "/swap/x", nil))
+				if body := w.Body.String(); w.Code != http.StatusOK || (body != "fallback" && body != "/swap/x") {
+					t.Errorf("/swap/x during a swap: got %d %q", w.Code, body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRouteCacheControl(t *testing.T) {
+	rt := newEventRoute(cfixtures.EchoPathCallback())
+	rt.cacheControl = "public, max-age=60"
+	if err := registerRoute("/cached", rt); err != nil {
+		t.Fatalf("registerRoute: %v", err)
+	}
+	defer unregisterRoute("/cached")
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/cached", nil))
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Cache-Control = %q, want %q", got, "public, max-age=60")
+	}
+	expires, err := http.ParseTime(w.Header().Get("Expires"))
+	if err != nil {
+		t.Fatalf("Expires: %v", err)
+	}
+	if until := time.Until(expires); until < 55*time.Second || until > 61*time.Second {
+		t.Errorf("Expires is %v away, want about a minute", until)
+	}
+
+	// The callback's own values win
+	response := newAsgiResponse("cached", http.StatusOK, [][2]string{
+		{"Cache-Control", "no-store"},
+		{"Expires", "0"},
+	}, nil)
+	defer freeAsgiResponse(response)
+	w = httptest.NewRecorder()
+	applyCachePolicy(w, rt, response)
+	writeResponseFromC(w, httptest.NewRequest(http.MethodGet, "/cached", nil), response)
+	if got := w.Header().Values("Cache-Control"); len(got) != 1 || got[0] != "no-store" {
+		t.Errorf("callback Cache-Control became %q", got)
+	}
+	if got := w.Header().Values("Expires"); len(got) != 1 || got[0] != "0" {
+		t.Errorf("callback Expires became %q", got)
+	}
+}
@@ -36,6 +36,10 @@ package main
 //     free_asgi_string(event->path);
 //     free_asgi_string(event->query_string);
 //     free_asgi_string(event->scheme);
+//     free_asgi_string(event->traceparent);
+//     free_asgi_string(event->http_version);
+//     free_asgi_string(event->request_target);
+//     free_asgi_string(event->type);
 //
 //     // Free headers
 //     for (size_t i = 0; i < event->headers_count; i++) {
@@ -46,6 +50,32 @@ package main
 //         free(event->headers);
 //     }
 //
+//     // Free path params
+//     for (size_t i = 0; i < event->path_params_count; i++) {
+//         free_asgi_string(event->path_params[i].name);
+//         free_asgi_string(event->path_params[i].value);
+//     }
+//     if (event->path_params != NULL) {
+//         free(event->path_params);
+//     }
+//
+//     // Free the offered subprotocols
+//     for (size_t i = 0; i < event->subprotocols_count; i++) {
+//         free_asgi_string(event->subprotocols[i]);
+//     }
+//     if (event->subprotocols != NULL) {
+//         free(event->subprotocols);
+//     }
+//
+//     // Free query params
+//     for (size_t i = 0; i < event->query_params_count; i++) {
+//         free_asgi_string(event->query_params[i].name);
+//         free_asgi_string(event->query_params[i].value);
+//     }
+//     if (event->query_params != NULL) {
+//         free(event->query_params);
+//     }
+//
 //     // Free client
 //     if (event->client != NULL) {
 //         // Access client array elements by pointer arithmetic
@@ -86,10 +116,20 @@ package main
 //         free(response->headers);
 //     }
 //
+//     // Free trailers
+//     for (size_t i = 0; i < response->trailers_count; i++) {
+//         free_asgi_string(response->trailers[i].name);
+//         free_asgi_string(response->trailers[i].value);
+//     }
+//     if (response->trailers != NULL) {
+//         free(response->trailers);
+//     }
+//
 //     // Free body
 //     if (response->body != NULL) {
 //         free(response->body);
 //     }
+//     free_asgi_string(response->file_path);
 //
 //     // Free the response itself
 //     free(response);
@@ -104,22 +144,41 @@ import "C"
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
+
+	"github.com/pankgeorg/asgi-go/marily"
 )
 
 // Configuration constants
 const (
-	// Maximum number of concurrent requests to process
-	maxConcurrentRequests = 4
+	// Maximum number of concurrent requests when StartServer is not given one
+	defaultMaxConcurrentRequests = 1000
 	// Request timeout for callback in seconds
 	callbackTimeout = 30
+	// How long a request waits for a request slot unless configured otherwise
+	defaultQueueTimeout = 5 * time.Second
+	// How often a graceful stop checks for in-flight requests
+	inFlightPollInterval = 10 * time.Millisecond
+	// Retry-After in seconds sent with 503 responses from paused routes
+	pausedRouteRetryAfter = 30
+	// How long stopping the server waits for the listener to be released
+	listenerReleaseTimeout = 5 * time.Second
+	// Size of each write when streaming a response body out of C memory
+	responseWriteChunkSize = 32 * 1024
 )
 
 // Global variables to manage the server state
@@ -127,69 +186,110 @@ var (
 	server   *http.Server
 	serverMu sync.Mutex
 
-	// Global router/multiplexer
-	globalMux = http.NewServeMux()
+	// Listener of the running server and a channel closed once its serve
+	// loop has exited, guarded by serverMu
+	serverListener net.Listener
+	serverDone     chan struct{}
+
+	// Global router/multiplexer, rebuilt from callbacks and swapped on every change
+	globalMux atomic.Pointer[http.ServeMux]
 
-	// Path-to-callback mapping
+	// Path-to-route mapping, the source of truth for globalMux
 	callbacksMu sync.RWMutex
-	callbacks   = make(map[string]C.asgi_callback_fn)
+	callbacks   = make(map[string]*route)
+
+	// Methods advertised as supported server-wide
+	supportedMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
 
 	// Request ID generation
 	requestIdSeq int64 = 0
 
+	// Maximum number of concurrent requests to process, set by StartServer
+	maxConcurrentRequests = defaultMaxConcurrentRequests
+
 	// Semaphore to limit concurrent requests
 	// Using a buffered channel as a counting semaphore
 	requestSemaphore = make(chan struct{}, maxConcurrentRequests)
+
+	// Closed once the running server begins shutting down
+	serverStopping atomic.Pointer[chan struct{}]
+	// Set from the moment the server begins shutting down until it is
+	// started again, so new requests are refused without blocking
+	shutdownInProgress atomic.Bool
+
+	// How long a request waits for a request slot, 0 to not wait at all
+	queueTimeout atomic.Int64
+
+	// Number of requests currently being handled, including those queued on the semaphore
+	activeRequests atomic.Int64
+	// Number of requests blocked waiting for a semaphore slot
+	waitingRequests atomic.Int64
+	// Number of callbacks currently running, which may outlive timed out requests
+	executingRequests atomic.Int64
+
+	// Maximum number of requests served on a single connection (0 = unlimited)
+	maxRequestsPerConnection atomic.Int64
+
+	// Limits on the headers a callback may return (0 = unlimited)
+	maxResponseHeaders     atomic.Int64
+	maxResponseHeaderBytes atomic.Int64
 )
 
+// connRequestsKey is the context key for the per-connection request counter
+type connRequestsKey struct{}
+
 // Convert a Go string to a C asgi_string
 func goStringToAsgiString(s string) C.asgi_string {
 	return C.make_asgi_string(C.CString(s))
 }
 
-// Convert HTTP headers to C asgi_header array
-func headersToAsgiHeaders(headers http.Header) (*C.asgi_header, C.size_t) {
-	count := 0
-	for _, values := range headers {
-		count += len(values)
-	}
-
-	// Add one for the Host header if not present
-	if _, ok := headers["Host"]; !ok {
-		count++
-	}
-
-	if count == 0 {
+// Convert name/value pairs to a C asgi_header array, NULL when empty
+func pairsToAsgiHeaders(pairs [][2]string) (*C.asgi_header, C.size_t) {
+	if len(pairs) == 0 {
 		return nil, 0
 	}
 
 	// Allocate memory for headers
-	asgiHeaders := (*C.asgi_header)(C.malloc(C.size_t(count) * C.size_t(unsafe.Sizeof(C.asgi_header{}))))
-	idx := 0
+	asgiHeaders := (*C.asgi_header)(C.malloc(C.size_t(len(pairs)) * C.size_t(unsafe.Sizeof(C.asgi_header{}))))
 
 	// Convert each header
-	for name, values := range headers {
-		for _, value := range values {
-			// Convert to lowercase as per ASGI spec
-			headerName := strings.ToLower(name)
-			header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(asgiHeaders)) +
-				uintptr(idx)*unsafe.Sizeof(C.asgi_header{})))
-
-			header.name = goStringToAsgiString(headerName)
-			header.value = goStringToAsgiString(value)
-			idx++
-		}
-	}
-
-	// Add Host header if not present
-	if _, ok := headers["Host"]; !ok {
+	for idx, pair := range pairs {
 		header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(asgiHeaders)) +
 			uintptr(idx)*unsafe.Sizeof(C.asgi_header{})))
-		header.name = goStringToAsgiString("host")
-		header.value = goStringToAsgiString("localhost")
+		header.name = goStringToAsgiString(pair[0])
+		header.value = goStringToAsgiString(pair[1])
 	}
 
-	return asgiHeaders, C.size_t(count)
+	return asgiHeaders, C.size_t(len(pairs))
+}
+
+// Convert a C asgi_header array of count entries to name/value pairs
+func asgiHeaderPairs(headers *C.asgi_header, count C.size_t) [][2]string {
+	pairs := make([][2]string, 0, int(count))
+	for i := 0; i < int(count); i++ {
+		header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(headers)) +
+			uintptr(i)*unsafe.Sizeof(C.asgi_header{})))
+		pairs = append(pairs, [2]string{
+			C.GoStringN(header.name.data, C.int(header.name.length)),
+			C.GoStringN(header.value.data, C.int(header.value.length)),
+		})
+	}
+	return pairs
+}
+
+// requestHost returns the host the request was sent to, falling back to
+// the address of the listener that accepted it when the client sent none
+func requestHost(r *http.Request) string {
+	if r.Host != "" {
+		return r.Host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return "localhost"
 }
 
 //export freeAsgiEvent
@@ -197,94 +297,227 @@ func freeAsgiEvent(event *C.asgi_event) {
 	C.free_asgi_event(event)
 }
 
-// createAsgiEvent converts an HTTP request to a C asgi_event
-func createAsgiEvent(r *http.Request, requestId string) *C.asgi_event {
-	// Allocate memory for the event
-	event := (*C.asgi_event)(C.malloc(C.size_t(unsafe.Sizeof(C.asgi_event{}))))
-
-	// Set request ID
-	event.request_id = goStringToAsgiString(requestId)
-
-	// Set method
-	event.method = goStringToAsgiString(r.Method)
-
-	// Set path
-	event.path = goStringToAsgiString(r.URL.Path)
+// FreeCString releases a string returned by any of the exported functions.
+// Every *C.char they return is owned by the caller and must be released
+// exactly once, with this function or the C free().
+//
+//export FreeCString
+func FreeCString(ptr *C.char) {
+	C.free(unsafe.Pointer(ptr))
+}
 
-	// Set query string
-	event.query_string = goStringToAsgiString(r.URL.RawQuery)
+// freeAsgiResponse releases a response returned by a callback
+func freeAsgiResponse(response *C.asgi_response) {
+	C.free_asgi_response(response)
+}
 
-	// Set scheme
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+// freeLateResponse waits for the callback call behind pending, whose request
+// has already been answered or abandoned, and frees its response
+func freeLateResponse(pending <-chan *C.asgi_response) {
+	if late := <-pending; late != nil {
+		freeAsgiResponse(late)
 	}
-	event.scheme = goStringToAsgiString(scheme)
+}
 
-	// Set headers
-	event.headers, event.headers_count = headersToAsgiHeaders(r.Header)
+// splitHostPort splits "host:port", "[v6]:port" included, into host and
+// port. Anything else is taken as a bare host with an empty port, and an
+// empty or unnamed address gives the defaults.
+func splitHostPort(hostport, defaultHost, defaultPort string) (string, string) {
+	// Peers on a unix socket are unnamed, which Linux reports as "@"
+	if hostport == "" || hostport == "@" {
+		return defaultHost, defaultPort
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, ""
+	}
+	return host, port
+}
 
-	// Set client info - Fix: can't use array indexing with *C.asgi_string
-	clientInfo := (*C.asgi_string)(C.malloc(2 * C.size_t(unsafe.Sizeof(C.asgi_string{}))))
-	hostStr, portStr := "127.0.0.1", "0"
-	if idx := strings.LastIndex(r.RemoteAddr, ":"); idx > 0 {
-		hostStr = r.RemoteAddr[:idx]
-		portStr = r.RemoteAddr[idx+1:]
+// createAsgiEvent converts an HTTP request to a C http.request asgi_event.
+// It fails, without allocating anything, when the request body cannot be read.
+func createAsgiEvent(r *http.Request, requestId string) (*C.asgi_event, error) {
+	// Read the body first so a failed read leaves nothing to free
+	bodyBytes, err := readRequestBody(r)
+	if err != nil {
+		return nil, err
 	}
+	return newAsgiEvent(r, requestId, "http.request", bodyBytes), nil
+}
 
-	// Fix: Set client array elements using pointer arithmetic
-	hostClientPtr := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(clientInfo))))
-	portClientPtr := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(clientInfo)) +
-		unsafe.Sizeof(C.asgi_string{})))
+// createAsgiEventChunk converts an HTTP request to a C http.request
+// asgi_event carrying the next chunk of its body, with more_body set while
+// more chunks may follow
+func createAsgiEventChunk(r *http.Request, requestId string) (*C.asgi_event, error) {
+	var chunk []byte
+	more := false
+	if r.Body != nil {
+		var err error
+		chunk, more, err = readBodyChunk(r.Body)
+		if err != nil || !more {
+			r.Body.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	*hostClientPtr = goStringToAsgiString(hostStr)
-	*portClientPtr = goStringToAsgiString(portStr)
-	event.client = clientInfo
+	event := newAsgiEvent(r, requestId, "http.request", chunk)
+	event.more_body = C.bool(more)
+	return event, nil
+}
 
-	// Set server info - Fix: can't use array indexing with *C.asgi_string
-	serverInfo := (*C.asgi_string)(C.malloc(2 * C.size_t(unsafe.Sizeof(C.asgi_string{}))))
-	hostStr, portStr = "localhost", "80"
-	if idx := strings.LastIndex(r.Host, ":"); idx > 0 {
-		hostStr = r.Host[:idx]
-		portStr = r.Host[idx+1:]
-	}
+// newAsgiEvent builds a C asgi_event of the given type for the request,
+// carrying bodyBytes as its body
+func newAsgiEvent(r *http.Request, requestId, eventType string, bodyBytes []byte) *C.asgi_event {
+	return asgiEventToC(createASGIEvent(r, requestId, eventType, bodyBytes))
+}
 
-	// Fix: Set server array elements using pointer arithmetic
-	hostServerPtr := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(serverInfo))))
-	portServerPtr := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(serverInfo)) +
-		unsafe.Sizeof(C.asgi_string{})))
+// asgiEventToC copies an event into a newly allocated C asgi_event
+func asgiEventToC(ev marily.Event) *C.asgi_event {
+	// Allocate memory for the event
+	event := (*C.asgi_event)(C.malloc(C.size_t(unsafe.Sizeof(C.asgi_event{}))))
 
-	*hostServerPtr = goStringToAsgiString(hostStr)
-	*portServerPtr = goStringToAsgiString(portStr)
-	event.server = serverInfo
+	// Set the event type and, for WebSocket messages, the frame type
+	event._type = goStringToAsgiString(ev.Type)
+	event.body_is_text = C.bool(ev.BodyIsText)
+
+	// Set the request line
+	event.request_id = goStringToAsgiString(ev.RequestID)
+	event.method = goStringToAsgiString(ev.Method)
+	event.path = goStringToAsgiString(ev.Path)
+	event.request_target = goStringToAsgiString(ev.RequestTarget)
+	event.query_string = goStringToAsgiString(ev.QueryString)
+	event.http_version = goStringToAsgiString(ev.HTTPVersion)
+	event.scheme = goStringToAsgiString(ev.Scheme)
+
+	// Set headers, the segments captured by the route pattern and the query
+	// parameters
+	event.headers, event.headers_count = pairsToAsgiHeaders(ev.Headers)
+	event.path_params, event.path_params_count = pairsToAsgiHeaders(ev.PathParams)
+	event.query_params, event.query_params_count = pairsToAsgiHeaders(ev.QueryParams)
+
+	// Set client and server info
+	event.client = addressToAsgiStrings(ev.Client)
+	event.server = addressToAsgiStrings(ev.Server)
 
 	// Set body
-	if r.Body != nil {
-		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-
-		if len(bodyBytes) > 0 {
-			bodyPtr := C.malloc(C.size_t(len(bodyBytes)))
-			C.memcpy(bodyPtr, unsafe.Pointer(&bodyBytes[0]), C.size_t(len(bodyBytes)))
-			event.body = (*C.uchar)(bodyPtr)
-			event.body_length = C.size_t(len(bodyBytes))
-		} else {
-			event.body = nil
-			event.body_length = 0
-		}
+	if len(ev.Body) > 0 {
+		bodyPtr := C.malloc(C.size_t(len(ev.Body)))
+		C.memcpy(bodyPtr, unsafe.Pointer(&ev.Body[0]), C.size_t(len(ev.Body)))
+		event.body = (*C.uchar)(bodyPtr)
+		event.body_length = C.size_t(len(ev.Body))
 	} else {
 		event.body = nil
 		event.body_length = 0
 	}
+	event.more_body = C.bool(ev.MoreBody)
+	event.content_length = C.int64_t(ev.ContentLength)
+	event.subprotocols, event.subprotocols_count = stringsToAsgiStrings(ev.Subprotocols)
 
-	// Set more_body
-	event.more_body = C.bool(false)
+	// Set the trace context the handler should forward downstream
+	event.traceparent = goStringToAsgiString(ev.Traceparent)
 
 	return event
 }
 
-// writeResponseFromC writes an ASGI response to the HTTP response writer
-func writeResponseFromC(w http.ResponseWriter, response *C.asgi_response) {
+// addressToAsgiStrings copies a host and port into a C array of two
+// asgi_strings
+func addressToAsgiStrings(address [2]string) *C.asgi_string {
+	// Can't use array indexing with *C.asgi_string
+	info := (*C.asgi_string)(C.malloc(2 * C.size_t(unsafe.Sizeof(C.asgi_string{}))))
+	hostPtr := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(info))))
+	portPtr := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(info)) +
+		unsafe.Sizeof(C.asgi_string{})))
+	*hostPtr = goStringToAsgiString(address[0])
+	*portPtr = goStringToAsgiString(address[1])
+	return info
+}
+
+// stringsToAsgiStrings copies a list of strings into a C array of
+// asgi_strings, NULL for an empty list
+func stringsToAsgiStrings(values []string) (*C.asgi_string, C.size_t) {
+	if len(values) == 0 {
+		return nil, 0
+	}
+	array := (*C.asgi_string)(C.malloc(C.size_t(len(values)) * C.size_t(unsafe.Sizeof(C.asgi_string{}))))
+	for i, value := range values {
+		item := (*C.asgi_string)(unsafe.Pointer(uintptr(unsafe.Pointer(array)) +
+			uintptr(i)*unsafe.Sizeof(C.asgi_string{})))
+		*item = goStringToAsgiString(value)
+	}
+	return array, C.size_t(len(values))
+}
+
+// newAsgiResponse builds a C asgi_response from Go values. The result is
+// owned by the caller and must be released with free_asgi_response.
+func newAsgiResponse(requestId string, status int, headers [][2]string, body []byte) *C.asgi_response {
+	response := (*C.asgi_response)(C.calloc(1, C.size_t(unsafe.Sizeof(C.asgi_response{}))))
+	response.request_id = goStringToAsgiString(requestId)
+	response.status = C.int(status)
+
+	if len(headers) > 0 {
+		response.headers = (*C.asgi_header)(C.malloc(C.size_t(len(headers)) * C.size_t(unsafe.Sizeof(C.asgi_header{}))))
+		for i, h := range headers {
+			header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(response.headers)) +
+				uintptr(i)*unsafe.Sizeof(C.asgi_header{})))
+			header.name = goStringToAsgiString(h[0])
+			header.value = goStringToAsgiString(h[1])
+		}
+		response.headers_count = C.size_t(len(headers))
+	}
+
+	if len(body) > 0 {
+		response.body = (*C.uchar)(C.CBytes(body))
+		response.body_length = C.size_t(len(body))
+	}
+
+	return response
+}
+
+// checkResponseHeaderLimits reports an error when the response carries more
+// headers, or more header bytes, than allowed by SetMaxResponseHeaders
+func checkResponseHeaderLimits(response *C.asgi_response) error {
+	maxCount := maxResponseHeaders.Load()
+	maxBytes := maxResponseHeaderBytes.Load()
+
+	if maxCount > 0 && int64(response.headers_count) > maxCount {
+		return fmt.Errorf("%d response headers exceed the limit of %d", response.headers_count, maxCount)
+	}
+	if maxBytes > 0 {
+		var total int64
+		for i := 0; i < int(response.headers_count); i++ {
+			header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(response.headers)) +
+				uintptr(i)*unsafe.Sizeof(C.asgi_header{})))
+			total += int64(header.name.length) + int64(header.value.length)
+		}
+		if total > maxBytes {
+			return fmt.Errorf("%d bytes of response headers exceed the limit of %d", total, maxBytes)
+		}
+	}
+	return nil
+}
+
+// writeResponseFromC writes an ASGI response to the HTTP response writer. It
+// reports false when the response was refused and an error written instead.
+func writeResponseFromC(w http.ResponseWriter, r *http.Request, response *C.asgi_response) bool {
+	// Refuse to pass oversized header blocks on to the client
+	if err := checkResponseHeaderLimits(response); err != nil {
+		fmt.Printf("Rejected response %s: %v\n", C.GoStringN(response.request_id.data, C.int(response.request_id.length)), err)
+		writeError(w, http.StatusInternalServerError, "Response headers too large")
+		return false
+	}
+	if err := checkResponseHeadersUTF8(response); err != nil {
+		fmt.Printf("Rejected response %s: %v\n", C.GoStringN(response.request_id.data, C.int(response.request_id.length)), err)
+		writeError(w, http.StatusInternalServerError, "Invalid response headers")
+		return false
+	}
+
+	// A request ID the callback sets replaces the one the server echoes
+	if responseHeader(response, "X-Request-ID") != "" {
+		w.Header().Del("X-Request-ID")
+	}
+
 	// Set headers
 	for i := 0; i < int(response.headers_count); i++ {
 		header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(response.headers)) +
@@ -295,54 +528,319 @@ func writeResponseFromC(w http.ResponseWriter, response *C.asgi_response) {
 		w.Header().Add(name, value)
 	}
 
+	// Fill in the server-wide headers the callback left out
+	applyDefaultResponseHeaders(w.Header())
+
+	// Declare the charset of text responses that leave it out
+	applyDefaultCharset(w.Header())
+
+	// Announce the trailers before the header block goes out
+	trailers := asgiResponseTrailers(response)
+	declareTrailers(w, trailers)
+
+	status := int(response.status)
+
+	// A body on disk is streamed from the file rather than from memory
+	if response.file_path.length > 0 {
+		writeFileResponse(w, r, status, C.GoStringN(response.file_path.data, C.int(response.file_path.length)))
+		setTrailers(w, trailers)
+		return true
+	}
+	body := newCBufferReader(response.body, response.body_length)
+
+	// Serve the requested slice of a complete body if range handling is on,
+	// unless the callback answered with a range itself
+	rangeable := honorRangeOnCallbackResponses.Load() || bool(response.honor_range)
+	if rangeable && status == http.StatusOK && !bool(response.more_body) && w.Header().Get("Content-Range") == "" {
+		status = applyRange(w, r, body)
+	}
+
 	// Set status code
-	w.WriteHeader(int(response.status))
+	w.WriteHeader(status)
+
+	// Write body straight from the C buffer, without copying it into Go memory
+	io.Copy(w, body)
 
-	// Write body
-	if response.body != nil && response.body_length > 0 {
-		body := C.GoBytes(unsafe.Pointer(response.body), C.int(response.body_length))
-		w.Write(body)
+	// A streamed response sends its trailers after the last chunk
+	if !bool(response.more_body) {
+		setTrailers(w, trailers)
 	}
+	return true
 }
 
+// cBufferReader is an io.Reader over a C-owned buffer. It lets the response
+// body be written to the client in bounded chunks directly from C memory.
+// The buffer must stay alive until the reader has been drained.
+type cBufferReader struct {
+	data   []byte
+	offset int
+}
+
+func newCBufferReader(data *C.uchar, length C.size_t) *cBufferReader {
+	if data == nil || length == 0 {
+		return &cBufferReader{}
+	}
+	return &cBufferReader{data: unsafe.Slice((*byte)(unsafe.Pointer(data)), int(length))}
+}
+
+func (r *cBufferReader) Read(p []byte) (int, error) {
+	if r.offset >= len(r.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.offset:])
+	r.offset += n
+	return n, nil
+}
+
+// WriteTo writes the remaining buffer to w in chunks of responseWriteChunkSize.
+// io.Copy prefers this over Read, so no intermediate Go buffer is used.
+func (r *cBufferReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for r.offset < len(r.data) {
+		end := min(r.offset+responseWriteChunkSize, len(r.data))
+		n, err := w.Write(r.data[r.offset:end])
+		r.offset += n
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// RegisterEventCallback registers callback for path, replacing a callback
+// registered for it before. Registrations can be made before the server
+// starts and are kept across StopServer and StartServer.
+//
 //export RegisterEventCallback
 func RegisterEventCallback(path *C.char, callback C.asgi_callback_fn) *C.char {
 	pathStr := C.GoString(path)
 
-	// Add handler to the global mux if needed
-	globalMux.HandleFunc(pathStr, handleRequestWithCallback(callback))
+	// Add handler to the global mux
+	if err := registerRoute(pathStr, newEventRoute(callback)); err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
 	fmt.Print("Event callback registered for path: ", pathStr, "\n")
 	return C.CString(fmt.Sprintf("Event callback registered for path: %s", pathStr))
 }
 
+// RegisterEventCallbackMethod registers a callback for one method on a path.
+// Other methods fall through to a callback registered for the path alone,
+// and get 405 with an Allow header when there is none.
+//
+//export RegisterEventCallbackMethod
+func RegisterEventCallbackMethod(method *C.char, path *C.char, callback C.asgi_callback_fn) *C.char {
+	methodStr := strings.ToUpper(strings.TrimSpace(C.GoString(method)))
+	pathStr := C.GoString(path)
+	if methodStr == "" || strings.ContainsAny(methodStr, " \t/") {
+		return C.CString(fmt.Sprintf("Invalid method: %q", methodStr))
+	}
+
+	// ServeMux matches "METHOD /path" patterns and answers 405 itself
+	pattern := methodStr + " " + pathStr
+	if err := registerRoute(pattern, newEventRoute(callback)); err != nil {
+		return C.CString(fmt.Sprintf("Error registering %s: %v", pattern, err))
+	}
+	fmt.Print("Event callback registered for: ", pattern, "\n")
+	return C.CString(fmt.Sprintf("Event callback registered for: %s", pattern))
+}
+
+//export RegisterEventCallbackWithTimeout
+func RegisterEventCallbackWithTimeout(path *C.char, callback C.asgi_callback_fn, timeoutMilliseconds int) *C.char {
+	pathStr := C.GoString(path)
+	if timeoutMilliseconds < 0 {
+		return C.CString("Timeout must be >= 0")
+	}
+
+	rt := newEventRoute(callback)
+	rt.timeout = time.Duration(timeoutMilliseconds) * time.Millisecond
+	if err := registerRoute(pathStr, rt); err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
+	fmt.Print("Event callback registered for path: ", pathStr, " with timeout: ", rt.timeout, "\n")
+	return C.CString(fmt.Sprintf("Event callback registered for path: %s with timeout: %v", pathStr, rt.timeout))
+}
+
+//export RegisterEventCallbackWithCacheControl
+func RegisterEventCallbackWithCacheControl(path *C.char, callback C.asgi_callback_fn, cacheControl *C.char) *C.char {
+	pathStr := C.GoString(path)
+
+	rt := newEventRoute(callback)
+	rt.cacheControl = strings.TrimSpace(C.GoString(cacheControl))
+	if err := registerRoute(pathStr, rt); err != nil {
+		return C.CString(fmt.Sprintf("Error registering path %s: %v", pathStr, err))
+	}
+	fmt.Print("Event callback registered for path: ", pathStr, " with Cache-Control: ", rt.cacheControl, "\n")
+	return C.CString(fmt.Sprintf("Event callback registered for path: %s with Cache-Control: %s", pathStr, rt.cacheControl))
+}
+
+// newHTTPServer creates an http.Server for addr dispatching to the global mux
+// through the middleware chain, with the configured timeouts
+func newHTTPServer(addr string) *http.Server {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: applyMiddleware(http.HandlerFunc(dispatch)),
+		// OPTIONS * is answered by dispatch instead of net/http
+		DisableGeneralOptionsHandler: true,
+		// Attach a request counter to every connection
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connRequestsKey{}, new(atomic.Int64))
+		},
+	}
+	applyTimeouts(srv)
+	return srv
+}
+
 //export StartServer
-func StartServer(port int) *C.char {
+func StartServer(port int, maxConcurrent int) *C.char {
 	serverMu.Lock()
 	defer serverMu.Unlock()
 
 	if server != nil {
 		return C.CString("Server is already running")
 	}
+	if !listenerReleased() {
+		return C.CString("Server shutdown in progress, the port is not released yet")
+	}
 
-	// Reset the semaphore
-	requestSemaphore = make(chan struct{}, maxConcurrentRequests)
+	// Size the request semaphore for this run
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentRequests
+	}
+	maxConcurrentRequests = maxConcurrent
+	resetRequestState()
+
+	// Create a new server dispatching to the global mux
+	server = newHTTPServer(fmt.Sprintf(":%d", port))
+	applyH2C(server)
+
+	// Bind the port up front so errors are reported to the caller
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		server = nil
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
 
-	// Create a new server using the global mux
-	server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: globalMux,
+	// The application may refuse to start, e.g. when its database is down
+	if err := runLifespan("lifespan.startup"); err != nil {
+		listener.Close()
+		server = nil
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
 	}
 
 	// Start the server in a goroutine
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Printf("HTTP server error: %v\n", err)
-		}
-	}()
+	srv, semaphore := server, requestSemaphore
+	startServing(listener, func(l net.Listener) error {
+		return srv.Serve(newOverflowListener(l, semaphore, false))
+	})
 
 	return C.CString(fmt.Sprintf("Server started on port %d with max %d concurrent requests", port, maxConcurrentRequests))
 }
 
+//export StartServerTLS
+func StartServerTLS(port int, certFile *C.char, keyFile *C.char) *C.char {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server != nil {
+		return C.CString("Server is already running")
+	}
+	if !listenerReleased() {
+		return C.CString("Server shutdown in progress, the port is not released yet")
+	}
+
+	// Load the key pair up front so a bad path is reported to the caller
+	cert, err := tls.LoadX509KeyPair(C.GoString(certFile), C.GoString(keyFile))
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error loading certificate: %v", err))
+	}
+
+	resetRequestState()
+
+	server = newHTTPServer(fmt.Sprintf(":%d", port))
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		server = nil
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+
+	// The application may refuse to start, e.g. when its database is down
+	if err := runLifespan("lifespan.startup"); err != nil {
+		listener.Close()
+		server = nil
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+
+	// The certificate is in TLSConfig, so no files are passed here
+	srv, semaphore := server, requestSemaphore
+	startServing(listener, func(l net.Listener) error {
+		return srv.ServeTLS(newOverflowListener(l, semaphore, true), "", "")
+	})
+
+	return C.CString(fmt.Sprintf("Server started with TLS on port %d with max %d concurrent requests", port, maxConcurrentRequests))
+}
+
+//export StartServerUnix
+func StartServerUnix(socketPath *C.char) *C.char {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server != nil {
+		return C.CString("Server is already running")
+	}
+	if !listenerReleased() {
+		return C.CString("Server shutdown in progress, the port is not released yet")
+	}
+
+	path := C.GoString(socketPath)
+	if err := removeStaleSocket(path); err != nil {
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+
+	resetRequestState()
+
+	server = newHTTPServer(path)
+
+	// The listener removes the socket file again when it is closed
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		server = nil
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+
+	// The application may refuse to start, e.g. when its database is down
+	if err := runLifespan("lifespan.startup"); err != nil {
+		listener.Close()
+		server = nil
+		return C.CString(fmt.Sprintf("Error starting server: %v", err))
+	}
+
+	srv, semaphore := server, requestSemaphore
+	startServing(listener, func(l net.Listener) error {
+		return srv.Serve(newOverflowListener(l, semaphore, false))
+	})
+
+	return C.CString(fmt.Sprintf("Server started on unix socket %s with max %d concurrent requests", path, maxConcurrentRequests))
+}
+
+// removeStaleSocket deletes a socket file left behind by a server that did
+// not shut down cleanly. Any other file at path is left alone and reported.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
 //export StopServer
 func StopServer() *C.char {
 	serverMu.Lock()
@@ -356,118 +854,711 @@ func StopServer() *C.char {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	// Turn away requests still waiting for a semaphore token
+	beginShutdown()
+
+	// Let the application release its resources
+	if err := runLifespan("lifespan.shutdown"); err != nil {
+		fmt.Printf("Lifespan shutdown error: %v\n", err)
+	}
+
+	stopHTTP3(ctx)
 	if err := server.Shutdown(ctx); err != nil {
 		return C.CString(fmt.Sprintf("Error shutting down server: %v", err))
 	}
 
-	// Drain the semaphore to unblock any waiting goroutines
-	for i := 0; i < maxConcurrentRequests; i++ {
-		select {
-		case requestSemaphore <- struct{}{}:
-			// Added a token
-		default:
-			// Semaphore is full
-			break
-		}
-	}
+	releaseListener()
 
 	server = nil
 	return C.CString("Server stopped")
 }
 
-//export GetConcurrentRequests
-func GetConcurrentRequests() *C.char {
-	// Count how many slots are available in the semaphore
-	available := 0
-	for i := 0; i < maxConcurrentRequests; i++ {
+// shutdownSummary describes how the in-flight requests fared during a graceful stop
+type shutdownSummary struct {
+	InFlight       int64 `json:"in_flight"`
+	Completed      int64 `json:"completed"`
+	ForciblyClosed int64 `json:"forcibly_closed"`
+	// Callbacks still running when the server stopped, whose requests were
+	// already answered or abandoned
+	CallbacksRunning int64 `json:"callbacks_running"`
+	Clean            bool  `json:"clean"`
+}
+
+//export StopServerWithTimeout
+func StopServerWithTimeout(timeoutSeconds int) *C.char {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server == nil {
+		return C.CString("Server is not running")
+	}
+
+	summary := shutdownSummary{InFlight: activeRequests.Load()}
+
+	// Wait up to the grace period for in-flight requests to finish
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	// Turn away requests still waiting for a semaphore token
+	beginShutdown()
+
+	// Let the application release its resources
+	if err := runLifespan("lifespan.shutdown"); err != nil {
+		fmt.Printf("Lifespan shutdown error: %v\n", err)
+	}
+
+	stopHTTP3(ctx)
+	if err := server.Shutdown(ctx); err != nil {
+		// The grace period ran out, cut the remaining connections
+		summary.ForciblyClosed = activeRequests.Load()
+		server.Close()
+	}
+	summary.Completed = max(summary.InFlight-summary.ForciblyClosed, 0)
+	summary.CallbacksRunning = executingRequests.Load()
+	summary.Clean = summary.ForciblyClosed == 0
+
+	releaseListener()
+
+	server = nil
+	result, _ := json.Marshal(summary)
+	return C.CString(string(result))
+}
+
+// StopServerGraceful stops accepting requests, then waits up to the grace
+// period for every in-flight request and callback to finish before the
+// application is told to shut down. Whatever is still running when the
+// grace period ends is cut off and reported.
+//
+//export StopServerGraceful
+func StopServerGraceful(timeoutSeconds int) *C.char {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server == nil {
+		return C.CString("Server is not running")
+	}
+
+	summary := shutdownSummary{InFlight: activeRequests.Load()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	// New and queued requests are turned away from here on
+	beginShutdown()
+
+	// Shutdown closes the listeners and waits for the handlers; callbacks
+	// outliving their handler, and hijacked connections, are waited for
+	// separately
+	stopHTTP3(ctx)
+	server.Shutdown(ctx)
+	waitForInFlight(ctx)
+
+	summary.ForciblyClosed = activeRequests.Load()
+	summary.CallbacksRunning = executingRequests.Load()
+	if summary.ForciblyClosed > 0 {
+		server.Close()
+	}
+	summary.Completed = max(summary.InFlight-summary.ForciblyClosed, 0)
+	summary.Clean = summary.ForciblyClosed == 0 && summary.CallbacksRunning == 0
+
+	// The application shuts down once nothing uses it anymore
+	if err := runLifespan("lifespan.shutdown"); err != nil {
+		fmt.Printf("Lifespan shutdown error: %v\n", err)
+	}
+
+	releaseListener()
+
+	server = nil
+	result, _ := json.Marshal(summary)
+	return C.CString(string(result))
+}
+
+// waitForInFlight waits until no request is active and no callback is
+// running, and reports whether that happened before ctx ended
+func waitForInFlight(ctx context.Context) bool {
+	ticker := time.NewTicker(inFlightPollInterval)
+	defer ticker.Stop()
+	for {
+		if activeRequests.Load() == 0 && executingRequests.Load() == 0 {
+			return true
+		}
 		select {
-		case requestSemaphore <- struct{}{}:
-			available++
-		default:
-			break
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
 		}
 	}
+}
+
+// startServing runs serve on the listener in the background and records
+// both, so that stopping the server can wait for the port to be released.
+// The caller holds serverMu.
+func startServing(listener net.Listener, serve func(net.Listener) error) {
+	done := make(chan struct{})
+	serverListener, serverDone = listener, done
+
+	go func() {
+		defer close(done)
+		if err := serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("HTTP server error: %v\n", err)
+		}
+	}()
+}
+
+// releaseListener closes the listener of a stopped server and waits for its
+// serve loop to exit, so the port can be bound again by the next StartServer.
+// The caller holds serverMu.
+func releaseListener() {
+	if serverListener == nil {
+		return
+	}
+	// Shutdown closes it too, unless the serve loop has not started yet
+	serverListener.Close()
+
+	select {
+	case <-serverDone:
+		serverListener, serverDone = nil, nil
+	case <-time.After(listenerReleaseTimeout):
+		// listenerReleased keeps reporting false until the loop exits
+	}
+}
+
+// listenerReleased reports whether the previous serve loop has exited.
+// The caller holds serverMu.
+func listenerReleased() bool {
+	if serverDone == nil {
+		return true
+	}
+	select {
+	case <-serverDone:
+		serverListener, serverDone = nil, nil
+		return true
+	default:
+		return false
+	}
+}
+
+//export SetMaxRequestsPerConnection
+func SetMaxRequestsPerConnection(n int) *C.char {
+	if n < 0 {
+		return C.CString("Max requests per connection must be >= 0")
+	}
+	maxRequestsPerConnection.Store(int64(n))
+	if n == 0 {
+		return C.CString("Max requests per connection set to unlimited")
+	}
+	return C.CString(fmt.Sprintf("Max requests per connection set to %d", n))
+}
 
-	// Return the tokens we just took
-	for i := 0; i < available; i++ {
-		<-requestSemaphore
+//export SetMaxResponseHeaders
+func SetMaxResponseHeaders(count int, totalBytes int) *C.char {
+	if count < 0 || totalBytes < 0 {
+		return C.CString("Response header limits must be >= 0")
 	}
+	maxResponseHeaders.Store(int64(count))
+	maxResponseHeaderBytes.Store(int64(totalBytes))
+	return C.CString(fmt.Sprintf("Response header limits set to %d headers, %d bytes", count, totalBytes))
+}
 
-	inUse := maxConcurrentRequests - available
+// limitConnectionRequests counts the request against its connection and asks
+// net/http to close the connection once it has served the configured maximum
+func limitConnectionRequests(w http.ResponseWriter, r *http.Request) {
+	limit := maxRequestsPerConnection.Load()
+	if limit == 0 {
+		return
+	}
+	counter, ok := r.Context().Value(connRequestsKey{}).(*atomic.Int64)
+	if !ok {
+		return
+	}
+	if counter.Add(1) >= limit {
+		w.Header().Set("Connection", "close")
+	}
+}
+
+//export GetConcurrentRequests
+func GetConcurrentRequests() *C.char {
+	// Read the counter rather than probing the semaphore, which would take
+	// slots away from real requests while it ran
+	inUse := activeRequests.Load()
 	return C.CString(fmt.Sprintf("%d/%d concurrent requests active", inUse, maxConcurrentRequests))
 }
 
+// serverStatus is the snapshot returned by GetServerStatus
+type serverStatus struct {
+	Running bool `json:"running"`
+	// The server is draining its requests before it stops
+	ShuttingDown bool `json:"shutting_down"`
+	// Requests being handled, in any phase
+	Active int64 `json:"active"`
+	// Requests waiting for a concurrency slot
+	Waiting int64 `json:"waiting"`
+	// Callbacks currently running
+	Executing     int64 `json:"executing"`
+	MaxConcurrent int   `json:"max_concurrent"`
+	// Slots for reading request bodies and writing responses
+	ReadSlots  ioSlotUsage `json:"read_slots"`
+	WriteSlots ioSlotUsage `json:"write_slots"`
+}
+
+//export GetServerStatus
+func GetServerStatus() *C.char {
+	// A stop holds serverMu while it drains, so the status does not wait
+	// for it: the server is running until the stop completes
+	shuttingDown := shutdownInProgress.Load()
+	running := shuttingDown
+	if serverMu.TryLock() {
+		running = server != nil
+		serverMu.Unlock()
+	}
+
+	result, _ := json.Marshal(serverStatus{
+		Running:       running,
+		ShuttingDown:  running && shuttingDown,
+		Active:        activeRequests.Load(),
+		Waiting:       waitingRequests.Load(),
+		Executing:     executingRequests.Load(),
+		MaxConcurrent: maxConcurrentRequests,
+		ReadSlots:     ioSlotsUsage(&readSlots),
+		WriteSlots:    ioSlotsUsage(&writeSlots),
+	})
+	return C.CString(string(result))
+}
+
+// dispatch is the root handler of the server. It answers server-wide
+// requests itself and hands everything else to globalMux.
+//
+// Requests are resolved with a fixed precedence, first match wins:
+//
+//  1. exact callback:   a callback registered for exactly this path
+//  2. pattern callback: a callback whose pattern (method, host, params) matches
+//  3. prefix callback:  the longest prefix registered with RegisterEventCallbackPrefix
+//  4. subtree callback: a callback whose pattern ends in a slash, like /app/
+//  5. static file:      a file under a static mount
+//  6. default callback: the callback registered for "/", else the not found
+//     callback
+//  7. 404
+//
+// Tiers 1, 2 and 4 are resolved by globalMux, which always prefers the most
+// specific pattern, and tiers 3, 5 and 6 by serveRoute. The "/" pattern is
+// a subtree for globalMux, but serveRoute holds it back until no static
+// file matched.
+func dispatch(w http.ResponseWriter, r *http.Request) {
+	// Probes are answered first, and tell shutdown apart themselves
+	if serveHealthCheck(w, r) {
+		return
+	}
+
+	// No new request is started once shutdown has begun
+	if shutdownInProgress.Load() {
+		rejectShuttingDown(w)
+		return
+	}
+	dispatchMux(w, r, globalMux.Load(), true)
+}
+
+// dispatchMux is dispatch with the route table of a given server
+func dispatchMux(w http.ResponseWriter, r *http.Request, mux *http.ServeMux, defaultServer bool) {
+	// Recycle the connection once it has served enough requests, whichever
+	// route serves them
+	limitConnectionRequests(w, r)
+
+	// Record the request once handled while request capture is on
+	defer captureRequest(r)()
+
+	// OPTIONS * queries the capabilities of the server as a whole
+	if r.Method == http.MethodOptions && r.RequestURI == "*" {
+		w.Header().Set("Allow", strings.Join(supportedMethods, ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// An absolute-form target without a path ("GET http://host") asks for
+	// "/", rather than for a redirect to it
+	if r.URL.Path == "" && r.URL.Host != "" {
+		r.URL.Path = "/"
+	}
+
+	// During maintenance every route gets the maintenance response
+	if serveMaintenance(w) {
+		return
+	}
+
+	// Take the host from a trusted proxy before any host-based routing
+	r = applyForwardedHeaders(r)
+
+	// Every request gets an ID, echoed in its response, and is tracked for
+	// IsRequestCancelled under it
+	r, untrack := withRequestId(w, r)
+	defer untrack()
+
+	// Whoever reads the body first buffers it for the rest
+	r = withBodyBuffer(r)
+
+	// Clients limited to GET and POST may emulate other methods
+	applyMethodOverride(r)
+
+	// Upgrades to protocols the server cannot speak are refused up front
+	if handleUnsupportedUpgrade(w, r) {
+		return
+	}
+
+	// The built-in checks apply whichever tier serves the request
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveRoute(w, r, mux, defaultServer)
+	})
+	marily.Wrap(serve, builtinMiddleware...).ServeHTTP(w, r)
+}
+
+// admitRouteRequest runs the checks every route handler applies before any
+// work is done for a request: pausing, header limits and the client's
+// deadline. It returns the deadline for the handler, or false once the
+// request has been answered.
+func admitRouteRequest(w http.ResponseWriter, r *http.Request, rt *route) (time.Duration, bool) {
+	// Paused routes are taken offline without touching the others
+	if rt.paused.Load() {
+		w.Header().Set("Retry-After", strconv.Itoa(pausedRouteRetryAfter))
+		writeError(w, http.StatusServiceUnavailable, "This route is temporarily unavailable")
+		return 0, false
+	}
+
+	// A single pathologically long header line is refused outright
+	if err := checkRequestHeaderLines(r.Header); err != nil {
+		writeError(w, http.StatusRequestHeaderFieldsTooLarge, err.Error())
+		return 0, false
+	}
+
+	// Strict deployments refuse header values that are not UTF-8
+	if err := checkRequestHeadersUTF8(r.Header); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return 0, false
+	}
+
+	// Clients may ask for a shorter deadline than the route's
+	routeTimeout := time.Duration(callbackTimeout) * time.Second
+	if rt.timeout > 0 {
+		routeTimeout = rt.timeout
+	}
+	timeout, err := requestTimeout(r, routeTimeout)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return 0, false
+	}
+	return timeout, true
+}
+
 // handleRequestWithCallback processes incoming HTTP requests and creates ASGI events
-func handleRequestWithCallback(callback C.asgi_callback_fn) http.HandlerFunc {
+func handleRequestWithCallback(rt *route) http.HandlerFunc {
+	callback := rt.callback
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Try to acquire a semaphore token with a short timeout
-		// This prevents the server from accepting more requests than it can handle
-		select {
-		case requestSemaphore <- struct{}{}:
-			// Got a token, proceed with the request
-			defer func() {
-				// Always release the token when done
-				<-requestSemaphore
-			}()
-		case <-time.After(5 * time.Second):
-			// Could not get a token within timeout, server is overloaded
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Server is at capacity, please try again later"))
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+
+		// Observe the response for the latency metrics
+		recorder := newResponseRecorder(w, time.Now())
+		defer recorder.finish(r)
+		w = recorder
+
+		timeout, ok := admitRouteRequest(w, r, rt)
+		if !ok {
+			return
+		}
+
+		// Time the phases of the request for the Server-Timing header
+		timing := newServerTiming()
+
+		// Limit how many requests are processed at once
+		queueStart := timing.start()
+		semaphore, stopping := rt.requestSlots()
+		if !acquireRequestSlot(w, semaphore, stopping, rt.slotWait()) {
 			return
 		}
+		defer releaseRequestSlot(semaphore)
+		timing.end("queue", queueStart)
 
 		// Check if we have a callback registered
 		if callback == nil {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("No handler registered for this path"))
+			writeError(w, http.StatusNotFound, "No handler registered for this path")
 			return
 		}
 
-		// Generate a unique request ID
-		requestId := generateRequestId()
+		requestId := requestIdOf(r)
+		recorder.requestId = requestId
 
-		// Create a C asgi_event from the HTTP request
-		cEvent := createAsgiEvent(r, requestId)
+		// WebSocket connections keep the request slot until they close
+		if isWebSocketUpgrade(r) {
+			serveWebSocket(w, r, callback, requestId, stopping, timeout)
+			return
+		}
+
+		// Let the client start fetching the route's assets early
+		sendPreloadLinks(w, r, rt)
+
+		// Bodies over the configured size are refused before they are
+		// copied into C memory
+		if !limitRequestBodySize(w, r) {
+			return
+		}
+		// Uploads slower than the configured floor are cut off
+		limitUploadRate(w, r)
+
+		// The callback may turn an announced upload away before it is sent
+		if !checkExpectContinue(w, r, callback, requestId, timeout) {
+			return
+		}
+
+		// Create C asgi_events from the HTTP request, holding a read slot
+		// while the body is consumed. A streamed body takes one event per
+		// chunk, any other a single event.
+		streaming := streamRequestBodies.Load()
+		readEvent := func() (*C.asgi_event, bool) {
+			readStart := timing.start()
+			releaseRead, ok := acquireIOSlot(r.Context(), &readSlots)
+			if !ok {
+				return nil, false
+			}
+			var cEvent *C.asgi_event
+			var err error
+			if streaming {
+				cEvent, err = createAsgiEventChunk(r, requestId)
+			} else {
+				cEvent, err = createAsgiEvent(r, requestId)
+			}
+			releaseRead()
+			timing.end("read", readStart)
+			if errors.Is(err, errUploadTooSlow) {
+				w.Header().Set("Connection", "close")
+				writeError(w, http.StatusRequestTimeout, "Request body upload too slow")
+				return nil, false
+			}
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+				return nil, false
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Error reading request body")
+				return nil, false
+			}
+			return cEvent, true
+		}
+		cEvent, ok := readEvent()
+		if !ok {
+			return
+		}
 		// We give this responsibility to julia nowadays
 		// defer C.free_asgi_event(cEvent)
 
+		// Chunks of a streamed response may arrive as soon as the callback returns
+		stream := openResponseStream(requestId)
+		defer stream.close(requestId)
+
 		// Set up a timeout for the callback
 		var cResponse *C.asgi_response
 		responseChan := make(chan *C.asgi_response, 1)
-		timeoutChan := time.After(time.Duration(callbackTimeout) * time.Second)
-
-		// Call the callback in a goroutine to allow timeout
-		go func() {
-			result := C.call_event_callback(callback, cEvent)
-			responseChan <- result
-		}()
-
-		// Wait for the callback to complete or timeout
-		select {
-		case cResponse = <-responseChan:
-			// Callback completed
-		case <-timeoutChan:
-			// Callback timed out
-			w.WriteHeader(http.StatusGatewayTimeout)
-			w.Write([]byte("Request processing timed out"))
-			return
+		timeoutChan := time.After(timeout)
+		callbackStart := timing.start()
+
+		for first := true; ; first = false {
+			// The callback owns the event once called, read it before
+			moreBody := bool(cEvent.more_body)
+
+			// Call the hooks and the callback in a goroutine to allow timeout
+			go func(cEvent *C.asgi_event, runHooks bool) {
+				// A panic here would take the host process down with it, answer
+				// with no response instead, which the handler turns into an error
+				defer func() {
+					if p := recover(); p != nil {
+						fmt.Printf("Panic while handling request %s: %v\n%s", requestId, p, debug.Stack())
+						responseChan <- nil
+					}
+				}()
+
+				// A scope hook may answer the request itself
+				if runHooks {
+					if result := runScopeHooks(cEvent); result != nil {
+						C.free_asgi_event(cEvent)
+						responseChan <- result
+						return
+					}
+				}
+				executingRequests.Add(1)
+				defer executingRequests.Add(-1)
+				responseChan <- C.call_event_callback(callback, cEvent)
+			}(cEvent, first)
+
+			// Wait for the callback to complete or timeout
+			select {
+			case cResponse = <-responseChan:
+				// Callback completed
+			case <-timeoutChan:
+				// Callback timed out, its response is freed whenever it comes
+				go freeLateResponse(responseChan)
+				extendWriteDeadline(w)
+				writeError(w, http.StatusGatewayTimeout, "Request processing timed out")
+				return
+			case <-r.Context().Done():
+				// The client went away, no one is waiting for the response
+				sendDisconnect(callback, r, requestId, responseChan)
+				return
+			}
+
+			// The callback may answer before the rest of the body arrives
+			if cResponse != nil || !moreBody {
+				break
+			}
+			if cEvent, ok = readEvent(); !ok {
+				return
+			}
 		}
 
+		timing.end("callback", callbackStart)
+		// The write timeout counts from the response being ready
+		extendWriteDeadline(w)
+
 		// Check if we got a valid response
 		if cResponse == nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("No response from event handler"))
-			return
+			cResponse = handleNilResponse(w, r, requestId, timeoutChan)
+			if cResponse == nil {
+				return
+			}
+		}
+
+		// Let the response hooks and body transforms adjust the response before
+		// it goes out. The body of a streamed response is never complete, so
+		// it is not transformed.
+		runResponseHooks(cResponse)
+		if !bool(cResponse.more_body) {
+			runBodyTransforms(cResponse)
 		}
 
 		// Write the response to the client and free it
-		writeResponseFromC(w, cResponse)
-		C.free_asgi_response(cResponse)
+		applyCachePolicy(w, rt, cResponse)
+		applyCORSHeaders(w, r, cResponse)
+		timing.writeHeader(w)
+		releaseWrite, ok := acquireIOSlot(r.Context(), &writeSlots)
+		if !ok {
+			C.free_asgi_response(cResponse)
+			return
+		}
+		defer releaseWrite()
+		defer C.free_asgi_response(cResponse)
+		// Deferred, so a stream aborted by panicking still closes the
+		// encoder and returns the buffer to its pool
+		cw, finish := compressResponse(w, r)
+		defer finish()
+		bw, flush := bufferResponse(cw)
+		defer flush()
+		if writeResponseFromC(bw, r, cResponse) && bool(cResponse.more_body) {
+			writeResponseStream(bw, r, stream, timeout)
+		}
 	}
 }
 
+func init() {
+	resetRequestState()
+	queueTimeout.Store(int64(defaultQueueTimeout))
+}
+
+//export SetQueueTimeout
+func SetQueueTimeout(timeoutMilliseconds int) *C.char {
+	if timeoutMilliseconds < 0 {
+		return C.CString("Queue timeout must be >= 0")
+	}
+	wait := time.Duration(timeoutMilliseconds) * time.Millisecond
+	queueTimeout.Store(int64(wait))
+	if wait == 0 {
+		return C.CString("Queue timeout set to 0, requests are refused when no slot is free")
+	}
+	return C.CString(fmt.Sprintf("Queue timeout set to %v", wait))
+}
+
+// resetRequestState gives a newly started server a fresh semaphore and
+// shutdown signal. The caller holds serverMu.
+func resetRequestState() {
+	requestSemaphore = make(chan struct{}, maxConcurrentRequests)
+	stopping := make(chan struct{})
+	serverStopping.Store(&stopping)
+	shutdownInProgress.Store(false)
+}
+
+// beginShutdown signals that the server is shutting down. It is safe to call
+// more than once. The caller holds serverMu.
+func beginShutdown() {
+	shutdownInProgress.Store(true)
+	stopping := *serverStopping.Load()
+	select {
+	case <-stopping:
+		// Already signalled
+	default:
+		close(stopping)
+	}
+}
+
+// acquireRequestSlot tries to acquire a semaphore token, waiting at most
+// wait for one. This prevents the server from accepting more requests than
+// it can handle. It writes a 503 and returns false when no token became
+// available, or when the server started shutting down while the request
+// was waiting. A zero wait never blocks.
+func acquireRequestSlot(w http.ResponseWriter, semaphore chan struct{}, stopping <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-stopping:
+		rejectShuttingDown(w)
+		return false
+	default:
+	}
+
+	select {
+	case semaphore <- struct{}{}:
+		// Got a token without waiting
+		return true
+	default:
+	}
+
+	if wait <= 0 {
+		writeError(w, http.StatusServiceUnavailable, "Server is at capacity, please try again later")
+		return false
+	}
+
+	waitingRequests.Add(1)
+	defer waitingRequests.Add(-1)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case semaphore <- struct{}{}:
+		// Got a token, proceed with the request
+		return true
+	case <-stopping:
+		// Waiting requests are rejected, not admitted, during shutdown
+		rejectShuttingDown(w)
+		return false
+	case <-timer.C:
+		// Could not get a token within timeout, server is overloaded
+		writeError(w, http.StatusServiceUnavailable, "Server is at capacity, please try again later")
+		return false
+	}
+}
+
+// rejectShuttingDown answers a request arriving during shutdown with 503,
+// closing the connection so the client does not reuse it
+func rejectShuttingDown(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	writeError(w, http.StatusServiceUnavailable, "Server is shutting down")
+}
+
+// releaseRequestSlot returns a token acquired by acquireRequestSlot
+func releaseRequestSlot(semaphore chan struct{}) {
+	<-semaphore
+}
+
 // generateRequestId creates a unique ID for each request
 func generateRequestId() string {
+	if requestIdStrategy.Load() == requestIdUUID {
+		return newUUID()
+	}
 	id := atomic.AddInt64(&requestIdSeq, 1)
 	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), id)
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+// startTestServer serves the global routes on a local port, configured as
+// StartServer configures the real server
+func startTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer("")
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestMaxRequestsPerConnection(t *testing.T) {
+	handleBody(t, "/conn", "ok")
+	maxRequestsPerConnection.Store(2)
+	defer maxRequestsPerConnection.Store(0)
+
+	ts := startTestServer(t)
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(conn, "GET /conn HTTP/1.1\r\nHost: test\r\n\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if i == 3 {
+			// The server closed the connection after the second response
+			if err == nil {
+				t.Fatalf("request %d answered with %d on a connection past its limit", i, resp.StatusCode)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if wantClose := i == 2; resp.Close != wantClose {
+			t.Errorf("request %d: Connection: close is %t, want %t", i, resp.Close, wantClose)
+		}
+	}
+}
+
+func TestResponseHeaderLimits(t *testing.T) {
+	maxResponseHeaders.Store(2)
+	defer maxResponseHeaders.Store(0)
+
+	headers := [][2]string{{"X-A", "1"}, {"X-B", "2"}, {"X-C", "3"}}
+	response := newAsgiResponse("limits", http.StatusOK, headers, []byte("body"))
+	defer freeAsgiResponse(response)
+	w := httptest.NewRecorder()
+	if writeResponseFromC(w, httptest.NewRequest(http.MethodGet, "/", nil), response) {
+		t.Error("response with too many headers written")
+	}
+	if w.Code != http.StatusInternalServerError || w.Header().Get("X-A") != "" {
+		t.Errorf("got %d with X-A %q, want a bare 500", w.Code, w.Header().Get("X-A"))
+	}
+
+	maxResponseHeaders.Store(3)
+	maxResponseHeaderBytes.Store(11)
+	defer maxResponseHeaderBytes.Store(0)
+	w = httptest.NewRecorder()
+	if writeResponseFromC(w, httptest.NewRequest(http.MethodGet, "/", nil), response) {
+		t.Error("response with too many header bytes written")
+	}
+
+	maxResponseHeaderBytes.Store(12)
+	w = httptest.NewRecorder()
+	if !writeResponseFromC(w, httptest.NewRequest(http.MethodGet, "/", nil), response) {
+		t.Fatal("response within the limits refused")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "body" || w.Header().Get("X-C") != "3" {
+		t.Errorf("got %d %q with X-C %q", w.Code, w.Body.String(), w.Header().Get("X-C"))
+	}
+}
+
+func TestOptionsAsterisk(t *testing.T) {
+	ts := startTestServer(t)
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "OPTIONS * HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("got %d, want 204", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Allow"), strings.Join(supportedMethods, ", "); got != want {
+		t.Errorf("Allow = %q, want %q", got, want)
+	}
+}
+
+// freePort returns a local TCP port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// serverRunning reports whether the default server is running
+func serverRunning() bool {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+	return server != nil
+}
+
+// resetAfterStop gives the dispatch tests that follow a request state that
+// is not shutting down, once the test has stopped the default server
+func resetAfterStop(t *testing.T) {
+	t.Cleanup(func() {
+		serverMu.Lock()
+		defer serverMu.Unlock()
+		resetRequestState()
+	})
+}
+
+func TestStartWhileStopping(t *testing.T) {
+	resetAfterStop(t)
+	release := make(chan struct{})
+	err := marily.Handle("/slow", func(marily.Event) marily.Response {
+		<-release
+		return marily.Response{Body: []byte("slow")}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/slow")
+	handleBody(t, "/fast", "fast")
+
+	port := freePort(t)
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+	FreeCString(StartServer(port, 0))
+	if !serverRunning() {
+		t.Fatal("server did not start")
+	}
+
+	// A request still in flight keeps the graceful stop waiting
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	for activeRequests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		FreeCString(StopServerGraceful(5))
+		close(stopped)
+	}()
+	for !shutdownInProgress.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The start waits for the stop instead of failing on the busy port
+	started := make(chan struct{})
+	go func() {
+		FreeCString(StartServer(port, 0))
+		close(started)
+	}()
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("in-flight request failed during the stop: %v", err)
+	}
+	<-stopped
+	<-started
+	defer func() { FreeCString(StopServer()) }()
+
+	if !serverRunning() {
+		t.Fatal("server did not start after the stop")
+	}
+	resp, err := http.Get(url + "/fast")
+	if err != nil {
+		t.Fatalf("request to the restarted server: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("restarted server answered %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestStopStartCycles(t *testing.T) {
+	resetAfterStop(t)
+	handleBody(t, "/cycle", "ok")
+	port := freePort(t)
+	for i := range 5 {
+		FreeCString(StartServer(port, 0))
+		if !serverRunning() {
+			t.Fatalf("cycle %d: server did not start", i)
+		}
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/cycle", port))
+		if err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+		resp.Body.Close()
+		FreeCString(StopServer())
+	}
+}
+
+// limitRequestSlots gives dispatched requests n request slots, waited for
+// up to wait, until the test ends
+func limitRequestSlots(t *testing.T, n int, wait time.Duration) {
+	t.Helper()
+	previousMax, previousWait := maxConcurrentRequests, queueTimeout.Load()
+	serverMu.Lock()
+	maxConcurrentRequests = n
+	resetRequestState()
+	serverMu.Unlock()
+	queueTimeout.Store(int64(wait))
+	t.Cleanup(func() {
+		queueTimeout.Store(previousWait)
+		serverMu.Lock()
+		maxConcurrentRequests = previousMax
+		resetRequestState()
+		serverMu.Unlock()
+	})
+}
+
+func TestShutdownRejectsSlotWaiters(t *testing.T) {
+	limitRequestSlots(t, 1, time.Minute)
+	release := make(chan struct{})
+	err := marily.Handle("/slots", func(marily.Event) marily.Response {
+		<-release
+		return marily.Response{Body: []byte("done")}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/slots")
+
+	// One request takes the only slot, the others wait for it
+	const waiters = 3
+	results := make(chan *httptest.ResponseRecorder, waiters+1)
+	for range waiters + 1 {
+		go func() {
+			w := httptest.NewRecorder()
+			dispatch(w, httptest.NewRequest(http.MethodGet, "/slots", nil))
+			results <- w
+		}()
+	}
+	for waitingRequests.Load() < waiters {
+		time.Sleep(time.Millisecond)
+	}
+
+	serverMu.Lock()
+	beginShutdown()
+	serverMu.Unlock()
+
+	// The waiters are turned away rather than handed the slot
+	for range waiters {
+		w := <-results
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Connection") != "close" {
+			t.Errorf("waiter got %d with Connection %q, want 503 and close", w.Code, w.Header().Get("Connection"))
+		}
+	}
+	if n := waitingRequests.Load(); n != 0 {
+		t.Errorf("%d requests still waiting after shutdown", n)
+	}
+
+	// The request holding the slot completes
+	close(release)
+	if w := <-results; w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Errorf("in-flight request got %d %q, want 200 %q", w.Code, w.Body.String(), "done")
+	}
+}
+
+// BenchmarkCBodyWrite compares writing a large C response body straight from
+// C memory with copying it into a Go slice first, as C.GoBytes did. The
+// writer discards, so the difference is the copy alone.
+func BenchmarkCBodyWrite(b *testing.B) {
+	response := newAsgiResponse("bench", http.StatusOK, nil, bytes.Repeat([]byte("x"), 8<<20))
+	defer freeAsgiResponse(response)
+
+	b.Run("direct", func(b *testing.B) {
+		b.SetBytes(int64(response.body_length))
+		b.ReportAllocs()
+		for b.Loop() {
+			io.Copy(io.Discard, newCBufferReader(response.body, response.body_length))
+		}
+	})
+	b.Run("copy", func(b *testing.B) {
+		b.SetBytes(int64(response.body_length))
+		b.ReportAllocs()
+		for b.Loop() {
+			body := bytes.Clone(newCBufferReader(response.body, response.body_length).data)
+			io.Discard.Write(body)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// When set, responses carry a Server-Timing header with the handling phases
+var serverTimingEnabled atomic.Bool
+
+//export EnableServerTiming
+func EnableServerTiming(enabled bool) *C.char {
+	serverTimingEnabled.Store(enabled)
+	return C.CString(fmt.Sprintf("Server-Timing enabled: %t", enabled))
+}
+
+// timingPhase is one measured phase of handling a request
+type timingPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// serverTiming accumulates the phases of a request. The zero value records
+// nothing, so a disabled request costs a time.Time per phase at most.
+type serverTiming struct {
+	enabled bool
+	phases  []timingPhase
+}
+
+func newServerTiming() serverTiming {
+	return serverTiming{enabled: serverTimingEnabled.Load()}
+}
+
+// start returns the start of a phase to pass to end
+func (t *serverTiming) start() time.Time {
+	if !t.enabled {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// end records the phase that began at start. Repeated phases, such as
+// reading a streamed body chunk by chunk, add up.
+func (t *serverTiming) end(name string, start time.Time) {
+	if !t.enabled {
+		return
+	}
+	duration := time.Since(start)
+	for i := range t.phases {
+		if t.phases[i].name == name {
+			t.phases[i].duration += duration
+			return
+		}
+	}
+	t.phases = append(t.phases, timingPhase{name: name, duration: duration})
+}
+
+// writeHeader sets the Server-Timing header, e.g.
+// "queue;dur=0.012, read;dur=0.204, callback;dur=15.731" in milliseconds
+func (t *serverTiming) writeHeader(w http.ResponseWriter) {
+	if !t.enabled || len(t.phases) == 0 {
+		return
+	}
+	metrics := make([]string, len(t.phases))
+	for i, phase := range t.phases {
+		metrics[i] = fmt.Sprintf("%s;dur=%.3f", phase.name, float64(phase.duration)/float64(time.Millisecond))
+	}
+	w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+// One "name;dur=milliseconds" metric of a Server-Timing header
+var serverTimingMetric = regexp.MustCompile(`^([a-z]+);dur=(\d+\.\d{3})$`)
+
+func TestServerTimingHeader(t *testing.T) {
+	handleCallback(t, "/timed", cfixtures.EchoPathCallback())
+	serverTimingEnabled.Store(true)
+	defer serverTimingEnabled.Store(false)
+
+	w := httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodPost, "/timed", strings.NewReader("body")))
+	header := w.Header().Get("Server-Timing")
+	var phases []string
+	for _, metric := range strings.Split(header, ", ") {
+		match := serverTimingMetric.FindStringSubmatch(metric)
+		if match == nil {
+			t.Fatalf("malformed Server-Timing metric %q in %q", metric, header)
+		}
+		phases = append(phases, match[1])
+	}
+	if got := strings.Join(phases, ","); got != "queue,read,callback" {
+		t.Errorf("Server-Timing phases %s, want queue,read,callback", got)
+	}
+
+	// Nothing is added while disabled
+	serverTimingEnabled.Store(false)
+	w = httptest.NewRecorder()
+	dispatch(w, httptest.NewRequest(http.MethodGet, "/timed", nil))
+	if got := w.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("disabled: Server-Timing = %q", got)
+	}
+}
+
+func TestServerTimingAddsRepeatedPhases(t *testing.T) {
+	timing := serverTiming{enabled: true}
+	now := time.Now()
+	timing.end("read", now.Add(-2*time.Millisecond))
+	timing.end("callback", now.Add(-5*time.Millisecond))
+	timing.end("read", now.Add(-3*time.Millisecond))
+
+	if len(timing.phases) != 2 || timing.phases[0].name != "read" || timing.phases[1].name != "callback" {
+		t.Fatalf("phases %+v, want read then callback", timing.phases)
+	}
+	if read := timing.phases[0].duration; read < 5*time.Millisecond {
+		t.Errorf("read %v, want the 5ms of both reads", read)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// staticMount serves the files of a directory under a URL prefix
+type staticMount struct {
+	prefix string
+	dir    string
+	// The directory opened as a root, so no path can resolve outside it,
+	// symbolic links included
+	root  *os.Root
+	files fs.FS
+	// Directories without an index.html are listed instead of passed on
+	listing bool
+}
+
+var (
+	// Serializes updates of staticMounts
+	staticMu sync.Mutex
+	// Static mounts, longest prefix first so the most specific mount applies
+	staticMounts atomic.Pointer[[]staticMount]
+)
+
+// RegisterStaticDir serves the files under dir at urlPrefix, without calling
+// into the C callbacks. Routes registered for a path, prefix routes and
+// subtree patterns win over static files, while a callback registered for
+// "/" gets only the paths no file matches. An empty dir removes the mount.
+//
+//export RegisterStaticDir
+func RegisterStaticDir(urlPrefix *C.char, dir *C.char) *C.char {
+	prefix := C.GoString(urlPrefix)
+	dirStr := C.GoString(dir)
+	if !strings.HasPrefix(prefix, "/") {
+		return C.CString(fmt.Sprintf("URL prefix must start with /: %s", prefix))
+	}
+
+	// An empty directory removes the mount
+	if dirStr == "" {
+		updateStaticMounts(prefix, nil)
+		return C.CString(fmt.Sprintf("Static directory removed for: %s", prefix))
+	}
+
+	root, err := os.OpenRoot(dirStr)
+	if err != nil {
+		return C.CString(fmt.Sprintf("Error opening static directory %s: %v", dirStr, err))
+	}
+	updateStaticMounts(prefix, &staticMount{prefix: prefix, dir: dirStr, root: root, files: root.FS()})
+	fmt.Print("Static directory ", dirStr, " registered for: ", prefix, "\n")
+	return C.CString(fmt.Sprintf("Static directory %s registered for: %s", dirStr, prefix))
+}
+
+//export SetStaticDirListing
+func SetStaticDirListing(urlPrefix *C.char, enabled bool) *C.char {
+	prefix := C.GoString(urlPrefix)
+
+	staticMu.Lock()
+	defer staticMu.Unlock()
+
+	current := staticMounts.Load()
+	if current == nil || !slices.ContainsFunc(*current, func(m staticMount) bool { return m.prefix == prefix }) {
+		return C.CString(fmt.Sprintf("No static directory registered for: %s", prefix))
+	}
+	mounts := slices.Clone(*current)
+	for i := range mounts {
+		if mounts[i].prefix == prefix {
+			mounts[i].listing = enabled
+		}
+	}
+	staticMounts.Store(&mounts)
+	return C.CString(fmt.Sprintf("Directory listing for %s enabled: %t", prefix, enabled))
+}
+
+// updateStaticMounts replaces the mount at prefix, or removes it when mount
+// is nil. A replaced mount keeps its listing setting, and the root of the
+// mount it replaces is closed; files already being served stay open.
+func updateStaticMounts(prefix string, mount *staticMount) {
+	staticMu.Lock()
+	defer staticMu.Unlock()
+
+	var mounts []staticMount
+	if current := staticMounts.Load(); current != nil {
+		mounts = slices.Clone(*current)
+	}
+	index := slices.IndexFunc(mounts, func(m staticMount) bool { return m.prefix == prefix })
+	if index >= 0 {
+		if mount != nil {
+			mount.listing = mounts[index].listing
+		}
+		if old := mounts[index].root; old != nil {
+			old.Close()
+		}
+		mounts = slices.Delete(mounts, index, index+1)
+	}
+
+	if mount != nil {
+		mounts = append(mounts, *mount)
+		slices.SortFunc(mounts, func(a, b staticMount) int { return len(b.prefix) - len(a.prefix) })
+	}
+	staticMounts.Store(&mounts)
+}
+
+// serveStatic serves the request from the static mount covering its path,
+// returning false when there is no file to serve so routing can go on
+func serveStatic(w http.ResponseWriter, r *http.Request, mounts *[]staticMount) bool {
+	if mounts == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	index := slices.IndexFunc(*mounts, func(m staticMount) bool { return underPrefix(r.URL.Path, m.prefix) })
+	if index < 0 {
+		return false
+	}
+	mount := (*mounts)[index]
+
+	// Cleaning the rooted path removes every "..", and the root refuses
+	// anything still pointing outside the directory
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(r.URL.Path, mount.prefix)), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(mount.files, name)
+	if err != nil {
+		return false
+	}
+
+	if info.IsDir() {
+		// Relative links in the index resolve against the directory
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := path.Base(r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return true
+		}
+		indexName := path.Join(name, "index.html")
+		if indexInfo, err := fs.Stat(mount.files, indexName); err == nil && !indexInfo.IsDir() {
+			return serveStaticFile(w, r, mount.files, indexName, indexInfo)
+		}
+		if !mount.listing {
+			return false
+		}
+		setCORSHeaders(w.Header(), r)
+		http.StripPrefix(strings.TrimSuffix(mount.prefix, "/"), http.FileServerFS(mount.files)).ServeHTTP(w, r)
+		return true
+	}
+	return serveStaticFile(w, r, mount.files, name, info)
+}
+
+// serveStaticFile writes a file with a validator derived from its size and
+// modification time. ServeContent sets Content-Type and answers conditional
+// and Range requests.
+func serveStaticFile(w http.ResponseWriter, r *http.Request, files fs.FS, name string, info fs.FileInfo) bool {
+	f, err := files.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	setCORSHeaders(w.Header(), r)
+	w.Header().Set("ETag", `W/"`+strconv.FormatInt(info.Size(), 16)+"-"+strconv.FormatInt(info.ModTime().UnixNano(), 16)+`"`)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mountDir mounts a directory holding a single file at prefix
+func mountDir(t *testing.T, prefix, name, content string) *os.Root {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateStaticMounts(prefix, &staticMount{prefix: prefix, dir: dir, root: root, files: root.FS()})
+	return root
+}
+
+func TestStaticMountServesFiles(t *testing.T) {
+	mountDir(t, "/assets/", "app.css", "body{}")
+	defer updateStaticMounts("/assets/", nil)
+
+	w := httptest.NewRecorder()
+	if !serveStatic(w, httptest.NewRequest(http.MethodGet, "/assets/app.css", nil), staticMounts.Load()) {
+		t.Fatal("file under the mount not served")
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "body{}" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "body{}")
+	}
+
+	// Other methods and paths are left to routing
+	if serveStatic(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/assets/app.css", nil), staticMounts.Load()) {
+		t.Error("POST served from the static mount")
+	}
+	if serveStatic(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other/app.css", nil), staticMounts.Load()) {
+		t.Error("path outside the mount served")
+	}
+}
+
+func TestStaticMountClosesReplacedRoot(t *testing.T) {
+	first := mountDir(t, "/files/", "a.txt", "first")
+	second := mountDir(t, "/files/", "a.txt", "second")
+	if _, err := first.Stat("a.txt"); err == nil {
+		t.Error("replaced root still open")
+	}
+
+	updateStaticMounts("/files/", nil)
+	if _, err := second.Stat("a.txt"); err == nil {
+		t.Error("removed root still open")
+	}
+}
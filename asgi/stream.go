@@ -0,0 +1,145 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Chunks queued for a streamed response before StreamResponseChunk blocks
+const responseStreamBuffer = 16
+
+// responseStream carries the body chunks of a streamed response from
+// StreamResponseChunk to the handler writing them
+type responseStream struct {
+	mu     sync.Mutex
+	closed bool
+	chunks chan *C.asgi_response
+	done   chan struct{}
+}
+
+// Open streams by request ID
+var responseStreams sync.Map
+
+// openResponseStream makes the request ready to receive chunks. It is
+// opened before the callback runs, so chunks sent right after the first
+// response is returned are never turned away.
+func openResponseStream(requestId string) *responseStream {
+	stream := &responseStream{
+		chunks: make(chan *C.asgi_response, responseStreamBuffer),
+		done:   make(chan struct{}),
+	}
+	responseStreams.Store(requestId, stream)
+	return stream
+}
+
+// close stops the stream and frees the chunks that were never written
+func (s *responseStream) close(requestId string) {
+	responseStreams.Delete(requestId)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.done)
+	s.drain()
+}
+
+// drain frees the queued chunks. The caller holds mu.
+func (s *responseStream) drain() {
+	for {
+		select {
+		case chunk := <-s.chunks:
+			freeAsgiResponse(chunk)
+		default:
+			return
+		}
+	}
+}
+
+// send queues a chunk, waiting while the queue is full. The chunk is freed
+// if the stream closes first.
+func (s *responseStream) send(chunk *C.asgi_response) bool {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		freeAsgiResponse(chunk)
+		return false
+	}
+
+	select {
+	case s.chunks <- chunk:
+	case <-s.done:
+		freeAsgiResponse(chunk)
+		return false
+	}
+
+	// A chunk that landed after close drained the queue is freed here
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.drain()
+		return false
+	}
+	return true
+}
+
+//export StreamResponseChunk
+func StreamResponseChunk(requestId *C.char, chunk *C.asgi_response) *C.char {
+	if chunk == nil {
+		return C.CString("Response chunk must not be NULL")
+	}
+
+	// The server owns the chunk from here on, whatever the outcome
+	id := C.GoString(requestId)
+	value, ok := responseStreams.Load(id)
+	if !ok {
+		freeAsgiResponse(chunk)
+		return C.CString(fmt.Sprintf("No streaming response for request: %s", id))
+	}
+	if !value.(*responseStream).send(chunk) {
+		return C.CString(fmt.Sprintf("Response stream closed for request: %s", id))
+	}
+	return C.CString("Response chunk queued")
+}
+
+// writeResponseStream writes the chunks following a first response that
+// had more_body set, flushing each one, until a chunk clears more_body.
+// A stream that stalls for longer than idleTimeout is cut off, and so is one
+// whose client goes away.
+func writeResponseStream(w http.ResponseWriter, r *http.Request, stream *responseStream, idleTimeout time.Duration) {
+	controller := http.NewResponseController(w)
+	controller.Flush()
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case chunk := <-stream.chunks:
+			more := bool(chunk.more_body)
+			extendWriteDeadline(w)
+			io.Copy(w, newCBufferReader(chunk.body, chunk.body_length))
+			if !more {
+				setTrailers(w, asgiResponseTrailers(chunk))
+			}
+			freeAsgiResponse(chunk)
+			controller.Flush()
+			if !more {
+				return
+			}
+			idle.Reset(idleTimeout)
+		case <-idle.C:
+			fmt.Printf("Response stream timed out for %s %s\n", r.Method, r.URL.Path)
+			// Ending normally would present the truncated body as complete
+			panic(http.ErrAbortHandler)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
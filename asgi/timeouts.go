@@ -0,0 +1,173 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Request header clients may set their own deadline with, nil when disabled
+	clientTimeoutHeader atomic.Pointer[string]
+	// Longest deadline a client may ask for
+	clientTimeoutMax atomic.Int64
+
+	// Units of the grpc-timeout header
+	grpcTimeoutUnits = map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	errMalformedTimeout = errors.New("malformed timeout header")
+)
+
+//export SetClientTimeoutHeader
+func SetClientTimeoutHeader(name *C.char, maxMilliseconds int) *C.char {
+	header := http.CanonicalHeaderKey(strings.TrimSpace(C.GoString(name)))
+	if header == "" {
+		clientTimeoutHeader.Store(nil)
+		return C.CString("Client timeout header disabled")
+	}
+	if maxMilliseconds < 0 {
+		return C.CString("Maximum client timeout must be >= 0")
+	}
+
+	// Without an explicit maximum clients may not exceed the callback timeout
+	maxTimeout := time.Duration(maxMilliseconds) * time.Millisecond
+	if maxTimeout == 0 {
+		maxTimeout = callbackTimeout * time.Second
+	}
+	clientTimeoutMax.Store(int64(maxTimeout))
+	clientTimeoutHeader.Store(&header)
+	return C.CString(fmt.Sprintf("Client timeout header set to %s (max %s)", header, maxTimeout))
+}
+
+// parseClientTimeout parses a timeout header value. grpc-timeout uses its
+// own format ("100m", "5S"), any other header is in milliseconds.
+func parseClientTimeout(header, value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(header, "grpc-timeout") {
+		if len(value) < 2 || len(value) > 9 {
+			return 0, errMalformedTimeout
+		}
+		unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+		n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if !ok || err != nil {
+			return 0, errMalformedTimeout
+		}
+		return scaleClientTimeout(n, unit)
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, errMalformedTimeout
+	}
+	return scaleClientTimeout(n, time.Millisecond)
+}
+
+// scaleClientTimeout returns n units as a duration. A timeout of 0 would
+// fail the request at once, so it is malformed, and one too long for a
+// duration is clamped rather than left to overflow.
+func scaleClientTimeout(n int64, unit time.Duration) (time.Duration, error) {
+	if n <= 0 {
+		return 0, errMalformedTimeout
+	}
+	if n > int64(math.MaxInt64/unit) {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// requestTimeout returns the callback deadline for the request: the one the
+// client asked for, clamped to the configured maximum, or the fallback
+func requestTimeout(r *http.Request, fallback time.Duration) (time.Duration, error) {
+	header := clientTimeoutHeader.Load()
+	if header == nil {
+		return fallback, nil
+	}
+	value := r.Header.Get(*header)
+	if value == "" {
+		return fallback, nil
+	}
+
+	timeout, err := parseClientTimeout(*header, value)
+	if err != nil {
+		return 0, err
+	}
+	return min(timeout, time.Duration(clientTimeoutMax.Load())), nil
+}
+
+const (
+	// Connection timeouts of servers unless configured otherwise
+	defaultReadTimeout  = 15 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+	defaultIdleTimeout  = 60 * time.Second
+)
+
+var (
+	// Time allowed to read a request, headers and body, 0 when unlimited
+	serverReadTimeout atomic.Int64
+	// Time allowed to write a response once it is ready, 0 when unlimited
+	serverWriteTimeout atomic.Int64
+	// Time a keep-alive connection may wait for its next request, 0 when
+	// unlimited
+	serverIdleTimeout atomic.Int64
+)
+
+func init() {
+	serverReadTimeout.Store(int64(defaultReadTimeout))
+	serverWriteTimeout.Store(int64(defaultWriteTimeout))
+	serverIdleTimeout.Store(int64(defaultIdleTimeout))
+}
+
+// ConfigureTimeouts sets the connection timeouts of servers started
+// afterwards, in milliseconds; 0 disables a timeout
+//
+//export ConfigureTimeouts
+func ConfigureTimeouts(readMilliseconds int, writeMilliseconds int, idleMilliseconds int) *C.char {
+	if readMilliseconds < 0 || writeMilliseconds < 0 || idleMilliseconds < 0 {
+		return C.CString("Timeouts must be >= 0")
+	}
+	read := time.Duration(readMilliseconds) * time.Millisecond
+	write := time.Duration(writeMilliseconds) * time.Millisecond
+	idle := time.Duration(idleMilliseconds) * time.Millisecond
+	serverReadTimeout.Store(int64(read))
+	serverWriteTimeout.Store(int64(write))
+	serverIdleTimeout.Store(int64(idle))
+	return C.CString(fmt.Sprintf("Timeouts set to read: %v, write: %v, idle: %v", read, write, idle))
+}
+
+// applyTimeouts sets the configured connection timeouts on srv
+func applyTimeouts(srv *http.Server) {
+	srv.ReadTimeout = time.Duration(serverReadTimeout.Load())
+	srv.WriteTimeout = time.Duration(serverWriteTimeout.Load())
+	srv.IdleTimeout = time.Duration(serverIdleTimeout.Load())
+}
+
+// extendWriteDeadline gives the response the full write timeout from now.
+// net/http starts the write timeout when the request is read, so without
+// this a slow callback or a long stream would eat into it.
+func extendWriteDeadline(w http.ResponseWriter) {
+	if timeout := time.Duration(serverWriteTimeout.Load()); timeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+// clearDeadlines lifts the server timeouts from a hijacked connection,
+// which keeps the deadlines net/http had set on it
+func clearDeadlines(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+}
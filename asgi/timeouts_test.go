@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+func TestParseClientTimeout(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+		want   time.Duration
+		err    error
+	}{
+		{"X-Timeout-Ms", "250", 250 * time.Millisecond, nil},
+		{"X-Timeout-Ms", " 40 ", 40 * time.Millisecond, nil},
+		{"X-Timeout-Ms", "0", 0, errMalformedTimeout},
+		{"X-Timeout-Ms", "-5", 0, errMalformedTimeout},
+		{"X-Timeout-Ms", "1.5", 0, errMalformedTimeout},
+		{"X-Timeout-Ms", "soon", 0, errMalformedTimeout},
+		{"X-Timeout-Ms", "9223372036854775807", math.MaxInt64, nil},
+		{"Grpc-Timeout", "100m", 100 * time.Millisecond, nil},
+		{"Grpc-Timeout", "5S", 5 * time.Second, nil},
+		{"Grpc-Timeout", "2H", 2 * time.Hour, nil},
+		{"Grpc-Timeout", "99999999H", math.MaxInt64, nil},
+		{"Grpc-Timeout", "100", 0, errMalformedTimeout},
+		{"Grpc-Timeout", "m", 0, errMalformedTimeout},
+		{"Grpc-Timeout", "100x", 0, errMalformedTimeout},
+		{"Grpc-Timeout", "123456789m", 0, errMalformedTimeout},
+	}
+	for _, tt := range tests {
+		got, err := parseClientTimeout(tt.header, tt.value)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("parseClientTimeout(%q, %q) = %v, %v, want %v, %v", tt.header, tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+// useClientTimeoutHeader honors the named timeout header, up to max, until
+// the test ends
+func useClientTimeoutHeader(t *testing.T, name string, max time.Duration) {
+	t.Helper()
+	clientTimeoutHeader.Store(&name)
+	clientTimeoutMax.Store(int64(max))
+	t.Cleanup(func() { clientTimeoutHeader.Store(nil) })
+}
+
+func TestClientTimeoutHeader(t *testing.T) {
+	useClientTimeoutHeader(t, "X-Timeout-Ms", 50*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	err := marily.Handle("/client-timeout", func(marily.Event) marily.Response {
+		<-release
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/client-timeout")
+
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{"honored", "10", http.StatusGatewayTimeout},
+		// Clamped to 50ms rather than an hour
+		{"clamped", "3600000", http.StatusGatewayTimeout},
+		{"malformed", "soon", http.StatusBadRequest},
+		{"zero", "0", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/client-timeout", nil)
+		r.Header.Set("X-Timeout-Ms", tt.value)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		dispatch(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: took %v, the client timeout was not applied", tt.name, elapsed)
+		}
+	}
+
+	// Without the header the route timeout applies
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if got, err := requestTimeout(r, time.Minute); got != time.Minute || err != nil {
+		t.Errorf("no header: requestTimeout = %v, %v, want 1m0s", got, err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// parseTraceparent splits a W3C traceparent header into its trace ID and
+// flags, reporting whether the header is well formed
+func parseTraceparent(traceparent string) (traceId, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	// Only version 00 is fully specified, later versions may append fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false
+	}
+	for _, part := range parts[:4] {
+		if _, err := hex.DecodeString(part); err != nil || strings.ToLower(part) != part {
+			return "", "", false
+		}
+	}
+	// All-zero trace and parent IDs are invalid
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+// childTraceparent returns a traceparent for a new span under the given
+// parent. When the parent is missing or malformed a new trace is started.
+func childTraceparent(parent string) string {
+	traceId, flags, ok := parseTraceparent(parent)
+	if !ok {
+		traceId, flags = randomHex(16), "00"
+	}
+	return "00-" + traceId + "-" + randomHex(8) + "-" + flags
+}
+
+// randomHex returns n random bytes encoded as lowercase hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//export GenerateChildTraceparent
+func GenerateChildTraceparent(parent *C.char) *C.char {
+	return C.CString(childTraceparent(C.GoString(parent)))
+}
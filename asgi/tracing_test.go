@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/marily"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		traceId string
+		flags   string
+		ok      bool
+	}{
+		{testTraceparent, "4bf92f3577b34da6a3ce929d0e0e4736", "01", true},
+		// Later versions may append fields
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra", "4bf92f3577b34da6a3ce929d0e0e4736", "00", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", "", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", "", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		traceId, flags, ok := parseTraceparent(tt.header)
+		if traceId != tt.traceId || flags != tt.flags || ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) = %q, %q, %t, want %q, %q, %t",
+				tt.header, traceId, flags, ok, tt.traceId, tt.flags, tt.ok)
+		}
+	}
+}
+
+func TestChildTraceparent(t *testing.T) {
+	child := childTraceparent(testTraceparent)
+	traceId, flags, ok := parseTraceparent(child)
+	if !ok || traceId != "4bf92f3577b34da6a3ce929d0e0e4736" || flags != "01" {
+		t.Errorf("child %q does not continue the parent's trace", child)
+	}
+	if child[36:52] == "00f067aa0ba902b7" {
+		t.Errorf("child %q reuses the parent's span ID", child)
+	}
+
+	// A malformed parent starts a new trace
+	if _, _, ok := parseTraceparent(childTraceparent("garbage")); !ok {
+		t.Error("new trace has a malformed traceparent")
+	}
+}
+
+func TestEventTraceparent(t *testing.T) {
+	var got string
+	err := marily.Handle("/traced", func(ev marily.Event) marily.Response {
+		got = ev.Traceparent
+		return marily.Response{}
+	})
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	defer unregisterRoute("/traced")
+
+	r := httptest.NewRequest(http.MethodGet, "/traced", nil)
+	r.Header.Set("traceparent", testTraceparent)
+	dispatch(httptest.NewRecorder(), r)
+	if traceId, _, ok := parseTraceparent(got); !ok || traceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("event traceparent %q is not a child of the request's", got)
+	}
+}
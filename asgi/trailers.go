@@ -0,0 +1,39 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import "net/http"
+
+// asgiResponseTrailers returns the trailers of a response as name/value pairs
+func asgiResponseTrailers(response *C.asgi_response) [][2]string {
+	return asgiHeaderPairs(response.trailers, response.trailers_count)
+}
+
+// declareTrailers lists the trailer names in the Trailer header. It must run
+// before WriteHeader. Trailers need a chunked body, so a Content-Length set
+// by the callback is dropped.
+func declareTrailers(w http.ResponseWriter, trailers [][2]string) {
+	if len(trailers) == 0 {
+		return
+	}
+	declared := make(map[string]bool, len(trailers))
+	for _, t := range trailers {
+		name := http.CanonicalHeaderKey(t[0])
+		if !declared[name] {
+			declared[name] = true
+			w.Header().Add("Trailer", name)
+		}
+	}
+	w.Header().Del("Content-Length")
+}
+
+// setTrailers sets the trailer values once the body has been written.
+// net/http sends header values that were declared in Trailer, or that carry
+// the TrailerPrefix, after the body. The prefix covers names first seen on
+// the last chunk of a streamed response, after the header block went out.
+func setTrailers(w http.ResponseWriter, trailers [][2]string) {
+	for _, t := range trailers {
+		w.Header().Add(http.TrailerPrefix+t[0], t[1])
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// When set, upgrades to unsupported protocols get a 426 instead of being
+	// served as plain requests
+	rejectUnsupportedUpgrades atomic.Bool
+
+	// Lowercased Upgrade tokens the server can perform, guarded by upgradeProtocolsMu
+	upgradeProtocolsMu sync.RWMutex
+	upgradeProtocols   = map[string]bool{}
+)
+
+//export SetUpgradeBehavior
+func SetUpgradeBehavior(behavior *C.char) *C.char {
+	switch name := C.GoString(behavior); name {
+	case "reject":
+		rejectUnsupportedUpgrades.Store(true)
+	case "ignore":
+		rejectUnsupportedUpgrades.Store(false)
+	default:
+		return C.CString(fmt.Sprintf("Unknown upgrade behavior: %s (expected reject or ignore)", name))
+	}
+	return C.CString(fmt.Sprintf("Unsupported upgrades are now handled with: %s", C.GoString(behavior)))
+}
+
+// enableUpgradeProtocol marks an Upgrade token as supported by the server
+func enableUpgradeProtocol(protocol string) {
+	upgradeProtocolsMu.Lock()
+	upgradeProtocols[strings.ToLower(protocol)] = true
+	upgradeProtocolsMu.Unlock()
+}
+
+// requestedUpgrades returns the lowercased protocols an upgrade request asks
+// for, or nil when the request is not an upgrade request
+func requestedUpgrades(r *http.Request) []string {
+	if r.ProtoMajor != 1 || !headerHasToken(r.Header, "Connection", "upgrade") {
+		return nil
+	}
+	var protocols []string
+	for _, line := range r.Header.Values("Upgrade") {
+		for _, protocol := range strings.Split(line, ",") {
+			// Drop the version, e.g. "websocket/13"
+			name, _, _ := strings.Cut(strings.TrimSpace(protocol), "/")
+			if name != "" {
+				protocols = append(protocols, strings.ToLower(name))
+			}
+		}
+	}
+	return protocols
+}
+
+// headerHasToken reports whether a comma-separated header contains token
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, line := range header.Values(name) {
+		for _, value := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(value), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleUnsupportedUpgrade answers upgrade requests for protocols the server
+// cannot perform with 426 when configured to reject them. Requests for
+// supported protocols, and all requests in ignore mode, continue to routing.
+func handleUnsupportedUpgrade(w http.ResponseWriter, r *http.Request) bool {
+	protocols := requestedUpgrades(r)
+	if len(protocols) == 0 || !rejectUnsupportedUpgrades.Load() {
+		return false
+	}
+
+	upgradeProtocolsMu.RLock()
+	defer upgradeProtocolsMu.RUnlock()
+
+	if slices.ContainsFunc(protocols, func(p string) bool { return upgradeProtocols[p] }) {
+		return false
+	}
+
+	// 426 must list the protocols the server would accept
+	supported := slices.Sorted(maps.Keys(upgradeProtocols))
+	if len(supported) > 0 {
+		w.Header().Set("Upgrade", strings.Join(supported, ", "))
+		w.Header().Set("Connection", "Upgrade")
+	}
+	writeError(w, http.StatusUpgradeRequired, fmt.Sprintf("Upgrade to %s is not supported", strings.Join(protocols, ", ")))
+	return true
+}
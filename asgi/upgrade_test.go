@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// rejectUpgrades answers unsupported upgrades with 426 until the test ends
+func rejectUpgrades(t *testing.T) {
+	rejectUnsupportedUpgrades.Store(true)
+	t.Cleanup(func() { rejectUnsupportedUpgrades.Store(false) })
+}
+
+// upgradeRequest asks for an upgrade to protocols
+func upgradeRequest(protocols string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/upgrade", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", protocols)
+	return r
+}
+
+func TestRequestedUpgrades(t *testing.T) {
+	r := upgradeRequest("WebSocket/13, foo")
+	if got := requestedUpgrades(r); strings.Join(got, ",") != "websocket,foo" {
+		t.Errorf("requestedUpgrades = %q, want [websocket foo]", got)
+	}
+
+	// Upgrade only counts when Connection lists it
+	r.Header.Set("Connection", "keep-alive")
+	if got := requestedUpgrades(r); got != nil {
+		t.Errorf("without Connection: upgrade, requestedUpgrades = %q", got)
+	}
+}
+
+func TestUnsupportedUpgrade(t *testing.T) {
+	handleBody(t, "/upgrade", "plain")
+	rejectUpgrades(t)
+
+	// An unrecognized token is refused, listing the supported ones
+	w := httptest.NewRecorder()
+	dispatch(w, upgradeRequest("foo/2"))
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("foo: got %d, want 426", w.Code)
+	}
+	if got := w.Header().Get("Upgrade"); got != "websocket" {
+		t.Errorf("foo: Upgrade = %q, want websocket", got)
+	}
+
+	// Without h2c enabled, an h2c upgrade is unsupported as well
+	w = httptest.NewRecorder()
+	dispatch(w, upgradeRequest("h2c"))
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("h2c: got %d, want 426", w.Code)
+	}
+
+	// A recognized token among others goes on to the route
+	w = httptest.NewRecorder()
+	dispatch(w, upgradeRequest("foo, websocket"))
+	if w.Code == http.StatusUpgradeRequired {
+		t.Error("foo, websocket: refused an upgrade the server supports")
+	}
+
+	// In ignore mode the upgrade is served as a plain request
+	rejectUnsupportedUpgrades.Store(false)
+	w = httptest.NewRecorder()
+	dispatch(w, upgradeRequest("foo"))
+	if w.Code != http.StatusOK || w.Body.String() != "plain" {
+		t.Errorf("ignored foo: got %d %q, want 200 %q", w.Code, w.Body.String(), "plain")
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	handleBody(t, "/upgrade", "plain")
+	rejectUpgrades(t)
+	h2cEnabled.Store(true)
+	defer h2cEnabled.Store(false)
+
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = newHTTPServer("")
+	applyH2C(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /upgrade HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 101 ") {
+		t.Errorf("h2c upgrade answered %q, want 101 Switching Protocols", strings.TrimSpace(status))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// #include "asgi_structs.h"
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"unicode/utf8"
+	"unsafe"
+)
+
+var (
+	// When set, header values must be valid UTF-8 in both directions
+	validateHeaderUTF8 atomic.Bool
+	// Longest request header line accepted, 0 when only the server-wide
+	// header size limit applies
+	maxHeaderLineBytes atomic.Int64
+)
+
+//export SetValidateHeaderUTF8
+func SetValidateHeaderUTF8(enabled bool) *C.char {
+	validateHeaderUTF8.Store(enabled)
+	return C.CString(fmt.Sprintf("Header UTF-8 validation enabled: %t", enabled))
+}
+
+//export SetMaxHeaderLineBytes
+func SetMaxHeaderLineBytes(n int) *C.char {
+	if n < 0 {
+		return C.CString("Max header line bytes must be >= 0")
+	}
+	maxHeaderLineBytes.Store(int64(n))
+	if n == 0 {
+		return C.CString("Max header line bytes disabled")
+	}
+	return C.CString(fmt.Sprintf("Max header line bytes set to %d", n))
+}
+
+// checkRequestHeaderLines reports the first request header whose line, name
+// and value, is longer than the configured limit. Running it before the
+// headers are converted bounds the largest C allocation made per header.
+func checkRequestHeaderLines(headers http.Header) error {
+	limit := int(maxHeaderLineBytes.Load())
+	if limit == 0 {
+		return nil
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			// "Name: value"
+			if len(name)+2+len(value) > limit {
+				return fmt.Errorf("header %s exceeds %d bytes", name, limit)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRequestHeadersUTF8 reports the first request header whose value is
+// not valid UTF-8, when validation is enabled
+func checkRequestHeadersUTF8(headers http.Header) error {
+	if !validateHeaderUTF8.Load() {
+		return nil
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			if !utf8.ValidString(value) {
+				return fmt.Errorf("header %s is not valid UTF-8", name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkResponseHeadersUTF8 reports the first response header whose value is
+// not valid UTF-8, when validation is enabled
+func checkResponseHeadersUTF8(response *C.asgi_response) error {
+	if !validateHeaderUTF8.Load() {
+		return nil
+	}
+	for i := 0; i < int(response.headers_count); i++ {
+		header := (*C.asgi_header)(unsafe.Pointer(uintptr(unsafe.Pointer(response.headers)) +
+			uintptr(i)*unsafe.Sizeof(C.asgi_header{})))
+		value := C.GoStringN(header.value.data, C.int(header.value.length))
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("header %s is not valid UTF-8", C.GoStringN(header.name.data, C.int(header.name.length)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pankgeorg/asgi-go/internal/cfixtures"
+)
+
+func TestInvalidUTF8RequestHeaders(t *testing.T) {
+	handleCallback(t, "/utf8", cfixtures.EchoPathCallback())
+	validateHeaderUTF8.Store(true)
+	defer validateHeaderUTF8.Store(false)
+
+	for _, value := range []string{"\xff", "caf\xc3", "\xed\xa0\x80", "ok \xc0\xaf"} {
+		r := httptest.NewRequest(http.MethodGet, "/utf8", nil)
+		r.Header.Set("X-Name", value)
+		w := httptest.NewRecorder()
+		dispatch(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("header value %q: got %d, want 400", value, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/utf8", nil)
+	r.Header.Set("X-Name", "café ☕")
+	w := httptest.NewRecorder()
+	dispatch(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("valid UTF-8 header: got %d, want 200", w.Code)
+	}
+
+	// Validation is opt-in
+	validateHeaderUTF8.Store(false)
+	r.Header.Set("X-Name", "\xff")
+	w = httptest.NewRecorder()
+	dispatch(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("invalid header without validation: got %d, want 200", w.Code)
+	}
+}
+
+func TestInvalidUTF8ResponseHeaders(t *testing.T) {
+	validateHeaderUTF8.Store(true)
+	defer validateHeaderUTF8.Store(false)
+
+	response := newAsgiResponse("utf8", http.StatusOK, [][2]string{{"X-Name", "\xfe\xff"}}, []byte("body"))
+	defer freeAsgiResponse(response)
+	w := httptest.NewRecorder()
+	if writeResponseFromC(w, httptest.NewRequest(http.MethodGet, "/", nil), response) {
+		t.Error("response with an invalid header written")
+	}
+	if w.Code != http.StatusInternalServerError || w.Header().Get("X-Name") != "" {
+		t.Errorf("got %d with X-Name %q, want a bare 500", w.Code, w.Header().Get("X-Name"))
+	}
+}
+
+func TestOversizedHeaderLine(t *testing.T) {
+	handleCallback(t, "/header-line", cfixtures.EchoPathCallback())
+	maxHeaderLineBytes.Store(8192)
+	defer maxHeaderLineBytes.Store(0)
+
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		// "X-Big: " takes 7 of the 8192 bytes
+		{"at the limit", strings.Repeat("a", 8192-7), http.StatusOK},
+		{"one byte over", strings.Repeat("a", 8192-6), http.StatusRequestHeaderFieldsTooLarge},
+		{"enormous", strings.Repeat("a", 4<<20), http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/header-line", nil)
+		r.Header.Set("X-Big", tt.value)
+		w := httptest.NewRecorder()
+		dispatch(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+// #include <stdlib.h>
+// #include "asgi_structs.h"
+//
+// // C helper function that calls the callback with a WebSocket event safely
+// static inline asgi_response* call_websocket_callback(asgi_callback_fn callback, asgi_event* event) {
+//     if (callback == NULL) return NULL;
+//     return callback(event);
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to send a close or ping frame
+	websocketCloseTimeout = time.Second
+	// Keepalive defaults: a ping every 30s, answered within 10s
+	defaultWebSocketPingInterval = 30 * time.Second
+	defaultWebSocketPongTimeout  = 10 * time.Second
+)
+
+var (
+	// Interval between pings on an open WebSocket, 0 when disabled
+	websocketPingInterval atomic.Int64
+	// How long after a ping a connection may stay silent before it is closed
+	websocketPongTimeout atomic.Int64
+)
+
+// The callback decides on the origin in websocket.connect
+var websocketUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func init() {
+	enableUpgradeProtocol("websocket")
+	websocketPingInterval.Store(int64(defaultWebSocketPingInterval))
+	websocketPongTimeout.Store(int64(defaultWebSocketPongTimeout))
+}
+
+// SetWebSocketKeepalive sets how often open WebSockets are pinged and how
+// long a connection may then stay silent, neither a pong nor a message,
+// before it is closed. A ping interval of 0 turns keepalive off. It applies
+// to connections opened afterwards.
+//
+//export SetWebSocketKeepalive
+func SetWebSocketKeepalive(pingIntervalMs int, pongTimeoutMs int) *C.char {
+	if pingIntervalMs < 0 || pongTimeoutMs <= 0 {
+		return C.CString("Ping interval must be >= 0 and pong timeout > 0")
+	}
+	interval := time.Duration(pingIntervalMs) * time.Millisecond
+	timeout := time.Duration(pongTimeoutMs) * time.Millisecond
+	websocketPingInterval.Store(int64(interval))
+	websocketPongTimeout.Store(int64(timeout))
+	if interval == 0 {
+		return C.CString("WebSocket keepalive disabled")
+	}
+	return C.CString(fmt.Sprintf("WebSocket keepalive set to a ping every %v, answered within %v", interval, timeout))
+}
+
+// selectSubprotocol keeps the subprotocol chosen in the handshake headers
+// only when the client offered it, as the protocol requires
+func selectSubprotocol(r *http.Request, handshakeHeaders http.Header) {
+	chosen := handshakeHeaders.Get("Sec-Websocket-Protocol")
+	if chosen == "" {
+		return
+	}
+	if !slices.Contains(websocket.Subprotocols(r), chosen) {
+		fmt.Printf("Dropping WebSocket subprotocol %q not offered by the client for %s\n", chosen, r.URL.Path)
+		handshakeHeaders.Del("Sec-Websocket-Protocol")
+	}
+}
+
+// isWebSocketUpgrade reports whether the request asks for a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r)
+}
+
+// callWebSocketCallback sends one WebSocket event to the callback and waits
+// up to timeout for its response, reporting false when the callback did not
+// answer in time. The event belongs to the callback from then on, and a
+// response arriving after the timeout is freed.
+func callWebSocketCallback(callback C.asgi_callback_fn, event *C.asgi_event, timeout time.Duration) (*C.asgi_response, bool) {
+	responseChan := make(chan *C.asgi_response, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("Panic in WebSocket callback: %v\n%s", p, debug.Stack())
+				responseChan <- nil
+			}
+		}()
+		executingRequests.Add(1)
+		defer executingRequests.Add(-1)
+		responseChan <- C.call_websocket_callback(callback, event)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-responseChan:
+		return response, true
+	case <-timer.C:
+		go freeLateResponse(responseChan)
+		return nil, false
+	}
+}
+
+// serveWebSocket drives a WebSocket connection through the callback: it asks
+// websocket.connect whether to accept, then sends every received frame as
+// websocket.receive and finally websocket.disconnect. Each callback call
+// gets up to timeout to answer. The caller's request slot is held until the
+// connection is closed.
+func serveWebSocket(w http.ResponseWriter, r *http.Request, callback C.asgi_callback_fn, requestId string, stopping <-chan struct{}, timeout time.Duration) {
+	// An upgrade request has no body of its own
+	r.Body = http.NoBody
+
+	response, ok := callWebSocketCallback(callback, newAsgiEvent(r, requestId, "websocket.connect", nil), timeout)
+	if !ok {
+		writeError(w, http.StatusGatewayTimeout, "WebSocket connection timed out")
+		return
+	}
+	if response == nil {
+		writeError(w, http.StatusForbidden, "WebSocket connection rejected")
+		return
+	}
+	status := int(response.status)
+	if status != http.StatusSwitchingProtocols && status != http.StatusOK {
+		freeAsgiResponse(response)
+		if status < 400 || status > 599 {
+			status = http.StatusForbidden
+		}
+		writeError(w, status, "WebSocket connection rejected")
+		return
+	}
+	handshakeHeaders := http.Header{}
+	for _, header := range asgiResponseHeaders(response) {
+		handshakeHeaders.Add(header[0], header[1])
+	}
+	freeAsgiResponse(response)
+	selectSubprotocol(r, handshakeHeaders)
+
+	// The upgrader answers failed handshakes itself
+	conn, err := websocketUpgrader.Upgrade(w, r, handshakeHeaders)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// A socket lives well past the request timeouts
+	clearDeadlines(conn.NetConn())
+	// Messages are held to the size limit of request bodies
+	if limit := maxRequestBodySize.Load(); limit > 0 {
+		conn.SetReadLimit(limit)
+	}
+
+	// With keepalive on, a connection silent for a ping interval and the
+	// pong timeout fails the read below. The silence counts from each time
+	// the loop waits for a frame, so a slow callback is not held against the
+	// client, and a pong restarts it.
+	pingInterval := time.Duration(websocketPingInterval.Load())
+	silenceLimit := pingInterval + time.Duration(websocketPongTimeout.Load())
+	extendReadDeadline := func() {
+		if pingInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(silenceLimit))
+		}
+	}
+	conn.SetPongHandler(func(string) error {
+		extendReadDeadline()
+		return nil
+	})
+
+	// Going away when the server shuts down ends the read loop below, and so
+	// does a ping that cannot be sent
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var pings <-chan time.Time
+		if pingInterval > 0 {
+			ticker := time.NewTicker(pingInterval)
+			defer ticker.Stop()
+			pings = ticker.C
+		}
+		for {
+			select {
+			case <-stopping:
+				closeWebSocket(conn, websocket.CloseGoingAway, "")
+				return
+			case <-pings:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketCloseTimeout)); err != nil {
+					conn.NetConn().Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	closeCode := websocket.CloseNormalClosure
+	for {
+		extendReadDeadline()
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			closeCode = websocket.CloseAbnormalClosure
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				closeCode = closeErr.Code
+			}
+			break
+		}
+
+		event := newAsgiEvent(r, requestId, "websocket.receive", data)
+		event.body_is_text = C.bool(messageType == websocket.TextMessage)
+		response, ok := callWebSocketCallback(callback, event, timeout)
+		if !ok {
+			closeCode = websocket.CloseInternalServerErr
+			closeWebSocket(conn, closeCode, "Callback timed out")
+			break
+		}
+		if response == nil {
+			continue
+		}
+		code, closing, err := replyToWebSocket(conn, messageType, response)
+		freeAsgiResponse(response)
+		if closing || err != nil {
+			closeCode = code
+			break
+		}
+	}
+
+	disconnect := newAsgiEvent(r, requestId, "websocket.disconnect", []byte(strconv.Itoa(closeCode)))
+	disconnect.body_is_text = C.bool(true)
+	if response, _ := callWebSocketCallback(callback, disconnect, timeout); response != nil {
+		freeAsgiResponse(response)
+	}
+}
+
+// replyToWebSocket carries out the callback's response to a received frame.
+// It reports whether the response closed the connection, and with what code.
+func replyToWebSocket(conn *websocket.Conn, receivedType int, response *C.asgi_response) (int, bool, error) {
+	var body []byte
+	if response.body != nil && response.body_length > 0 {
+		body = C.GoBytes(unsafe.Pointer(response.body), C.int(response.body_length))
+	}
+
+	if status := int(response.status); status >= 1000 && status <= 4999 {
+		closeWebSocket(conn, status, string(body))
+		return status, true, nil
+	}
+	if len(body) == 0 {
+		return 0, false, nil
+	}
+
+	messageType := receivedType
+	if contentType := responseHeader(response, "Content-Type"); contentType != "" {
+		messageType = websocket.BinaryMessage
+		if strings.HasPrefix(strings.ToLower(contentType), "text/") {
+			messageType = websocket.TextMessage
+		}
+	}
+	if err := conn.WriteMessage(messageType, body); err != nil {
+		return websocket.CloseAbnormalClosure, false, err
+	}
+	return 0, false, nil
+}
+
+// closeWebSocket sends a close frame. The reader sees the peer's reply, or
+// the connection closing, and ends the loop.
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(websocketCloseTimeout))
+}
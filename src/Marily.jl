@@ -1,17 +1,28 @@
 module Marily
 
-export start_server, stop_server, register_event_handler, register_path_handler, run_server
+export start_server, stop_server, register_event_handler, register_path_handler, register_pattern_handler, register_prefix_handler, register_static_dir, register_lifespan_handler, stream_response_chunk, run_server, FileBody, RangedBody
 
 # Load the shared object file
 const libpath = joinpath(@__DIR__, "../asgi/libasgi.so")
 
-# Global storage for the event handler callbacks
-global event_handlers = Dict{String,Function}()
-global event_callback_ptrs = Dict{String,Ptr{Cvoid}}()
+# Global storage for the event handler callbacks. Go keeps registrations
+# across stop_server and start_server, so the C function pointers handed to it
+# must stay alive as long as the registration does.
+global event_handlers = Dict{String,Any}()
+global event_callback_ptrs = Dict{String,Base.CFunction}()
 
 # Thread safety for callback registration
 const callback_lock = ReentrantLock()
 
+# Keep a callback alive under key, replacing the one registered before it
+function keep_callback!(key::String, handler, c_handler::Base.CFunction)
+    lock(callback_lock) do
+        event_handlers[key] = handler
+        event_callback_ptrs[key] = c_handler
+    end
+    return c_handler
+end
+
 # Define the C struct types to match asgi_structs.h exactly
 struct AsgiString
     data::Ptr{Cchar}
@@ -35,7 +46,19 @@ struct AsgiEvent
     server::Ptr{AsgiString}
     body::Ptr{Cuchar}
     body_length::Csize_t
-    more_body::Cint
+    more_body::Bool
+    traceparent::AsgiString
+    http_version::AsgiString
+    request_target::AsgiString
+    type::AsgiString
+    body_is_text::Bool
+    path_params::Ptr{AsgiHeader}
+    path_params_count::Csize_t
+    query_params::Ptr{AsgiHeader}
+    query_params_count::Csize_t
+    content_length::Int64
+    subprotocols::Ptr{AsgiString}
+    subprotocols_count::Csize_t
 end
 
 struct AsgiResponse
@@ -45,6 +68,34 @@ struct AsgiResponse
     headers_count::Csize_t
     body::Ptr{Cuchar}
     body_length::Csize_t
+    more_body::Bool
+    trailers::Ptr{AsgiHeader}
+    trailers_count::Csize_t
+    file_path::AsgiString
+    honor_range::Bool
+end
+
+"""
+    FileBody(path::String)
+
+A response body read from the file at path by the server, e.g.
+`return (200, headers, FileBody("/srv/video.mp4"))`. With status 200, Range
+and conditional requests are answered and Content-Type follows the extension.
+"""
+struct FileBody
+    path::String
+end
+
+"""
+    RangedBody(body)
+
+A complete response body the server may slice for a `Range: bytes=...`
+request, answering 206 with Content-Range, e.g.
+`return (200, headers, RangedBody(bytes))`. Handlers that answer ranges
+themselves return the body as is.
+"""
+struct RangedBody
+    body::Union{String,Vector{UInt8}}
 end
 
 function __init__()
@@ -75,6 +126,11 @@ function make_asgi_string(str::String)
     return AsgiString(convert(Ptr{Cchar}, data), length(bytes))
 end
 
+# Release a status string returned by the library
+function free_cstring(str::Cstring)
+    ccall((:FreeCString, libpath), Cvoid, (Cstring,), str)
+end
+
 # Helper to read an AsgiString to a Julia String
 function read_asgi_string(str::AsgiString)
     if str.data == C_NULL || str.length == 0
@@ -118,7 +174,7 @@ function make_asgi_headers(headers::Dict)
 end
 
 # Helper to create an AsgiResponse
-function make_asgi_response(request_id::String, status::Int, headers::Dict, body::Vector{UInt8})
+function make_asgi_response(request_id::String, status::Int, headers::Dict, body::Vector{UInt8}; more_body::Bool=false, trailers::Dict=Dict(), file_path::String="", honor_range::Bool=false)
     # Create the response struct
     response_ptr = Base.Libc.malloc(sizeof(AsgiResponse))
 
@@ -153,6 +209,22 @@ function make_asgi_response(request_id::String, status::Int, headers::Dict, body
         unsafe_store!(Ptr{Csize_t}(response_ptr + body_length_offset), Csize_t(0))
     end
 
+    # Set more_body
+    more_body_offset = fieldoffset(AsgiResponse, 7)
+    unsafe_store!(Ptr{Bool}(response_ptr + more_body_offset), more_body)
+
+    # Set trailers
+    trailers_ptr, trailers_count = make_asgi_headers(trailers)
+    unsafe_store!(Ptr{Ptr{AsgiHeader}}(response_ptr + fieldoffset(AsgiResponse, 8)), trailers_ptr)
+    unsafe_store!(Ptr{Csize_t}(response_ptr + fieldoffset(AsgiResponse, 9)), trailers_count)
+
+    # Set the file the body is read from, if any
+    file_path_asgi = isempty(file_path) ? AsgiString(C_NULL, 0) : make_asgi_string(file_path)
+    unsafe_store!(Ptr{AsgiString}(response_ptr + fieldoffset(AsgiResponse, 10)), file_path_asgi)
+
+    # Set whether the server may answer Range requests from the body
+    unsafe_store!(Ptr{Bool}(response_ptr + fieldoffset(AsgiResponse, 11)), honor_range)
+
     return convert(Ptr{AsgiResponse}, response_ptr)
 end
 
@@ -170,6 +242,7 @@ function process_event_callback(handler)
 
             # Extract path to determine which handler to use
             path = read_asgi_string(event.path)
+            event_type = read_asgi_string(event.type)
 
             # Find the appropriate handler for this path
 
@@ -181,6 +254,23 @@ function process_event_callback(handler)
 
             # Extract fields from the event
             request_id = read_asgi_string(event.request_id)
+
+            # Lifespan events carry no request
+            if startswith(event_type, "lifespan.")
+                response = handler(Dict(
+                    "type" => event_type,
+                    "request_id" => request_id,
+                    "scope" => Dict("type" => "lifespan")
+                ))
+                if response === nothing
+                    return C_NULL
+                end
+                status, headers, body = response
+                if body isa String
+                    body = Vector{UInt8}(body)
+                end
+                return make_asgi_response(request_id, status, headers, body)
+            end
             method = read_asgi_string(event.method)
             query_string = read_asgi_string(event.query_string)
             scheme = read_asgi_string(event.scheme)
@@ -199,6 +289,23 @@ function process_event_callback(handler)
                 push!(headers[name], value)
             end
 
+            # Extract the segments captured by the route pattern
+            path_params = Dict{String,String}()
+            for i in 0:(Int(event.path_params_count)-1)
+                param = unsafe_load(event.path_params + i * sizeof(AsgiHeader))
+                path_params[read_asgi_string(param.name)] = read_asgi_string(param.value)
+            end
+
+            # Extract the decoded query parameters, repeated names included
+            query_params = Dict{String,Vector{String}}()
+            for i in 0:(Int(event.query_params_count)-1)
+                param = unsafe_load(event.query_params + i * sizeof(AsgiHeader))
+                push!(get!(query_params, read_asgi_string(param.name), String[]), read_asgi_string(param.value))
+            end
+
+            # Extract the WebSocket subprotocols offered by the client
+            subprotocols = [read_asgi_string(unsafe_load(event.subprotocols, i)) for i in 1:Int(event.subprotocols_count)]
+
             # Extract client and server info
             client = ["unknown", "0"]
             if event.client != C_NULL
@@ -222,29 +329,46 @@ function process_event_callback(handler)
                 body = copy(body)
             end
 
+            # websocket.* events share the request's scope
+            is_websocket = startswith(event_type, "websocket.")
+
             # Build scope
             scope = Dict(
-                "type" => "http",
-                "http_version" => "1.1",
+                "type" => is_websocket ? "websocket" : "http",
+                "http_version" => read_asgi_string(event.http_version),
                 "method" => method,
                 "scheme" => scheme,
                 "path" => path,
+                "path_params" => path_params,
                 "query_string" => query_string,
+                "query_params" => query_params,
+                "content_length" => event.content_length < 0 ? nothing : Int(event.content_length),
+                "subprotocols" => subprotocols,
+                "request_target" => read_asgi_string(event.request_target),
                 "headers" => headers,
                 "client" => client,
                 "server" => server
             )
 
             # Build message
-            message = Dict(
-                "body" => body,
-                "more_body" => event.more_body !== Cint(0)
-            )
+            if event_type == "websocket.receive"
+                message = event.body_is_text ? Dict("text" => String(body)) : Dict("bytes" => body)
+            elseif event_type == "websocket.disconnect"
+                message = Dict("code" => parse(Int, String(body)))
+            elseif is_websocket || event_type == "http.disconnect" || event_type == "http.expect"
+                message = Dict{String,Any}()
+            else
+                message = Dict(
+                    "body" => body,
+                    "more_body" => event.more_body
+                )
+            end
 
             # Build event object
             event_obj = Dict(
-                "type" => "http.request",
+                "type" => event_type,
                 "request_id" => request_id,
+                "traceparent" => read_asgi_string(event.traceparent),
                 "scope" => scope,
                 "message" => message
             )
@@ -257,16 +381,29 @@ function process_event_callback(handler)
                 return C_NULL
             end
 
-            # Extract response components
+            # Extract response components. A fourth element set to true
+            # starts a streamed response, continued with stream_response_chunk.
+            # A fifth element holds the trailers sent after the body.
             status, headers, body = response
-
-            # Convert body to vector of bytes if it's a string
-            if body isa String
+            more_body = length(response) > 3 && response[4]
+            trailers = length(response) > 4 ? response[5] : Dict()
+
+            # Convert body to vector of bytes if it's a string, and let the
+            # server read a FileBody itself and slice a RangedBody
+            file_path = ""
+            honor_range = body isa RangedBody
+            if honor_range
+                body = body.body
+            end
+            if body isa FileBody
+                file_path = body.path
+                body = UInt8[]
+            elseif body isa String
                 body = Vector{UInt8}(body)
             end
 
             # Create and return the response
-            return make_asgi_response(request_id, status, headers, body)
+            return make_asgi_response(request_id, status, headers, body; more_body=more_body, trailers=trailers, file_path=file_path, honor_range=honor_range)
 
         catch e
             # Handle any errors in the callback
@@ -278,6 +415,25 @@ function process_event_callback(handler)
     end
 end
 
+"""
+    stream_response_chunk(request_id::String, body; more_body::Bool=true, trailers::Dict=Dict())
+
+Send the next body chunk of a streamed response, started by returning
+(status, headers, body, true) from the handler. The last chunk sets
+more_body=false and may carry the trailers sent after the body.
+"""
+function stream_response_chunk(request_id::String, body; more_body::Bool=true, trailers::Dict=Dict())
+    if body isa String
+        body = Vector{UInt8}(body)
+    end
+    chunk = make_asgi_response(request_id, 0, Dict(), body; more_body=more_body, trailers=trailers)
+    result = ccall((:StreamResponseChunk, libpath), Cstring, (Cstring, Ptr{AsgiResponse}), request_id, chunk)
+
+    message = unsafe_string(result)
+    free_cstring(result)
+    return message
+end
+
 """
     register_path_handler(path::String, handler::Function)
 
@@ -285,8 +441,9 @@ Register a callback function for a specific path.
 The handler should accept an event and return a tuple of (status, headers, body) or nothing.
 
 Path can end with /* to match all paths with that prefix.
+A positive timeout_ms replaces the default callback timeout for this path.
 """
-function register_path_handler(path::String, handler)
+function register_path_handler(path::String, handler; timeout_ms::Int=0)
 
     # Warning! If the function is not precompiled,
     # calling it _twice_ from go will lead to either a segmentation
@@ -295,15 +452,99 @@ function register_path_handler(path::String, handler)
     # nonetheless
 
     precompile(handler, (Ptr{AsgiEvent},))
-    c_handler = @cfunction($handler, Ptr{AsgiResponse}, (Ptr{AsgiEvent},))
+    c_handler = keep_callback!(path, handler, @cfunction($handler, Ptr{AsgiResponse}, (Ptr{AsgiEvent},)))
     # Register the callback with Go for this path
     path_cstr = Base.unsafe_convert(Cstring, Base.cconvert(Cstring, path))
-    result = ccall((:RegisterEventCallback, libpath), Cstring,
+    if timeout_ms > 0
+        result = ccall((:RegisterEventCallbackWithTimeout, libpath), Cstring,
+            (Cstring, Ptr{Cvoid}, Int),
+            path_cstr, c_handler, timeout_ms)
+    else
+        result = ccall((:RegisterEventCallback, libpath), Cstring,
+            (Cstring, Ptr{Cvoid}),
+            path_cstr, c_handler)
+    end
+
+    message = unsafe_string(result)
+    free_cstring(result)
+    @info message
+    return message
+end
+
+"""
+    register_pattern_handler(pattern::String, handler)
+
+Register a callback, wrapped with process_event_callback, for a route pattern
+with `:param` and `*wildcard` segments, e.g. "/users/:id" or "GET /files/*path".
+The captured segments are in the scope's "path_params". When several patterns
+match a request, the most specific one is used.
+"""
+function register_pattern_handler(pattern::String, handler)
+    precompile(handler, (Ptr{AsgiEvent},))
+    c_handler = keep_callback!(pattern, handler, @cfunction($handler, Ptr{AsgiResponse}, (Ptr{AsgiEvent},)))
+    result = ccall((:RegisterEventCallbackPattern, libpath), Cstring,
+        (Cstring, Ptr{Cvoid}),
+        pattern, c_handler)
+
+    message = unsafe_string(result)
+    free_cstring(result)
+    @info message
+    return message
+end
+
+"""
+    register_prefix_handler(prefix::String, handler)
+
+Register a callback, wrapped with process_event_callback, for every path under
+prefix, e.g. "/app" for a single-page app. Of several matching prefixes the
+longest wins, and a handler registered for the path itself always wins over a
+prefix.
+"""
+function register_prefix_handler(prefix::String, handler)
+    precompile(handler, (Ptr{AsgiEvent},))
+    c_handler = keep_callback!("prefix " * prefix, handler, @cfunction($handler, Ptr{AsgiResponse}, (Ptr{AsgiEvent},)))
+    result = ccall((:RegisterEventCallbackPrefix, libpath), Cstring,
         (Cstring, Ptr{Cvoid}),
-        path_cstr, c_handler)
+        prefix, c_handler)
+
+    message = unsafe_string(result)
+    free_cstring(result)
+    @info message
+    return message
+end
+
+"""
+    register_static_dir(url_prefix::String, dir::String)
+
+Serve the files under dir at url_prefix, e.g. "/static". Handlers registered
+for a path or prefix win over static files, while the "/" handler of
+`register_event_handler` only gets the paths no file matches. An empty dir
+removes the mount.
+"""
+function register_static_dir(url_prefix::String, dir::String)
+    result = ccall((:RegisterStaticDir, libpath), Cstring, (Cstring, Cstring), url_prefix, dir)
+
+    message = unsafe_string(result)
+    free_cstring(result)
+    @info message
+    return message
+end
+
+"""
+    register_lifespan_handler(handler::Function)
+
+Register a callback, wrapped with process_event_callback, for the
+lifespan.startup and lifespan.shutdown events. Returning (status, headers, body)
+with status >= 400 from lifespan.startup makes start_server fail with body as
+the message.
+"""
+function register_lifespan_handler(handler)
+    precompile(handler, (Ptr{AsgiEvent},))
+    c_handler = keep_callback!("lifespan", handler, @cfunction($handler, Ptr{AsgiResponse}, (Ptr{AsgiEvent},)))
+    result = ccall((:RegisterLifespanCallback, libpath), Cstring, (Ptr{Cvoid},), c_handler)
 
     message = unsafe_string(result)
-    Libc.free(result)
+    free_cstring(result)
     @info message
     return message
 end
@@ -319,14 +560,17 @@ function register_event_handler(handler::Function)
 end
 
 """
-    start_server(port::Int)
+    start_server(port::Int; max_concurrent::Int=0)
 
-Start the ASGI HTTP server on the specified port.
+Start the ASGI HTTP server on the specified port, processing at most
+max_concurrent requests at once (0 for the default of 1000). Handlers
+registered before, including those of an earlier run, are served.
 """
-function start_server(port::Int)
-    result = ccall((:StartServer, libpath), Cstring, (Cint,), port)
+function start_server(port::Int; max_concurrent::Int=0)
+    # Go's int (GoInt in libasgi.h) is word sized, as is Julia's Int
+    result = ccall((:StartServer, libpath), Cstring, (Int, Int), port, max_concurrent)
     message = unsafe_string(result)
-    Libc.free(result)
+    free_cstring(result)
     return message
 end
 
@@ -338,7 +582,7 @@ Stop the running ASGI HTTP server.
 function stop_server()
     result = ccall((:StopServer, libpath), Cstring, ())
     message = unsafe_string(result)
-    Libc.free(result)
+    free_cstring(result)
     return message
 end
 